@@ -0,0 +1,295 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Roles recognised by the access policy, matched against the "role" certificate attribute and User.UserRole
+const (
+	RoleFarmInspector = "farmInspector"
+	RoleHarvester     = "harvester"
+	RoleProcessor     = "processor"
+	RoleExporter      = "exporter"
+	RoleImporter      = "importer"
+	RoleAdmin         = "admin"
+)
+
+const rolePolicyObjectType = "RolePolicy"
+
+// RolePolicy lists the transactions a role is allowed to submit
+type RolePolicy struct {
+	Role         string   `json:"role"`
+	Transactions []string `json:"transactions" metadata:",optional"`
+}
+
+// defaultRolePolicies is used for any role that has no policy stored on the ledger yet
+var defaultRolePolicies = map[string][]string{
+	RoleFarmInspector: {"CreateFarmInspector", "UpdateFarmInspector", "IssueRecall"},
+	RoleHarvester:     {"CreateHarvester", "UpdateHarvester"},
+	RoleProcessor:     {"CreateProcessor", "UpdateProcessor", "MergeBatches"},
+	RoleExporter:      {"CreateExporter", "UpdateExporter", "SplitBatch"},
+	RoleImporter:      {"CreateImporter", "UpdateImporter", "CreateBuy"},
+}
+
+func rolePolicyKey(ctx contractapi.TransactionContextInterface, role string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(rolePolicyObjectType, []string{role})
+}
+
+// getCallerIdentity returns the enrollment ID and role of the submitting client.
+// The role comes from the certificate attribute and, when the caller is also a registered user, must agree with User.UserRole.
+// A registered user is only matched if the certificate was issued by the user's MSP.
+func getCallerIdentity(ctx contractapi.TransactionContextInterface) (string, string, error) {
+	identity := ctx.GetClientIdentity()
+
+	mspId, err := identity.GetMSPID()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get client MSP ID: %v", err)
+	}
+
+	enrollmentId, found, err := identity.GetAttributeValue("hf.EnrollmentID")
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read enrollment ID attribute: %v", err)
+	}
+	if !found {
+		enrollmentId, err = identity.GetID()
+		if err != nil {
+			return "", "", fmt.Errorf("Failed to get client ID: %v", err)
+		}
+	}
+
+	certRole, _, err := identity.GetAttributeValue("role")
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read role attribute: %v", err)
+	}
+
+	userKey, err := entityKey(ctx, docTypeUser, enrollmentId)
+	if err != nil {
+		return "", "", err
+	}
+	userJSON, err := ctx.GetStub().GetState(userKey)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read user %s: %v", enrollmentId, err)
+	}
+	if userJSON == nil {
+		if certRole == "" {
+			return "", "", fmt.Errorf("Caller %s has no role attribute and is not a registered user", enrollmentId)
+		}
+		return enrollmentId, certRole, nil
+	}
+
+	var user User
+	err = json.Unmarshal(userJSON, &user)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to unmarshal user data: %v", err)
+	}
+
+	if user.UserMspId != "" && user.UserMspId != mspId {
+		return "", "", fmt.Errorf("User %s is bound to %s, not %s", enrollmentId, user.UserMspId, mspId)
+	}
+	if certRole != "" && user.UserRole != "" && certRole != user.UserRole {
+		return "", "", fmt.Errorf("Certificate role %s does not match registered role %s", certRole, user.UserRole)
+	}
+	if certRole == "" {
+		certRole = user.UserRole
+	}
+
+	return enrollmentId, certRole, nil
+}
+
+// getRolePolicy reads the ledger policy for a role, falling back to the built-in defaults
+func getRolePolicy(ctx contractapi.TransactionContextInterface, role string) (RolePolicy, error) {
+	key, err := rolePolicyKey(ctx, role)
+	if err != nil {
+		return RolePolicy{}, fmt.Errorf("Failed to create policy key: %v", err)
+	}
+
+	policyJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return RolePolicy{}, fmt.Errorf("Failed to read policy for role %s: %v", role, err)
+	}
+	if policyJSON == nil {
+		return RolePolicy{Role: role, Transactions: defaultRolePolicies[role]}, nil
+	}
+
+	var policy RolePolicy
+	err = json.Unmarshal(policyJSON, &policy)
+	if err != nil {
+		return RolePolicy{}, fmt.Errorf("Failed to unmarshal policy data: %v", err)
+	}
+
+	return policy, nil
+}
+
+func putRolePolicy(ctx contractapi.TransactionContextInterface, policy RolePolicy) error {
+	key, err := rolePolicyKey(ctx, policy.Role)
+	if err != nil {
+		return fmt.Errorf("Failed to create policy key: %v", err)
+	}
+
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal policy: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, policyJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save policy: %v", err)
+	}
+
+	return nil
+}
+
+// checkAccess returns the caller's enrollment ID and role if the role may submit the named transaction.
+// Admins may submit every transaction.
+func checkAccess(ctx contractapi.TransactionContextInterface, transaction string) (string, string, error) {
+	callerId, role, err := getCallerIdentity(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if role == RoleAdmin {
+		return callerId, role, nil
+	}
+
+	policy, err := getRolePolicy(ctx, role)
+	if err != nil {
+		return "", "", err
+	}
+	for _, allowed := range policy.Transactions {
+		if allowed == transaction {
+			return callerId, role, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("Role %s is not allowed to invoke %s", role, transaction)
+}
+
+func requireAdmin(ctx contractapi.TransactionContextInterface) error {
+	_, role, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if role != RoleAdmin {
+		return fmt.Errorf("Only %s may invoke this transaction", RoleAdmin)
+	}
+	return nil
+}
+
+// SetRolePolicy replaces the list of transactions allowed for a role
+func (s *SmartContract) SetRolePolicy(ctx contractapi.TransactionContextInterface, role string, transactions []string) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if role == RoleAdmin {
+		return fmt.Errorf("The %s role cannot be restricted", RoleAdmin)
+	}
+
+	return putRolePolicy(ctx, RolePolicy{Role: role, Transactions: transactions})
+}
+
+// GrantTransaction allows a role to submit one more transaction
+func (s *SmartContract) GrantTransaction(ctx contractapi.TransactionContextInterface, role string, transaction string) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if role == RoleAdmin {
+		return fmt.Errorf("The %s role cannot be restricted", RoleAdmin)
+	}
+
+	policy, err := getRolePolicy(ctx, role)
+	if err != nil {
+		return err
+	}
+	for _, allowed := range policy.Transactions {
+		if allowed == transaction {
+			return nil
+		}
+	}
+	policy.Transactions = append(policy.Transactions, transaction)
+
+	return putRolePolicy(ctx, policy)
+}
+
+// RevokeTransaction removes a transaction from a role's policy
+func (s *SmartContract) RevokeTransaction(ctx contractapi.TransactionContextInterface, role string, transaction string) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if role == RoleAdmin {
+		return fmt.Errorf("The %s role cannot be restricted", RoleAdmin)
+	}
+
+	policy, err := getRolePolicy(ctx, role)
+	if err != nil {
+		return err
+	}
+	transactions := []string{}
+	for _, allowed := range policy.Transactions {
+		if allowed != transaction {
+			transactions = append(transactions, allowed)
+		}
+	}
+	policy.Transactions = transactions
+
+	return putRolePolicy(ctx, policy)
+}
+
+// GetRolePolicy returns the transactions currently allowed for a role
+func (s *SmartContract) GetRolePolicy(ctx contractapi.TransactionContextInterface, role string) (RolePolicy, error) {
+	policy, err := getRolePolicy(ctx, role)
+	if err != nil {
+		return RolePolicy{}, err
+	}
+	if policy.Transactions == nil {
+		policy.Transactions = []string{}
+	}
+	return policy, nil
+}
+
+// GetAllRolePolicies returns the effective policy of every known role, stored or default
+func (s *SmartContract) GetAllRolePolicies(ctx contractapi.TransactionContextInterface) ([]RolePolicy, error) {
+	roles := map[string]bool{}
+	for role := range defaultRolePolicies {
+		roles[role] = true
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(rolePolicyObjectType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get policies: %v", err)
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		queryResponse, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var policy RolePolicy
+		err = json.Unmarshal(queryResponse.Value, &policy)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal policy data: %v", err)
+		}
+		roles[policy.Role] = true
+	}
+
+	var names []string
+	for role := range roles {
+		names = append(names, role)
+	}
+	sort.Strings(names)
+
+	policies := []RolePolicy{}
+	for _, role := range names {
+		policy, err := s.GetRolePolicy(ctx, role)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,430 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Buy lifecycle states
+const (
+	BuyStatusPending   = "PENDING"
+	BuyStatusPaid      = "PAID"
+	BuyStatusDelivered = "DELIVERED"
+	BuyStatusCancelled = "CANCELLED"
+	BuyStatusRefunded  = "REFUNDED"
+)
+
+// buyEscrowObjectType keys the tokens a paid buy holds until it is delivered or refunded
+const buyEscrowObjectType = "BuyEscrow"
+
+// buyTransition is a step of the buy lifecycle and the parties that may take it
+type buyTransition struct {
+	from    []string
+	buyer   bool
+	seller  bool
+	admin   bool // admins may take the step for either party
+	release bool // the bought quantity goes back on sale
+}
+
+// Paying and confirming delivery move the buyer's tokens, so only the buyer may take those steps
+var buyTransitions = map[string]buyTransition{
+	BuyStatusPaid:      {from: []string{BuyStatusPending}, buyer: true},
+	BuyStatusDelivered: {from: []string{BuyStatusPaid}, buyer: true},
+	BuyStatusCancelled: {from: []string{BuyStatusPending}, buyer: true, seller: true, admin: true, release: true},
+	BuyStatusRefunded:  {from: []string{BuyStatusPaid}, seller: true, admin: true, release: true},
+}
+
+// buyStatus returns the lifecycle state of a buy, buys written while BuyStatus was free text count as pending
+func buyStatus(buy Buy) string {
+	if _, ok := buyTransitions[buy.BuyStatus]; ok || buy.BuyStatus == BuyStatusPending {
+		return buy.BuyStatus
+	}
+	return BuyStatusPending
+}
+
+func buyEscrowKey(ctx contractapi.TransactionContextInterface, batchId string, transactionId string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(buyEscrowObjectType, []string{batchId, transactionId})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create escrow key: %v", err)
+	}
+	return key, nil
+}
+
+func buyKey(ctx contractapi.TransactionContextInterface, batchId string, transactionId string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(docTypeBuy, []string{batchId, transactionId})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create composite key: %v", err)
+	}
+	return key, nil
+}
+
+func formatKilograms(kilograms float64) string {
+	return strconv.FormatFloat(kilograms, 'f', -1, 64)
+}
+
+// sellableKilograms returns the weight of a batch still for sale. Batches imported before this was tracked
+// start from the importer's weight, or the batch quantity, less the buys already made. A split or merged
+// lot only holds its own quantity of what the importer received.
+func sellableKilograms(ctx contractapi.TransactionContextInterface, s *SmartContract, batch Batch) (float64, error) {
+	if batch.Remaining.Unit != "" {
+		kilograms, _ := kilograms(batch.Remaining, "")
+		return kilograms, nil
+	}
+
+	total, known := 0.0, false
+	if len(batch.ParentBatches) == 0 {
+		var importer Importer
+		found, err := readStageRecord(ctx, docTypeImporter, batch.ImporterId, &importer)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			total, known = kilograms(importer.Volume, importer.Quantity)
+		}
+	}
+	if !known {
+		total, known = kilograms(Measure{}, batch.Quantity)
+	}
+	if !known {
+		return 0, fmt.Errorf("Batch %s has no known quantity to sell", batch.BatchId)
+	}
+
+	buys, err := s.GetBuyTransactionsByBatchId(ctx, batch.BatchId)
+	if err != nil {
+		return 0, err
+	}
+	for _, buy := range buys {
+		status := buyStatus(*buy)
+		if status == BuyStatusCancelled || status == BuyStatusRefunded {
+			continue
+		}
+		bought, _ := kilograms(buy.Volume, buy.Quantity)
+		total -= bought
+	}
+	if total < 0 {
+		total = 0
+	}
+	return total, nil
+}
+
+// putBuyIndexes lists a buy under its buyer and its seller, the entries hold the buy's key
+func putBuyIndexes(ctx contractapi.TransactionContextInterface, buy Buy, key string) error {
+	entries := []struct {
+		index string
+		id    string
+	}{
+		{indexBuyByBuyer, buy.BuyerId},
+		{indexBuyBySeller, buy.SellerId},
+	}
+	for _, entry := range entries {
+		index := entry.index
+		indexKey, err := ctx.GetStub().CreateCompositeKey(index, []string{entry.id, buy.TransactionId})
+		if err != nil {
+			return fmt.Errorf("Failed to create %s key: %v", index, err)
+		}
+		err = ctx.GetStub().PutState(indexKey, []byte(key))
+		if err != nil {
+			return fmt.Errorf("Failed to save %s entry: %v", index, err)
+		}
+	}
+	return nil
+}
+
+// IndexBuys lists every buy under its buyer and seller and drops the purchase history users carried
+// before the indexes existed. It returns the number of buys indexed.
+func (s *SmartContract) IndexBuys(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	buyIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeBuy, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get buys: %v", err)
+	}
+	defer buyIterator.Close()
+
+	indexed := 0
+	for buyIterator.HasNext() {
+		queryResponse, err := buyIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var buy Buy
+		err = json.Unmarshal(queryResponse.Value, &buy)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to unmarshal buy data: %v", err)
+		}
+		err = putBuyIndexes(ctx, buy, queryResponse.Key)
+		if err != nil {
+			return 0, err
+		}
+		indexed++
+	}
+
+	userIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeUser, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get users: %v", err)
+	}
+	defer userIterator.Close()
+
+	for userIterator.HasNext() {
+		queryResponse, err := userIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		// Unmarshal into a map so the dropped field can be removed without touching the others
+		var record map[string]interface{}
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			continue
+		}
+		if _, ok := record["userBuyProducts"]; !ok {
+			continue
+		}
+		delete(record, "userBuyProducts")
+
+		userJSON, err := json.Marshal(record)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to marshal user: %v", err)
+		}
+		err = ctx.GetStub().PutState(queryResponse.Key, userJSON)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to save user: %v", err)
+		}
+	}
+
+	return indexed, nil
+}
+
+// transferPurchasedPortion gives the buyer's org a lot of its own, split from the sold batch, for the weight it bought
+func transferPurchasedPortion(ctx contractapi.TransactionContextInterface, buy *Buy, buyer User, kilograms float64) error {
+	if buyer.UserMspId == "" {
+		return fmt.Errorf("Buyer %s is not bound to an MSP", buyer.UserId)
+	}
+
+	parentKey, parent, err := getBatch(ctx, buy.BatchId)
+	if err != nil {
+		return err
+	}
+
+	childId := buy.BatchId + "-" + buy.TransactionId
+	childKey, err := newChildBatch(ctx, childId)
+	if err != nil {
+		return err
+	}
+
+	quantity := formatKilograms(kilograms)
+	child := parent
+	child.BatchId = childId
+	child.QRCode = ""
+	child.Quantity = quantity
+	child.Remaining = Measure{Value: kilograms, Unit: "kg"}
+	child.BatchStatus = BatchStatusImported
+	child.OwnerMspId = buyer.UserMspId
+	child.ParentBatches = []BatchLink{{BatchId: parent.BatchId, Quantity: quantity}}
+	child.ChildBatches = nil
+
+	err = putBatch(ctx, childKey, child)
+	if err != nil {
+		return err
+	}
+	err = setOrgEndorsementPolicy(ctx, childKey, buyer.UserMspId)
+	if err != nil {
+		return err
+	}
+
+	parent.ChildBatches = append(parent.ChildBatches, BatchLink{BatchId: childId, Quantity: quantity})
+	err = putBatch(ctx, parentKey, parent)
+	if err != nil {
+		return err
+	}
+
+	buy.PurchasedBatchId = childId
+	return nil
+}
+
+// lockBuyPayment takes the payment of a buy out of the buyer's account and holds it in the buy's escrow
+func lockBuyPayment(ctx contractapi.TransactionContextInterface, s *SmartContract, buy Buy, payment int64) error {
+	buyer, err := getUserAccount(ctx, s, buy.BuyerId)
+	if err != nil {
+		return err
+	}
+	err = addTokens(ctx, buyer, -payment)
+	if err != nil {
+		return err
+	}
+	escrowKey, err := buyEscrowKey(ctx, buy.BatchId, buy.TransactionId)
+	if err != nil {
+		return err
+	}
+	return writeTokenAmount(ctx, escrowKey, payment)
+}
+
+// settleBuyPayment pays what the buy's escrow holds out to the given user and empties the escrow
+func settleBuyPayment(ctx contractapi.TransactionContextInterface, s *SmartContract, buy Buy, recipientId string) error {
+	escrowKey, err := buyEscrowKey(ctx, buy.BatchId, buy.TransactionId)
+	if err != nil {
+		return err
+	}
+	held, err := readTokenAmount(ctx, escrowKey)
+	if err != nil {
+		return err
+	}
+	if held == 0 {
+		return nil
+	}
+	recipient, err := getUserAccount(ctx, s, recipientId)
+	if err != nil {
+		return err
+	}
+	err = addTokens(ctx, recipient, held)
+	if err != nil {
+		return err
+	}
+	return writeTokenAmount(ctx, escrowKey, 0)
+}
+
+// advanceBuy moves a buy to the given status on behalf of its buyer or seller
+func (s *SmartContract) advanceBuy(ctx contractapi.TransactionContextInterface, batchId string, transactionId string, status string) error {
+	callerId, role, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+
+	key, err := buyKey(ctx, batchId, transactionId)
+	if err != nil {
+		return err
+	}
+	buyJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to read buy: %v", err)
+	}
+	if buyJSON == nil {
+		return fmt.Errorf("Buy transaction %s does not exist for BatchId %s", transactionId, batchId)
+	}
+	var buy Buy
+	err = json.Unmarshal(buyJSON, &buy)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal buy data: %v", err)
+	}
+
+	transition := buyTransitions[status]
+	allowed := (transition.admin && role == RoleAdmin) ||
+		(transition.buyer && callerId == buy.BuyerId) ||
+		(transition.seller && callerId == buy.SellerId)
+	if !allowed {
+		return fmt.Errorf("Caller %s may not mark buy %s %s", callerId, transactionId, status)
+	}
+
+	current := buyStatus(buy)
+	valid := false
+	for _, from := range transition.from {
+		if current == from {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("Buy %s is %s and cannot become %s", transactionId, current, status)
+	}
+
+	// Recalled coffee may still be cancelled or refunded, but no longer paid for or delivered
+	if status == BuyStatusPaid || status == BuyStatusDelivered {
+		if err := checkNotRecalled(ctx, batchId); err != nil {
+			return err
+		}
+	}
+
+	bought, _ := kilograms(buy.Volume, buy.Quantity)
+
+	// A cancelled or refunded buy puts its quantity back on sale
+	if transition.release {
+		batchKey, batch, err := getBatch(ctx, batchId)
+		if err != nil {
+			return err
+		}
+		remaining, err := sellableKilograms(ctx, s, batch)
+		if err != nil {
+			return err
+		}
+		batch.Remaining = Measure{Value: remaining + bought, Unit: "kg"}
+		err = putBatch(ctx, batchKey, batch)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Paying locks the buyer's tokens in escrow. The amount is part of the private terms,
+	// settled against the copy the peer's org holds.
+	if status == BuyStatusPaid {
+		payment, err := buyPaymentAmount(ctx, buy)
+		if err != nil {
+			return err
+		}
+		if payment > 0 {
+			err = lockBuyPayment(ctx, s, buy, payment)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// A refund gives the escrowed tokens back to the buyer
+	if status == BuyStatusRefunded {
+		err = settleBuyPayment(ctx, s, buy, buy.BuyerId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The buyer confirming delivery takes over the bought weight and releases the escrow to the seller in one transaction
+	if status == BuyStatusDelivered {
+		err = settleBuyPayment(ctx, s, buy, buy.SellerId)
+		if err != nil {
+			return err
+		}
+		buyer, err := s.ViewUser(ctx, buy.BuyerId)
+		if err != nil {
+			return err
+		}
+		err = transferPurchasedPortion(ctx, &buy, buyer, bought)
+		if err != nil {
+			return err
+		}
+	}
+
+	buy.BuyStatus = status
+	buyJSON, err = json.Marshal(buy)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal buy: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, buyJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save buy: %v", err)
+	}
+	return nil
+}
+
+// PayBuy records that the buyer paid for a pending buy, the payment is held in escrow until delivery or refund
+func (s *SmartContract) PayBuy(ctx contractapi.TransactionContextInterface, batchId string, transactionId string) error {
+	return s.advanceBuy(ctx, batchId, transactionId, BuyStatusPaid)
+}
+
+// DeliverBuy records that the buyer received a paid buy, the buyer's org becomes owner of the bought portion
+// and the escrowed payment goes to the seller
+func (s *SmartContract) DeliverBuy(ctx contractapi.TransactionContextInterface, batchId string, transactionId string) error {
+	return s.advanceBuy(ctx, batchId, transactionId, BuyStatusDelivered)
+}
+
+// CancelBuy withdraws a buy that was not paid yet
+func (s *SmartContract) CancelBuy(ctx contractapi.TransactionContextInterface, batchId string, transactionId string) error {
+	return s.advanceBuy(ctx, batchId, transactionId, BuyStatusCancelled)
+}
+
+// RefundBuy records that the seller refunded a paid buy instead of delivering it, the escrowed payment goes back to the buyer
+func (s *SmartContract) RefundBuy(ctx contractapi.TransactionContextInterface, batchId string, transactionId string) error {
+	return s.advanceBuy(ctx, batchId, transactionId, BuyStatusRefunded)
+}
@@ -0,0 +1,232 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// newPendingBuy stores batch B1 with 100 kg left for sale after a pending buy of 30 kg
+// by bob from alice, whose private terms settle 50 tokens
+func newPendingBuy(t *testing.T) (*mockLedger, TokenAccount, TokenAccount) {
+	l := newMockLedger(t)
+	alice := l.addUser("Org1MSP", "alice", "")
+	bob := l.addUser("Org1MSP", "bob", "")
+	l.fund(80, bob)
+
+	l.put(docTypeBatch, "B1", Batch{DocType: docTypeBatch, BatchId: "B1", BatchStatus: BatchStatusImported, Remaining: Measure{Value: 100, Unit: "kg"}})
+
+	ctx := l.as("Org1MSP", "setup", RoleAdmin)
+	buy := Buy{DocType: docTypeBuy, BatchId: "B1", TransactionId: "T1", BuyerId: "bob", SellerId: "alice", Volume: Measure{Value: 30, Unit: "kg"}, PriceHash: "hash", BuyStatus: BuyStatusPending}
+	key, err := buyKey(ctx, "B1", "T1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buyJSON, _ := json.Marshal(buy)
+	if err := l.stub.PutState(key, buyJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := ctx.GetStub().CreateCompositeKey(buyPrivateObjectType, []string{"B1", "T1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	detailsJSON, _ := json.Marshal(BuyPrivateDetails{BatchId: "B1", TransactionId: "T1", Price: "50", PaymentAmount: 50})
+	if err := l.stub.PutPrivateData(orgCollection("Org1MSP"), privateKey, detailsJSON); err != nil {
+		t.Fatal(err)
+	}
+	return l, alice, bob
+}
+
+func (l *mockLedger) buy(batchId string, transactionId string) Buy {
+	l.t.Helper()
+	key, err := buyKey(l.as("Org1MSP", "setup", RoleAdmin), batchId, transactionId)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	var buy Buy
+	if err := json.Unmarshal(l.stub.State[key], &buy); err != nil {
+		l.t.Fatal(err)
+	}
+	return buy
+}
+
+func (l *mockLedger) escrow(batchId string, transactionId string) int64 {
+	l.t.Helper()
+	ctx := l.as("Org1MSP", "setup", RoleAdmin)
+	key, err := buyEscrowKey(ctx, batchId, transactionId)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	held, err := readTokenAmount(ctx, key)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return held
+}
+
+func TestPayBuyLocksPaymentInEscrow(t *testing.T) {
+	l, _, bob := newPendingBuy(t)
+	s := new(SmartContract)
+
+	if err := s.PayBuy(l.as("Org1MSP", "alice", ""), "B1", "T1"); err == nil {
+		t.Fatal("the seller paid for the buyer")
+	}
+	if err := s.DeliverBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err == nil {
+		t.Fatal("an unpaid buy was delivered")
+	}
+	if err := s.PayBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := l.buy("B1", "T1").BuyStatus; status != BuyStatusPaid {
+		t.Fatalf("buy is %s, want %s", status, BuyStatusPaid)
+	}
+	if held := l.escrow("B1", "T1"); held != 50 {
+		t.Fatalf("escrow holds %d tokens, want 50", held)
+	}
+	if got := l.balance(bob); got != 30 {
+		t.Fatalf("bob holds %d tokens, want 30", got)
+	}
+	if err := s.PayBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err == nil {
+		t.Fatal("a buy was paid twice")
+	}
+	if err := s.CancelBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err == nil {
+		t.Fatal("a paid buy was cancelled instead of refunded")
+	}
+}
+
+func TestPayBuyRefusesOverdraft(t *testing.T) {
+	l, _, bob := newPendingBuy(t)
+	s := new(SmartContract)
+	if err := s.Transfer(l.as("Org1MSP", "bob", ""), TokenAccount{MspId: "Org1MSP", EnrollmentId: "alice"}, 40); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.PayBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err == nil {
+		t.Fatal("bob paid 50 tokens holding 40")
+	}
+	if got := l.balance(bob); got != 40 {
+		t.Fatalf("bob holds %d tokens, want 40", got)
+	}
+}
+
+func TestRefundBuyReturnsPaymentAndQuantity(t *testing.T) {
+	l, alice, bob := newPendingBuy(t)
+	s := new(SmartContract)
+	if err := s.PayBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RefundBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err == nil {
+		t.Fatal("the buyer refunded their own buy")
+	}
+	if err := s.RefundBuy(l.as("Org1MSP", "alice", ""), "B1", "T1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := l.buy("B1", "T1").BuyStatus; status != BuyStatusRefunded {
+		t.Fatalf("buy is %s, want %s", status, BuyStatusRefunded)
+	}
+	if held := l.escrow("B1", "T1"); held != 0 {
+		t.Fatalf("escrow still holds %d tokens", held)
+	}
+	if got := l.balance(bob); got != 80 {
+		t.Fatalf("bob holds %d tokens, want 80", got)
+	}
+	if got := l.balance(alice); got != 0 {
+		t.Fatalf("alice holds %d tokens, want 0", got)
+	}
+	_, batch, err := getBatch(l.as("Org1MSP", "setup", RoleAdmin), "B1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Remaining.Value != 130 {
+		t.Fatalf("batch has %v kg for sale, want 130", batch.Remaining.Value)
+	}
+	if err := s.DeliverBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err == nil {
+		t.Fatal("a refunded buy was delivered")
+	}
+}
+
+func TestDeliverBuyPaysSellerAndSplitsBatch(t *testing.T) {
+	l, alice, bob := newPendingBuy(t)
+	s := new(SmartContract)
+	if err := s.PayBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeliverBuy(l.as("Org1MSP", "alice", ""), "B1", "T1"); err == nil {
+		t.Fatal("the seller confirmed delivery for the buyer")
+	}
+	if err := s.DeliverBuy(l.as("Org1MSP", "bob", ""), "B1", "T1"); err != nil {
+		t.Fatal(err)
+	}
+
+	buy := l.buy("B1", "T1")
+	if buy.BuyStatus != BuyStatusDelivered {
+		t.Fatalf("buy is %s, want %s", buy.BuyStatus, BuyStatusDelivered)
+	}
+	if got := l.balance(alice); got != 50 {
+		t.Fatalf("alice holds %d tokens, want 50", got)
+	}
+	if got := l.balance(bob); got != 30 {
+		t.Fatalf("bob holds %d tokens, want 30", got)
+	}
+	if held := l.escrow("B1", "T1"); held != 0 {
+		t.Fatalf("escrow still holds %d tokens", held)
+	}
+
+	_, child, err := getBatch(l.as("Org1MSP", "setup", RoleAdmin), buy.PurchasedBatchId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.Remaining.Value != 30 || child.OwnerMspId != "Org1MSP" {
+		t.Fatalf("bought lot holds %v kg for %s, want 30 kg for Org1MSP", child.Remaining.Value, child.OwnerMspId)
+	}
+	if err := s.RefundBuy(l.as("Org1MSP", "alice", ""), "B1", "T1"); err == nil {
+		t.Fatal("a delivered buy was refunded")
+	}
+}
+
+func TestCreateBuyChecksCustodyAndRemainingQuantity(t *testing.T) {
+	l := newMockLedger(t)
+	s := new(SmartContract)
+	l.addUser("Org1MSP", "alice", RoleImporter)
+	l.addUser("Org2MSP", "bob", RoleImporter)
+	l.put(docTypeBatch, "B1", Batch{DocType: docTypeBatch, BatchId: "B1", BatchStatus: BatchStatusImported, OwnerMspId: "Org1MSP", Remaining: Measure{Value: 100, Unit: "kg"}})
+
+	sell := func(seller string, mspId string, transactionId string, kilograms float64) error {
+		buy := Buy{BatchId: "B1", TransactionId: transactionId, BuyerId: "bob", SellerId: seller, Volume: Measure{Value: kilograms, Unit: "kg"}}
+		if seller == "bob" {
+			buy.BuyerId = "alice"
+		}
+		return s.CreateBuy(l.as(mspId, seller, ""), buy)
+	}
+
+	if err := sell("bob", "Org2MSP", "T1", 10); err == nil {
+		t.Fatal("an importer outside the org holding the batch sold it")
+	}
+	if err := sell("alice", "Org1MSP", "T1", 120); err == nil {
+		t.Fatal("more was sold than the batch holds")
+	}
+	if err := sell("alice", "Org1MSP", "T1", 70); err != nil {
+		t.Fatal(err)
+	}
+	if err := sell("alice", "Org1MSP", "T1", 10); err == nil {
+		t.Fatal("a buy was recorded twice under one transaction ID")
+	}
+	if err := sell("alice", "Org1MSP", "T2", 40); err == nil {
+		t.Fatal("the second buy sold more than the first one left")
+	}
+
+	if status := l.buy("B1", "T1").BuyStatus; status != BuyStatusPending {
+		t.Fatalf("buy is %s, want %s", status, BuyStatusPending)
+	}
+	_, batch, err := getBatch(l.as("Org1MSP", "setup", RoleAdmin), "B1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Remaining.Value != 30 || batch.BatchStatus != BatchStatusSold {
+		t.Fatalf("batch is %s with %v kg for sale, want %s with 30", batch.BatchStatus, batch.Remaining.Value, BatchStatusSold)
+	}
+}
@@ -0,0 +1,319 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	docTypeCertificationBody = "CertificationBody"
+	docTypeCertificate       = "Certificate"
+
+	// certBodyAttribute names the certification body a client acts for, needed when several bodies share an MSP
+	certBodyAttribute = "certBody"
+
+	// Validity dates of a certificate, both inclusive
+	certificateDateLayout = "2006-01-02"
+)
+
+// Certificate states
+const (
+	CertificateStatusActive    = "ACTIVE"
+	CertificateStatusSuspended = "SUSPENDED"
+	CertificateStatusRevoked   = "REVOKED"
+)
+
+// CertificationBody is an accredited issuer of certificates, acting through the clients of its MSP
+type CertificationBody struct {
+	DocType    string `json:"docType" metadata:",optional"`
+	BodyId     string `json:"bodyId"`
+	Name       string `json:"name"`
+	MspId      string `json:"mspId"`
+	Accredited bool   `json:"accredited"`
+}
+
+// Certificate is a certification issued by an accredited body. This is the only certificate registry,
+// the order chaincode (supplychain1.go) reads certificates from it with ViewCertificate.
+type Certificate struct {
+	DocType       string   `json:"docType" metadata:",optional"`
+	CertificateNo string   `json:"certificateNo"`
+	IssuerId      string   `json:"issuerId"`
+	Holder        string   `json:"holder" metadata:",optional"` // farmer registration number, or supplier user ID for the order chaincode, "" if not bound to a holder
+	Scope         string   `json:"scope"`
+	ProductTypes  []string `json:"productTypes" metadata:",optional"` // "" or empty covers every product
+	ValidFrom     string   `json:"validFrom"`
+	ValidTo       string   `json:"validTo"`
+	DocumentHash  string   `json:"documentHash"`
+	Status        string   `json:"status" metadata:",optional"`
+	StatusReason  string   `json:"statusReason" metadata:",optional"`
+	IssuedAt      string   `json:"issuedAt" metadata:",optional"`
+	UpdatedAt     string   `json:"updatedAt" metadata:",optional"`
+}
+
+func getCertificationBody(ctx contractapi.TransactionContextInterface, bodyId string) (CertificationBody, error) {
+	var body CertificationBody
+	found, err := readStageRecord(ctx, docTypeCertificationBody, bodyId, &body)
+	if err != nil {
+		return CertificationBody{}, err
+	}
+	if !found {
+		return CertificationBody{}, fmt.Errorf("Certification body %s does not exist", bodyId)
+	}
+	return body, nil
+}
+
+// requireCertificationBody checks that the caller acts for the given accredited body
+func requireCertificationBody(ctx contractapi.TransactionContextInterface, bodyId string) error {
+	body, err := getCertificationBody(ctx, bodyId)
+	if err != nil {
+		return err
+	}
+	if !body.Accredited {
+		return fmt.Errorf("Certification body %s is not accredited", bodyId)
+	}
+
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+	if mspId != body.MspId {
+		return fmt.Errorf("Clients of %s cannot act for certification body %s", mspId, bodyId)
+	}
+	attribute, found, err := ctx.GetClientIdentity().GetAttributeValue(certBodyAttribute)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s attribute: %v", certBodyAttribute, err)
+	}
+	if found && attribute != bodyId {
+		return fmt.Errorf("Client acts for certification body %s, not %s", attribute, bodyId)
+	}
+	return nil
+}
+
+func getCertificate(ctx contractapi.TransactionContextInterface, certificateNo string) (string, Certificate, error) {
+	key, err := entityKey(ctx, docTypeCertificate, certificateNo)
+	if err != nil {
+		return "", Certificate{}, err
+	}
+	certificateJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return "", Certificate{}, fmt.Errorf("Failed to read certificate %s: %v", certificateNo, err)
+	}
+	if certificateJSON == nil {
+		return "", Certificate{}, fmt.Errorf("Certificate %s is not registered", certificateNo)
+	}
+
+	var certificate Certificate
+	err = json.Unmarshal(certificateJSON, &certificate)
+	if err != nil {
+		return "", Certificate{}, fmt.Errorf("Failed to unmarshal certificate data: %v", err)
+	}
+	return key, certificate, nil
+}
+
+func putCertificate(ctx contractapi.TransactionContextInterface, key string, certificate Certificate) error {
+	certificateJSON, err := json.Marshal(certificate)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal certificate: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, certificateJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save certificate %s: %v", certificate.CertificateNo, err)
+	}
+	return nil
+}
+
+// checkCertificate returns the certificate if it is registered, active and valid at the transaction time.
+// A non-empty issuer must name the issuing body and a non-empty product type must be covered by the certificate.
+func checkCertificate(ctx contractapi.TransactionContextInterface, certificateNo string, issuer string, productType string) (Certificate, error) {
+	if certificateNo == "" {
+		return Certificate{}, fmt.Errorf("Certificate number is required")
+	}
+	_, certificate, err := getCertificate(ctx, certificateNo)
+	if err != nil {
+		return Certificate{}, err
+	}
+	if certificate.Status != CertificateStatusActive {
+		return Certificate{}, fmt.Errorf("Certificate %s is %s", certificateNo, certificate.Status)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return Certificate{}, err
+	}
+	today := now.UTC().Format(certificateDateLayout)
+	if today < certificate.ValidFrom || today > certificate.ValidTo {
+		return Certificate{}, fmt.Errorf("Certificate %s is valid from %s to %s", certificateNo, certificate.ValidFrom, certificate.ValidTo)
+	}
+
+	if issuer != "" && issuer != certificate.IssuerId {
+		body, err := getCertificationBody(ctx, certificate.IssuerId)
+		if err != nil {
+			return Certificate{}, err
+		}
+		if !strings.EqualFold(issuer, body.Name) {
+			return Certificate{}, fmt.Errorf("Certificate %s was issued by %s, not %s", certificateNo, body.Name, issuer)
+		}
+	}
+
+	if productType != "" && len(certificate.ProductTypes) > 0 {
+		covered := false
+		for _, certified := range certificate.ProductTypes {
+			if strings.EqualFold(certified, productType) {
+				covered = true
+			}
+		}
+		if !covered {
+			return Certificate{}, fmt.Errorf("Certificate %s does not cover %s", certificateNo, productType)
+		}
+	}
+
+	return certificate, nil
+}
+
+// AccreditCertificationBody registers or updates a certification body, withdrawing accreditation stops it issuing
+func (s *SmartContract) AccreditCertificationBody(ctx contractapi.TransactionContextInterface, body CertificationBody) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if body.BodyId == "" || body.MspId == "" {
+		return fmt.Errorf("Certification body needs an ID and an MSP")
+	}
+
+	key, err := entityKey(ctx, docTypeCertificationBody, body.BodyId)
+	if err != nil {
+		return err
+	}
+	body.DocType = docTypeCertificationBody
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal certification body: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, bodyJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save certification body: %v", err)
+	}
+	return nil
+}
+
+// IssueCertificate registers a certificate on behalf of its accredited issuing body
+func (s *SmartContract) IssueCertificate(ctx contractapi.TransactionContextInterface, certificate Certificate) error {
+	if err := requireCertificationBody(ctx, certificate.IssuerId); err != nil {
+		return err
+	}
+
+	if certificate.CertificateNo == "" {
+		return fmt.Errorf("Certificate number is required")
+	}
+	if certificate.DocumentHash == "" {
+		return fmt.Errorf("Certificate document hash is required")
+	}
+	validFrom, err := time.Parse(certificateDateLayout, certificate.ValidFrom)
+	if err != nil {
+		return fmt.Errorf("Invalid validFrom %s, expected YYYY-MM-DD", certificate.ValidFrom)
+	}
+	validTo, err := time.Parse(certificateDateLayout, certificate.ValidTo)
+	if err != nil {
+		return fmt.Errorf("Invalid validTo %s, expected YYYY-MM-DD", certificate.ValidTo)
+	}
+	if validTo.Before(validFrom) {
+		return fmt.Errorf("Certificate cannot expire before it becomes valid")
+	}
+
+	key, err := entityKey(ctx, docTypeCertificate, certificate.CertificateNo)
+	if err != nil {
+		return err
+	}
+	certificateJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to check if certificate exists: %v", err)
+	}
+	if certificateJSON != nil {
+		return fmt.Errorf("Certificate %s already exists", certificate.CertificateNo)
+	}
+
+	certificate.DocType = docTypeCertificate
+	certificate.Status = CertificateStatusActive
+	certificate.StatusReason = ""
+	certificate.IssuedAt, err = txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	certificate.UpdatedAt = certificate.IssuedAt
+	return putCertificate(ctx, key, certificate)
+}
+
+// setCertificateStatus moves a certificate between states on behalf of its issuer or an admin.
+// A revoked certificate stays revoked.
+func setCertificateStatus(ctx contractapi.TransactionContextInterface, certificateNo string, status string, reason string) error {
+	key, certificate, err := getCertificate(ctx, certificateNo)
+	if err != nil {
+		return err
+	}
+
+	_, role, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if role != RoleAdmin {
+		if err := requireCertificationBody(ctx, certificate.IssuerId); err != nil {
+			return err
+		}
+	}
+
+	if certificate.Status == CertificateStatusRevoked {
+		return fmt.Errorf("Certificate %s is revoked", certificateNo)
+	}
+	if status != CertificateStatusActive && reason == "" {
+		return fmt.Errorf("A reason is required")
+	}
+
+	certificate.Status = status
+	certificate.StatusReason = reason
+	certificate.UpdatedAt, err = txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	return putCertificate(ctx, key, certificate)
+}
+
+// SuspendCertificate stops a certificate from being accepted until it is reinstated
+func (s *SmartContract) SuspendCertificate(ctx contractapi.TransactionContextInterface, certificateNo string, reason string) error {
+	return setCertificateStatus(ctx, certificateNo, CertificateStatusSuspended, reason)
+}
+
+// ReinstateCertificate lifts the suspension of a certificate
+func (s *SmartContract) ReinstateCertificate(ctx contractapi.TransactionContextInterface, certificateNo string) error {
+	return setCertificateStatus(ctx, certificateNo, CertificateStatusActive, "")
+}
+
+// RevokeCertificate withdraws a certificate for good
+func (s *SmartContract) RevokeCertificate(ctx contractapi.TransactionContextInterface, certificateNo string, reason string) error {
+	return setCertificateStatus(ctx, certificateNo, CertificateStatusRevoked, reason)
+}
+
+// ViewCertificate retrieves a certificate by its number
+func (s *SmartContract) ViewCertificate(ctx contractapi.TransactionContextInterface, certificateNo string) (Certificate, error) {
+	_, certificate, err := getCertificate(ctx, certificateNo)
+	return certificate, err
+}
+
+// ViewCertificationBody retrieves a certification body by its ID
+func (s *SmartContract) ViewCertificationBody(ctx contractapi.TransactionContextInterface, bodyId string) (CertificationBody, error) {
+	return getCertificationBody(ctx, bodyId)
+}
+
+// checkInspectionCertificate checks the certificate a farm inspection cites against the registry and the batch's farmer
+func checkInspectionCertificate(ctx contractapi.TransactionContextInterface, farmInspector FarmInspector, batch Batch) error {
+	certificate, err := checkCertificate(ctx, farmInspector.CertificateNo, farmInspector.CertificateFrom, farmInspector.ProductName)
+	if err != nil {
+		return err
+	}
+	if certificate.Holder != "" && certificate.Holder != batch.FarmerRegNo {
+		return fmt.Errorf("Certificate %s is held by farmer %s, batch %s belongs to %s", certificate.CertificateNo, certificate.Holder, batch.BatchId, batch.FarmerRegNo)
+	}
+	return nil
+}
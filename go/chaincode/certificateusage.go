@@ -0,0 +1,479 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	// certificateBatchIndex lists the batches whose farm inspection cites a certificate, certificateNo~batchId
+	certificateBatchIndex           = "CertificateBatch"
+	certificateVolumeRuleObjectType = "CertificateVolumeRule"
+)
+
+// CertificateVolumeRule caps the weight of cherry one certificate may cover in a season. The rule with an empty
+// CertificateNo applies to every certificate without a rule of its own.
+type CertificateVolumeRule struct {
+	CertificateNo    string  `json:"certificateNo" metadata:",optional"`
+	MaxKilograms     float64 `json:"maxKilograms"`     // 0 leaves the volume uncapped
+	SeasonStartMonth int     `json:"seasonStartMonth"` // month the harvest season starts in, 1 to 12
+}
+
+// CertificateUsageEntry records a batch certified under a certificate and the harvest weight it covers
+type CertificateUsageEntry struct {
+	CertificateNo    string  `json:"certificateNo"`
+	BatchId          string  `json:"batchId"`
+	FarmInspectionId string  `json:"farmInspectionId"`
+	FarmerRegNo      string  `json:"farmerRegNo"`
+	Season           string  `json:"season"`                                       // season of the inspection, labelled by the year it starts in
+	Kilograms        float64 `json:"kilograms"`                                    // 0 until the batch is harvested
+	WeightUnknown    bool    `json:"weightUnknown,omitempty" metadata:",optional"` // harvested without a readable Volume
+}
+
+// SeasonUsage is the weight a certificate covered in one season
+type SeasonUsage struct {
+	Season       string  `json:"season"`
+	Kilograms    float64 `json:"kilograms"`
+	MaxKilograms float64 `json:"maxKilograms"`
+	Exceeded     bool    `json:"exceeded"`
+}
+
+// CertificateUsage lists where a certificate was used and what looks wrong about it
+type CertificateUsage struct {
+	CertificateNo string                  `json:"certificateNo"`
+	Holder        string                  `json:"holder"`
+	Batches       []CertificateUsageEntry `json:"batches"`
+	Farmers       []string                `json:"farmers"`
+	Seasons       []SeasonUsage           `json:"seasons"`
+	Flagged       bool                    `json:"flagged"`
+	Issues        []string                `json:"issues"`
+}
+
+func certificateVolumeRuleKey(ctx contractapi.TransactionContextInterface, certificateNo string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(certificateVolumeRuleObjectType, []string{certificateNo})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create certificate volume rule key: %v", err)
+	}
+	return key, nil
+}
+
+// getCertificateVolumeRule returns the rule of a certificate, else the default rule, else an uncapped calendar year season
+func getCertificateVolumeRule(ctx contractapi.TransactionContextInterface, certificateNo string) (CertificateVolumeRule, error) {
+	for _, id := range []string{certificateNo, ""} {
+		key, err := certificateVolumeRuleKey(ctx, id)
+		if err != nil {
+			return CertificateVolumeRule{}, err
+		}
+		ruleJSON, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return CertificateVolumeRule{}, fmt.Errorf("Failed to read certificate volume rule: %v", err)
+		}
+		if ruleJSON == nil {
+			continue
+		}
+
+		var rule CertificateVolumeRule
+		err = json.Unmarshal(ruleJSON, &rule)
+		if err != nil {
+			return CertificateVolumeRule{}, fmt.Errorf("Failed to unmarshal certificate volume rule: %v", err)
+		}
+		return rule, nil
+	}
+	return CertificateVolumeRule{CertificateNo: certificateNo, SeasonStartMonth: 1}, nil
+}
+
+// seasonOf labels the season a time falls in, "2024" for calendar year seasons and "2024/25" otherwise
+func seasonOf(t time.Time, startMonth int) string {
+	year := t.UTC().Year()
+	if int(t.UTC().Month()) < startMonth {
+		year--
+	}
+	if startMonth <= 1 {
+		return fmt.Sprintf("%d", year)
+	}
+	return fmt.Sprintf("%d/%02d", year, (year+1)%100)
+}
+
+func certificateBatchKey(ctx contractapi.TransactionContextInterface, certificateNo string, batchId string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(certificateBatchIndex, []string{certificateNo, batchId})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create %s key: %v", certificateBatchIndex, err)
+	}
+	return key, nil
+}
+
+func putCertificateUsageEntry(ctx contractapi.TransactionContextInterface, entry CertificateUsageEntry) error {
+	key, err := certificateBatchKey(ctx, entry.CertificateNo, entry.BatchId)
+	if err != nil {
+		return err
+	}
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal certificate usage: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, entryJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save %s entry: %v", certificateBatchIndex, err)
+	}
+	return nil
+}
+
+// getCertificateUsageEntries lists the batches certified under a certificate, sorted by batch ID
+func getCertificateUsageEntries(ctx contractapi.TransactionContextInterface, certificateNo string) ([]CertificateUsageEntry, error) {
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(certificateBatchIndex, []string{certificateNo})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get %s entries: %v", certificateBatchIndex, err)
+	}
+	defer queryIterator.Close()
+
+	entries := []CertificateUsageEntry{}
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var entry CertificateUsageEntry
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal certificate usage: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// harvestedKilograms is the weight of cherry harvested for a batch, 0 before harvest. unknown is set when the
+// batch was harvested without a readable Volume.
+func harvestedKilograms(ctx contractapi.TransactionContextInterface, batch Batch) (weight float64, unknown bool, err error) {
+	var harvester Harvester
+	found, err := readStageRecord(ctx, docTypeHarvester, batch.HarvesterId, &harvester)
+	if err != nil || !found {
+		return 0, false, err
+	}
+	weight, known := kilograms(harvester.Volume, "")
+	return weight, !known, nil
+}
+
+// indexCertificateUse lists a batch under the certificate its farm inspection cites, in the season the inspection falls in
+func indexCertificateUse(ctx contractapi.TransactionContextInterface, farmInspector FarmInspector, batch Batch, inspectedAt time.Time) error {
+	if farmInspector.CertificateNo == "" {
+		return nil
+	}
+	rule, err := getCertificateVolumeRule(ctx, farmInspector.CertificateNo)
+	if err != nil {
+		return err
+	}
+	weight, unknown, err := harvestedKilograms(ctx, batch)
+	if err != nil {
+		return err
+	}
+	return putCertificateUsageEntry(ctx, CertificateUsageEntry{
+		CertificateNo:    farmInspector.CertificateNo,
+		BatchId:          batch.BatchId,
+		FarmInspectionId: farmInspector.FarmInspectionId,
+		FarmerRegNo:      batch.FarmerRegNo,
+		Season:           seasonOf(inspectedAt, rule.SeasonStartMonth),
+		Kilograms:        weight,
+		WeightUnknown:    unknown,
+	})
+}
+
+// unindexCertificateUse removes a batch from the batches listed under a certificate
+func unindexCertificateUse(ctx contractapi.TransactionContextInterface, certificateNo string, batchId string) error {
+	if certificateNo == "" {
+		return nil
+	}
+	key, err := certificateBatchKey(ctx, certificateNo, batchId)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to delete %s entry: %v", certificateBatchIndex, err)
+	}
+	return nil
+}
+
+// recordCertifiedVolume charges the harvested weight of a batch to the certificate its farm inspection cites,
+// refusing to go over the certificate's cap for the season. A certified harvest must give its weight, or it
+// would escape the cap.
+func recordCertifiedVolume(ctx contractapi.TransactionContextInterface, batch Batch, volume Measure) error {
+	var farmInspector FarmInspector
+	found, err := readStageRecord(ctx, docTypeFarmInspector, batch.FarmInspectionId, &farmInspector)
+	if err != nil {
+		return err
+	}
+	if !found || farmInspector.CertificateNo == "" {
+		return nil
+	}
+	weight, known := kilograms(volume, "")
+	if !known {
+		return fmt.Errorf("Harvest of batch %s must give its Volume, the batch is certified under %s", batch.BatchId, farmInspector.CertificateNo)
+	}
+
+	entries, err := getCertificateUsageEntries(ctx, farmInspector.CertificateNo)
+	if err != nil {
+		return err
+	}
+	var entry *CertificateUsageEntry
+	for i := range entries {
+		if entries[i].BatchId == batch.BatchId {
+			entry = &entries[i]
+		}
+	}
+	rule, err := getCertificateVolumeRule(ctx, farmInspector.CertificateNo)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		// Inspected before usage was indexed, charge it to the current season
+		now, err := txTime(ctx)
+		if err != nil {
+			return err
+		}
+		entry = &CertificateUsageEntry{
+			CertificateNo:    farmInspector.CertificateNo,
+			BatchId:          batch.BatchId,
+			FarmInspectionId: farmInspector.FarmInspectionId,
+			FarmerRegNo:      batch.FarmerRegNo,
+			Season:           seasonOf(now, rule.SeasonStartMonth),
+		}
+	}
+	entry.Kilograms = weight
+	entry.WeightUnknown = false
+
+	if rule.MaxKilograms > 0 {
+		total := weight
+		for _, other := range entries {
+			if other.BatchId != batch.BatchId && other.Season == entry.Season {
+				total += other.Kilograms
+			}
+		}
+		if total > rule.MaxKilograms {
+			return fmt.Errorf("Certificate %s would cover %.2f kg in season %s, the cap is %.2f kg", farmInspector.CertificateNo, total, entry.Season, rule.MaxKilograms)
+		}
+	}
+
+	return putCertificateUsageEntry(ctx, *entry)
+}
+
+// certificateUsage summarises the batches certified under a certificate and flags over-use and reuse across farmers
+func certificateUsage(ctx contractapi.TransactionContextInterface, certificateNo string, entries []CertificateUsageEntry) (CertificateUsage, error) {
+	usage := CertificateUsage{
+		CertificateNo: certificateNo,
+		Batches:       entries,
+		Farmers:       []string{},
+		Seasons:       []SeasonUsage{},
+		Issues:        []string{},
+	}
+
+	_, certificate, err := getCertificate(ctx, certificateNo)
+	if err != nil {
+		usage.Issues = append(usage.Issues, fmt.Sprintf("Certificate %s is not registered", certificateNo))
+	} else {
+		usage.Holder = certificate.Holder
+		if certificate.Status != CertificateStatusActive {
+			usage.Issues = append(usage.Issues, fmt.Sprintf("Certificate %s is %s", certificateNo, certificate.Status))
+		}
+	}
+
+	rule, err := getCertificateVolumeRule(ctx, certificateNo)
+	if err != nil {
+		return CertificateUsage{}, err
+	}
+
+	farmers := map[string]bool{}
+	seasons := map[string]float64{}
+	for _, entry := range entries {
+		for _, farmer := range strings.Split(entry.FarmerRegNo, ", ") {
+			if farmer != "" {
+				farmers[farmer] = true
+			}
+		}
+		seasons[entry.Season] += entry.Kilograms
+	}
+
+	for farmer := range farmers {
+		usage.Farmers = append(usage.Farmers, farmer)
+	}
+	for season, weight := range seasons {
+		usage.Seasons = append(usage.Seasons, SeasonUsage{
+			Season:       season,
+			Kilograms:    weight,
+			MaxKilograms: rule.MaxKilograms,
+			Exceeded:     rule.MaxKilograms > 0 && weight > rule.MaxKilograms,
+		})
+	}
+
+	// Map order is random, sort so every peer returns the same result
+	sort.Strings(usage.Farmers)
+	sort.Slice(usage.Seasons, func(i, j int) bool { return usage.Seasons[i].Season < usage.Seasons[j].Season })
+
+	if len(usage.Farmers) > 1 {
+		usage.Issues = append(usage.Issues, fmt.Sprintf("Certificate %s is used by %d farmers: %s", certificateNo, len(usage.Farmers), strings.Join(usage.Farmers, ", ")))
+	}
+	for _, farmer := range usage.Farmers {
+		if usage.Holder != "" && farmer != usage.Holder {
+			usage.Issues = append(usage.Issues, fmt.Sprintf("Certificate %s is held by %s but used by %s", certificateNo, usage.Holder, farmer))
+		}
+	}
+	for _, season := range usage.Seasons {
+		if season.Exceeded {
+			usage.Issues = append(usage.Issues, fmt.Sprintf("Certificate %s covers %.2f kg in season %s, the cap is %.2f kg", certificateNo, season.Kilograms, season.Season, season.MaxKilograms))
+		}
+	}
+	for _, entry := range entries {
+		if entry.WeightUnknown {
+			usage.Issues = append(usage.Issues, fmt.Sprintf("Certificate %s covers batch %s, whose harvest weight is unknown", certificateNo, entry.BatchId))
+		}
+	}
+	usage.Flagged = len(usage.Issues) > 0
+
+	return usage, nil
+}
+
+// SetCertificateVolumeRule caps the weight one certificate may cover per season, an empty certificate number sets
+// the default for every certificate without a rule of its own. Seasons already recorded keep their labels.
+func (s *SmartContract) SetCertificateVolumeRule(ctx contractapi.TransactionContextInterface, rule CertificateVolumeRule) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if rule.MaxKilograms < 0 {
+		return fmt.Errorf("Volume cap cannot be negative")
+	}
+	if rule.SeasonStartMonth < 1 || rule.SeasonStartMonth > 12 {
+		return fmt.Errorf("Season start month must be between 1 and 12")
+	}
+
+	key, err := certificateVolumeRuleKey(ctx, rule.CertificateNo)
+	if err != nil {
+		return err
+	}
+	ruleJSON, err := json.Marshal(rule)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal certificate volume rule: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, ruleJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save certificate volume rule: %v", err)
+	}
+	return nil
+}
+
+// GetCertificateVolumeRule returns the rule that applies to a certificate
+func (s *SmartContract) GetCertificateVolumeRule(ctx contractapi.TransactionContextInterface, certificateNo string) (CertificateVolumeRule, error) {
+	return getCertificateVolumeRule(ctx, certificateNo)
+}
+
+// GetCertificateUsage lists the batches certified under a certificate, the weight it covered per season and
+// any over-use or reuse across farmers
+func (s *SmartContract) GetCertificateUsage(ctx contractapi.TransactionContextInterface, certificateNo string) (CertificateUsage, error) {
+	entries, err := getCertificateUsageEntries(ctx, certificateNo)
+	if err != nil {
+		return CertificateUsage{}, err
+	}
+	return certificateUsage(ctx, certificateNo, entries)
+}
+
+// FindSuspiciousCertificates lists the usage of every certificate that went over its cap, is used by more than
+// one farmer or by someone other than its holder, is cited while not active, or covers a harvest of unknown weight
+func (s *SmartContract) FindSuspiciousCertificates(ctx contractapi.TransactionContextInterface) ([]CertificateUsage, error) {
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(certificateBatchIndex, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get %s entries: %v", certificateBatchIndex, err)
+	}
+	defer queryIterator.Close()
+
+	// Entries come sorted by certificate number, so each certificate's batches are next to each other
+	grouped := [][]CertificateUsageEntry{}
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var entry CertificateUsageEntry
+		err = json.Unmarshal(queryResponse.Value, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal certificate usage: %v", err)
+		}
+		last := len(grouped) - 1
+		if last >= 0 && grouped[last][0].CertificateNo == entry.CertificateNo {
+			grouped[last] = append(grouped[last], entry)
+		} else {
+			grouped = append(grouped, []CertificateUsageEntry{entry})
+		}
+	}
+
+	suspicious := []CertificateUsage{}
+	for _, entries := range grouped {
+		usage, err := certificateUsage(ctx, entries[0].CertificateNo, entries)
+		if err != nil {
+			return nil, err
+		}
+		if usage.Flagged {
+			suspicious = append(suspicious, usage)
+		}
+	}
+	return suspicious, nil
+}
+
+// IndexCertificateUsage lists every farm inspection recorded before usage was indexed under the certificate it cites,
+// with the weight harvested for its batch. Caps are not enforced on what is already on the ledger, breaches show up
+// in FindSuspiciousCertificates. It returns the number of batches indexed.
+func (s *SmartContract) IndexCertificateUsage(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeFarmInspector, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get farm inspectors: %v", err)
+	}
+	defer queryIterator.Close()
+
+	indexed := 0
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var farmInspector FarmInspector
+		err = json.Unmarshal(queryResponse.Value, &farmInspector)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to unmarshal farm inspector data: %v", err)
+		}
+		if farmInspector.CertificateNo == "" || farmInspector.BatchId == "" {
+			continue
+		}
+		_, batch, err := getBatch(ctx, farmInspector.BatchId)
+		if err != nil {
+			return 0, err
+		}
+
+		// Date the entry by the inspection when its creation time can be read
+		inspectedAt, err := time.Parse(time.RFC3339, farmInspector.FarmInspectionCreatedAt)
+		if err != nil {
+			inspectedAt = now
+		}
+		err = indexCertificateUse(ctx, farmInspector, batch, inspectedAt)
+		if err != nil {
+			return 0, err
+		}
+		indexed++
+	}
+
+	return indexed, nil
+}
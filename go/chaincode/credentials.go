@@ -0,0 +1,228 @@
+package chaincode
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// passwordTransientKey is the transient map entry carrying a user's password, it never reaches the public ledger
+const passwordTransientKey = "password"
+
+// passwordSaltTransientKey is the transient map entry carrying random bytes chosen by the client to salt password hashes.
+// Endorsers cannot draw random numbers of their own, they would disagree on the result.
+const passwordSaltTransientKey = "passwordSalt"
+
+// Passwords are hashed with PBKDF2-HMAC-SHA256
+const (
+	passwordSaltMinLength = 16
+	passwordIterations    = 100000
+	passwordKeyLength     = 32
+)
+
+const userCredentialObjectType = "UserCredential"
+
+// UserCredential is the salted password hash kept in the user's org-private implicit collection
+type UserCredential struct {
+	UserId     string `json:"userId"`
+	Salt       string `json:"salt"`
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations,omitempty"` // PBKDF2 rounds, 0 for credentials hashed with a single SHA-256
+}
+
+// legacyUser picks the plaintext password out of user records written before credentials were moved off-chain
+type legacyUser struct {
+	UserPassword string `json:"userPassword"`
+}
+
+func orgCollection(mspId string) string {
+	return "_implicit_org_" + mspId
+}
+
+// pbkdf2SHA256 derives a key of keyLength bytes from password and salt as RFC 8018 describes
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLength; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var counter [4]byte
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
+
+func hashPassword(salt string, password string, iterations int) string {
+	if iterations == 0 {
+		sum := sha256.Sum256([]byte(salt + password))
+		return hex.EncodeToString(sum[:])
+	}
+	return hex.EncodeToString(pbkdf2SHA256([]byte(password), []byte(salt), iterations, passwordKeyLength))
+}
+
+// getTransientPassword returns the password passed in the transient map, or "" if none was sent
+func getTransientPassword(ctx contractapi.TransactionContextInterface) (string, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return "", fmt.Errorf("Failed to read transient data: %v", err)
+	}
+	return string(transientMap[passwordTransientKey]), nil
+}
+
+// putUserCredential stores a salted hash of the password in the implicit collection of the user's org.
+// The user's salt mixes the client's random salt from the transient map with the user ID, so one salt sent
+// to migrate many users still gives each of them a salt of their own.
+func putUserCredential(ctx contractapi.TransactionContextInterface, userId string, mspId string, password string) error {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("Failed to read transient data: %v", err)
+	}
+	randomSalt := transientMap[passwordSaltTransientKey]
+	if len(randomSalt) < passwordSaltMinLength {
+		return fmt.Errorf("Passwords need at least %d random bytes passed in the transient map under %q", passwordSaltMinLength, passwordSaltTransientKey)
+	}
+	saltSum := sha256.Sum256(append(append([]byte{}, randomSalt...), userId...))
+	salt := hex.EncodeToString(saltSum[:])
+
+	credential := UserCredential{
+		UserId:     userId,
+		Salt:       salt,
+		Hash:       hashPassword(salt, password, passwordIterations),
+		Iterations: passwordIterations,
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(userCredentialObjectType, []string{userId})
+	if err != nil {
+		return fmt.Errorf("Failed to create credential key: %v", err)
+	}
+
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal credential: %v", err)
+	}
+
+	err = ctx.GetStub().PutPrivateData(orgCollection(mspId), key, credentialJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save credential: %v", err)
+	}
+
+	return nil
+}
+
+// VerifyUserPassword checks the password in the transient map against the stored hash.
+// It must be evaluated on a peer of the user's org, the only one holding the credential.
+func (s *SmartContract) VerifyUserPassword(ctx contractapi.TransactionContextInterface, userId string) (bool, error) {
+	user, err := s.ViewUser(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+
+	password, err := getTransientPassword(ctx)
+	if err != nil {
+		return false, err
+	}
+	if password == "" {
+		return false, fmt.Errorf("Password must be passed in the transient map under %q", passwordTransientKey)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(userCredentialObjectType, []string{userId})
+	if err != nil {
+		return false, fmt.Errorf("Failed to create credential key: %v", err)
+	}
+
+	credentialJSON, err := ctx.GetStub().GetPrivateData(orgCollection(user.UserMspId), key)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read credential: %v", err)
+	}
+	if credentialJSON == nil {
+		return false, nil
+	}
+
+	var credential UserCredential
+	err = json.Unmarshal(credentialJSON, &credential)
+	if err != nil {
+		return false, fmt.Errorf("Failed to unmarshal credential: %v", err)
+	}
+
+	hash := hashPassword(credential.Salt, password, credential.Iterations)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(credential.Hash)) == 1, nil
+}
+
+// ScrubUserPasswords moves plaintext passwords left in public user records into the private credential store
+// and rewrites the records without them. It returns the number of users scrubbed.
+func (s *SmartContract) ScrubUserPasswords(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	callerMspId, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get client MSP ID: %v", err)
+	}
+
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeUser, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get users: %v", err)
+	}
+	defer queryIterator.Close()
+
+	scrubbed := 0
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var legacy legacyUser
+		if err := json.Unmarshal(queryResponse.Value, &legacy); err != nil || legacy.UserPassword == "" {
+			continue
+		}
+
+		var user User
+		err = json.Unmarshal(queryResponse.Value, &user)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to unmarshal user data: %v", err)
+		}
+		if user.UserMspId == "" {
+			user.UserMspId = callerMspId
+		}
+
+		err = putUserCredential(ctx, user.UserId, user.UserMspId, legacy.UserPassword)
+		if err != nil {
+			return 0, err
+		}
+
+		// User has no password field, so re-marshalling drops it
+		userJSON, err := json.Marshal(user)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to marshal user: %v", err)
+		}
+		err = ctx.GetStub().PutState(queryResponse.Key, userJSON)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to update user: %v", err)
+		}
+		scrubbed++
+	}
+
+	return scrubbed, nil
+}
@@ -0,0 +1,388 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// BatchLink ties a batch to a parent or child lot
+type BatchLink struct {
+	BatchId      string `json:"batchId"`
+	Quantity     string `json:"quantity,omitempty" metadata:",optional"`     // split: quantity of the parent carried by the child
+	Contribution string `json:"contribution,omitempty" metadata:",optional"` // merge: percentage of the child coming from the parent
+}
+
+// BatchSplit describes one child lot of a split
+type BatchSplit struct {
+	BatchId  string `json:"batchId"`
+	Quantity string `json:"quantity"`
+	QRCode   string `json:"qrCode" metadata:",optional"`
+}
+
+// GenealogyEdge is a parent to child link of the genealogy graph
+type GenealogyEdge struct {
+	Parent       string `json:"parent"`
+	Child        string `json:"child"`
+	Quantity     string `json:"quantity,omitempty" metadata:",optional"`
+	Contribution string `json:"contribution,omitempty" metadata:",optional"`
+}
+
+// BatchGenealogy holds every ancestor and descendant of a batch and the links between them
+type BatchGenealogy struct {
+	BatchId string          `json:"batchId"`
+	Batches []Batch         `json:"batches"`
+	Edges   []GenealogyEdge `json:"edges"`
+}
+
+func getBatch(ctx contractapi.TransactionContextInterface, batchId string) (string, Batch, error) {
+	key, err := entityKey(ctx, docTypeBatch, batchId)
+	if err != nil {
+		return "", Batch{}, err
+	}
+	batchJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return "", Batch{}, fmt.Errorf("Failed to read batch %s: %v", batchId, err)
+	}
+	if batchJSON == nil {
+		return "", Batch{}, fmt.Errorf("Batch with ID %s does not exist", batchId)
+	}
+
+	var batch Batch
+	err = json.Unmarshal(batchJSON, &batch)
+	if err != nil {
+		return "", Batch{}, fmt.Errorf("Failed to unmarshal batch data: %v", err)
+	}
+	return key, batch, nil
+}
+
+func putBatch(ctx contractapi.TransactionContextInterface, key string, batch Batch) error {
+	batchJSON, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal batch: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, batchJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save batch %s: %v", batch.BatchId, err)
+	}
+	return nil
+}
+
+// newChildBatch checks that a child lot ID is free and returns its key
+func newChildBatch(ctx contractapi.TransactionContextInterface, batchId string) (string, error) {
+	if batchId == "" {
+		return "", fmt.Errorf("Child batch must have an ID")
+	}
+	key, err := entityKey(ctx, docTypeBatch, batchId)
+	if err != nil {
+		return "", err
+	}
+	batchJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return "", fmt.Errorf("Failed to check if batch exists: %v", err)
+	}
+	if batchJSON != nil {
+		return "", fmt.Errorf("Batch with ID %s already exists", batchId)
+	}
+	return key, nil
+}
+
+// parseBatchQuantity reads a quantity, "" counts as unknown and returns ok false
+func parseBatchQuantity(quantity string) (float64, bool, error) {
+	if quantity == "" {
+		return 0, false, nil
+	}
+	value, err := strconv.ParseFloat(quantity, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Invalid quantity %s", quantity)
+	}
+	return value, true, nil
+}
+
+// joinDistinct joins the distinct non-empty values in order of first appearance
+func joinDistinct(values []string) string {
+	seen := map[string]bool{}
+	var distinct []string
+	for _, value := range values {
+		if value != "" && !seen[value] {
+			seen[value] = true
+			distinct = append(distinct, value)
+		}
+	}
+	return strings.Join(distinct, ", ")
+}
+
+// SplitBatch divides a lot into child lots, for example an export lot into containers.
+// The children carry the parent's provenance and stage, the parent becomes split and takes no further stages.
+func (s *SmartContract) SplitBatch(ctx contractapi.TransactionContextInterface, parentBatchId string, children []BatchSplit) error {
+	if _, _, err := checkAccess(ctx, "SplitBatch"); err != nil {
+		return err
+	}
+	if len(children) < 2 {
+		return fmt.Errorf("A split needs at least two child batches")
+	}
+
+	parentKey, parent, err := getBatch(ctx, parentBatchId)
+	if err != nil {
+		return err
+	}
+	status := batchStatus(parent)
+	if status == BatchStatusSplit || status == BatchStatusMerged || status == BatchStatusSold {
+		return fmt.Errorf("Batch %s is %s and cannot be split", parentBatchId, status)
+	}
+	if err := checkNotRecalled(ctx, parentBatchId); err != nil {
+		return err
+	}
+
+	// Only the owning org may split the lot, and it owns the children
+	mspId, err := checkOwnerOrg(ctx, parentKey, parent.OwnerMspId)
+	if err != nil {
+		return err
+	}
+
+	total := 0.0
+	seen := map[string]bool{}
+	for _, child := range children {
+		quantity, ok, err := parseBatchQuantity(child.Quantity)
+		if err != nil {
+			return err
+		}
+		if !ok || quantity <= 0 {
+			return fmt.Errorf("Child batch %s must have a positive quantity", child.BatchId)
+		}
+		if seen[child.BatchId] {
+			return fmt.Errorf("Child batch %s is listed twice", child.BatchId)
+		}
+		seen[child.BatchId] = true
+		total += quantity
+	}
+	parentQuantity, known, err := parseBatchQuantity(parent.Quantity)
+	if err != nil {
+		return err
+	}
+	if known && math.Abs(total-parentQuantity) > 1e-9 {
+		return fmt.Errorf("Child quantities add up to %v, batch %s holds %v", total, parentBatchId, parentQuantity)
+	}
+
+	for _, split := range children {
+		childKey, err := newChildBatch(ctx, split.BatchId)
+		if err != nil {
+			return err
+		}
+
+		child := parent
+		child.BatchId = split.BatchId
+		child.QRCode = split.QRCode
+		child.Quantity = split.Quantity
+		child.BatchStatus = status
+		child.OwnerMspId = mspId
+		child.ParentBatches = []BatchLink{{BatchId: parentBatchId, Quantity: split.Quantity}}
+		child.ChildBatches = nil
+		child.Remaining = Measure{}
+
+		err = putBatch(ctx, childKey, child)
+		if err != nil {
+			return err
+		}
+		err = setOrgEndorsementPolicy(ctx, childKey, mspId)
+		if err != nil {
+			return err
+		}
+
+		parent.ChildBatches = append(parent.ChildBatches, BatchLink{BatchId: split.BatchId, Quantity: split.Quantity})
+	}
+
+	parent.BatchStatus = BatchStatusSplit
+	parent.OwnerMspId = mspId
+	return putBatch(ctx, parentKey, parent)
+}
+
+// MergeBatches blends lots at the same stage into a new batch, contributions are the percentage each parent makes up
+// and must add up to 100. The parents become merged and take no further stages.
+func (s *SmartContract) MergeBatches(ctx contractapi.TransactionContextInterface, childBatchId string, parents []BatchLink, qrCode string) error {
+	if _, _, err := checkAccess(ctx, "MergeBatches"); err != nil {
+		return err
+	}
+	if len(parents) < 2 {
+		return fmt.Errorf("A merge needs at least two parent batches")
+	}
+
+	childKey, err := newChildBatch(ctx, childBatchId)
+	if err != nil {
+		return err
+	}
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+
+	child := Batch{
+		DocType:    docTypeBatch,
+		BatchId:    childBatchId,
+		QRCode:     qrCode,
+		OwnerMspId: mspId,
+	}
+
+	var farmerRegNos, farmerNames, farmerAddresses, coffeeTypes []string
+	totalContribution := 0.0
+	totalQuantity := 0.0
+	quantitiesKnown := true
+	seen := map[string]bool{}
+	for _, link := range parents {
+		contribution, ok, err := parseBatchQuantity(link.Contribution)
+		if err != nil {
+			return err
+		}
+		if !ok || contribution <= 0 {
+			return fmt.Errorf("Parent batch %s must have a positive contribution", link.BatchId)
+		}
+		if seen[link.BatchId] {
+			return fmt.Errorf("Parent batch %s is listed twice", link.BatchId)
+		}
+		seen[link.BatchId] = true
+		totalContribution += contribution
+
+		parentKey, parent, err := getBatch(ctx, link.BatchId)
+		if err != nil {
+			return err
+		}
+
+		// Blends are made of lots at the same stage, the child continues from it
+		status := batchStatus(parent)
+		if status == BatchStatusSplit || status == BatchStatusMerged || status == BatchStatusSold {
+			return fmt.Errorf("Batch %s is %s and cannot be merged", link.BatchId, status)
+		}
+		if err := checkNotRecalled(ctx, link.BatchId); err != nil {
+			return err
+		}
+		if child.BatchStatus == "" {
+			child.BatchStatus = status
+		} else if child.BatchStatus != status {
+			return fmt.Errorf("Batch %s is %s, the other batches are %s", link.BatchId, status, child.BatchStatus)
+		}
+
+		// The merging org must own every parent
+		if _, err := checkOwnerOrg(ctx, parentKey, parent.OwnerMspId); err != nil {
+			return err
+		}
+
+		quantity, known, err := parseBatchQuantity(parent.Quantity)
+		if err != nil {
+			return err
+		}
+		quantitiesKnown = quantitiesKnown && known
+		totalQuantity += quantity
+
+		farmerRegNos = append(farmerRegNos, parent.FarmerRegNo)
+		farmerNames = append(farmerNames, parent.FarmerName)
+		farmerAddresses = append(farmerAddresses, parent.FarmerAddress)
+		coffeeTypes = append(coffeeTypes, parent.CoffeeType)
+
+		parent.BatchStatus = BatchStatusMerged
+		parent.OwnerMspId = mspId
+		parent.ChildBatches = append(parent.ChildBatches, BatchLink{BatchId: childBatchId, Contribution: link.Contribution})
+		err = putBatch(ctx, parentKey, parent)
+		if err != nil {
+			return err
+		}
+
+		child.ParentBatches = append(child.ParentBatches, BatchLink{BatchId: link.BatchId, Contribution: link.Contribution})
+	}
+	if math.Abs(totalContribution-100) > 1e-6 {
+		return fmt.Errorf("Contributions add up to %v%%, not 100%%", totalContribution)
+	}
+
+	// The blend keeps the provenance of every parent
+	child.FarmerRegNo = joinDistinct(farmerRegNos)
+	child.FarmerName = joinDistinct(farmerNames)
+	child.FarmerAddress = joinDistinct(farmerAddresses)
+	child.CoffeeType = joinDistinct(coffeeTypes)
+	if quantitiesKnown {
+		child.Quantity = strconv.FormatFloat(totalQuantity, 'f', -1, 64)
+	}
+
+	err = putBatch(ctx, childKey, child)
+	if err != nil {
+		return err
+	}
+	return setOrgEndorsementPolicy(ctx, childKey, mspId)
+}
+
+// GetBatchGenealogy returns every lot a batch was split or merged from, every lot made from it, and the links between them
+func (s *SmartContract) GetBatchGenealogy(ctx contractapi.TransactionContextInterface, batchId string) (BatchGenealogy, error) {
+	_, root, err := getBatch(ctx, batchId)
+	if err != nil {
+		return BatchGenealogy{}, err
+	}
+
+	batches := map[string]Batch{batchId: root}
+	edges := map[string]GenealogyEdge{}
+
+	// Ancestors are followed upwards only and descendants downwards only, so siblings are left out
+	walk := func(links func(Batch) []BatchLink, edge func(string, BatchLink) GenealogyEdge) error {
+		queue := []string{batchId}
+		for len(queue) > 0 {
+			current := batches[queue[0]]
+			queue = queue[1:]
+
+			for _, link := range links(current) {
+				e := edge(current.BatchId, link)
+				edges[e.Parent+"\x00"+e.Child] = e
+
+				if _, ok := batches[link.BatchId]; ok {
+					continue
+				}
+				_, batch, err := getBatch(ctx, link.BatchId)
+				if err != nil {
+					return err
+				}
+				batches[link.BatchId] = batch
+				queue = append(queue, link.BatchId)
+			}
+		}
+		return nil
+	}
+
+	err = walk(
+		func(batch Batch) []BatchLink { return batch.ParentBatches },
+		func(id string, link BatchLink) GenealogyEdge {
+			return GenealogyEdge{Parent: link.BatchId, Child: id, Quantity: link.Quantity, Contribution: link.Contribution}
+		},
+	)
+	if err != nil {
+		return BatchGenealogy{}, err
+	}
+	err = walk(
+		func(batch Batch) []BatchLink { return batch.ChildBatches },
+		func(id string, link BatchLink) GenealogyEdge {
+			return GenealogyEdge{Parent: id, Child: link.BatchId, Quantity: link.Quantity, Contribution: link.Contribution}
+		},
+	)
+	if err != nil {
+		return BatchGenealogy{}, err
+	}
+
+	genealogy := BatchGenealogy{BatchId: batchId, Batches: []Batch{}, Edges: []GenealogyEdge{}}
+	for _, batch := range batches {
+		genealogy.Batches = append(genealogy.Batches, batch)
+	}
+	for _, edge := range edges {
+		genealogy.Edges = append(genealogy.Edges, edge)
+	}
+
+	// Map order is random, sort so every peer returns the same result
+	sort.Slice(genealogy.Batches, func(i, j int) bool { return genealogy.Batches[i].BatchId < genealogy.Batches[j].BatchId })
+	sort.Slice(genealogy.Edges, func(i, j int) bool {
+		if genealogy.Edges[i].Parent != genealogy.Edges[j].Parent {
+			return genealogy.Edges[i].Parent < genealogy.Edges[j].Parent
+		}
+		return genealogy.Edges[i].Child < genealogy.Edges[j].Child
+	})
+
+	return genealogy, nil
+}
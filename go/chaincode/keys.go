@@ -0,0 +1,177 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Document types, used both as the composite key object type and as the docType field of each record
+const (
+	docTypeUser          = "User"
+	docTypeBatch         = "Batch"
+	docTypeFarmInspector = "FarmInspector"
+	docTypeHarvester     = "Harvester"
+	docTypeImporter      = "Importer"
+	docTypeExporter      = "Exporter"
+	docTypeProcessor     = "Processor"
+	docTypeBuy           = "Buy"
+)
+
+// Index object types, each entry points at the key of the Buy it lists
+const (
+	indexBuyByBuyer  = "BuyByBuyer"
+	indexBuyBySeller = "BuyBySeller"
+)
+
+// entityKey returns the ledger key of a record, namespaced by its document type
+func entityKey(ctx contractapi.TransactionContextInterface, docType string, id string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(docType, []string{id})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create %s key for %s: %v", docType, id, err)
+	}
+	return key, nil
+}
+
+// legacyDocType guesses the type of a record stored under its raw ID, before records carried a docType
+func legacyDocType(record map[string]interface{}) string {
+	if docType, ok := record["docType"].(string); ok && docType != "" {
+		return docType
+	}
+
+	// Batch also carries the stage IDs, so it has to be recognised before the stage records
+	markers := []struct {
+		field   string
+		docType string
+	}{
+		{"userRole", docTypeUser},
+		{"farmerRegNo", docTypeBatch},
+		{"farmInspectionName", docTypeFarmInspector},
+		{"harvestStatus", docTypeHarvester},
+		{"importerStatus", docTypeImporter},
+		{"exporterStatus", docTypeExporter},
+		{"processorStatus", docTypeProcessor},
+	}
+	for _, marker := range markers {
+		if _, ok := record[marker.field]; ok {
+			return marker.docType
+		}
+	}
+	return ""
+}
+
+var legacyIdFields = map[string]string{
+	docTypeUser:          "userId",
+	docTypeBatch:         "batchId",
+	docTypeFarmInspector: "farmInspectionId",
+	docTypeHarvester:     "harvestId",
+	docTypeImporter:      "importerId",
+	docTypeExporter:      "exporterId",
+	docTypeProcessor:     "processorId",
+}
+
+// MigrateLedgerKeys moves every record still stored under its raw ID to its typed composite key,
+// stamps its docType and carries over any key-level endorsement policy. It returns the number of records moved.
+// User records leave their password and contact details behind: the password becomes a credential and the
+// contact details go to the user's org collection, as ScrubUserPasswords and MigratePrivateData do for typed keys.
+func (s *SmartContract) MigrateLedgerKeys(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	callerMspId, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get client MSP ID: %v", err)
+	}
+
+	queryIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get state by range: %v", err)
+	}
+	defer queryIterator.Close()
+
+	migrated := 0
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		// Unmarshal into a map so fields no longer in the structs survive the move
+		var record map[string]interface{}
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			continue
+		}
+		docType := legacyDocType(record)
+		if docType == "" {
+			continue
+		}
+		id, _ := record[legacyIdFields[docType]].(string)
+		if id == "" {
+			id = queryResponse.Key
+		}
+		record["docType"] = docType
+
+		if docType == docTypeUser {
+			err = moveLegacyUserSecrets(ctx, record, id, callerMspId)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		key, err := entityKey(ctx, docType, id)
+		if err != nil {
+			return 0, err
+		}
+		recordJSON, err := json.Marshal(record)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to marshal %s %s: %v", docType, id, err)
+		}
+		err = ctx.GetStub().PutState(key, recordJSON)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to save %s %s: %v", docType, id, err)
+		}
+
+		policy, err := ctx.GetStub().GetStateValidationParameter(queryResponse.Key)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to read endorsement policy of %s: %v", queryResponse.Key, err)
+		}
+		if policy != nil {
+			err = ctx.GetStub().SetStateValidationParameter(key, policy)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to set endorsement policy of %s %s: %v", docType, id, err)
+			}
+		}
+
+		err = ctx.GetStub().DelState(queryResponse.Key)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to delete legacy key %s: %v", queryResponse.Key, err)
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// moveLegacyUserSecrets takes the plaintext password and contact details out of a legacy user record and stores
+// them in the implicit collection of the user's org, the creating org standing in for users bound to none
+func moveLegacyUserSecrets(ctx contractapi.TransactionContextInterface, record map[string]interface{}, userId string, callerMspId string) error {
+	mspId, _ := record["userMspId"].(string)
+	if mspId == "" {
+		mspId = callerMspId
+		record["userMspId"] = mspId
+	}
+	record["userId"] = userId
+
+	if password, _ := record["userPassword"].(string); password != "" {
+		err := putUserCredential(ctx, userId, mspId, password)
+		if err != nil {
+			return err
+		}
+	}
+	delete(record, "userPassword")
+
+	_, err := movePublicUserDetails(ctx, record, mspId)
+	return err
+}
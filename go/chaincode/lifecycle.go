@@ -0,0 +1,145 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Batch lifecycle states, in the order a batch moves through them
+const (
+	BatchStatusRegistered = "registered"
+	BatchStatusInspected  = "inspected"
+	BatchStatusHarvested  = "harvested"
+	BatchStatusProcessed  = "processed"
+	BatchStatusExported   = "exported"
+	BatchStatusImported   = "imported"
+	BatchStatusSold       = "sold"
+
+	// A lot that was split or merged lives on in its child batches
+	BatchStatusSplit  = "split"
+	BatchStatusMerged = "merged"
+)
+
+// batchStage is the step a record of a given docType moves its batch through
+type batchStage struct {
+	from []string
+	to   string
+	link func(batch *Batch, id string, name string)
+}
+
+var batchStages = map[string]batchStage{
+	docTypeFarmInspector: {
+		from: []string{BatchStatusRegistered},
+		to:   BatchStatusInspected,
+		link: func(batch *Batch, id string, name string) {
+			batch.FarmInspectionId, batch.FarmInspectionName = id, name
+		},
+	},
+	docTypeHarvester: {
+		from: []string{BatchStatusInspected},
+		to:   BatchStatusHarvested,
+		link: func(batch *Batch, id string, name string) {
+			batch.HarvesterId, batch.HarvesterName = id, name
+		},
+	},
+	docTypeProcessor: {
+		from: []string{BatchStatusHarvested},
+		to:   BatchStatusProcessed,
+		link: func(batch *Batch, id string, name string) {
+			batch.ProcessorId, batch.ProcessorName = id, name
+		},
+	},
+	docTypeExporter: {
+		from: []string{BatchStatusProcessed},
+		to:   BatchStatusExported,
+		link: func(batch *Batch, id string, name string) {
+			batch.ExporterId, batch.ExporterName = id, name
+		},
+	},
+	docTypeImporter: {
+		from: []string{BatchStatusExported},
+		to:   BatchStatusImported,
+		link: func(batch *Batch, id string, name string) {
+			batch.ImporterId, batch.ImporterName = id, name
+		},
+	},
+	// An imported batch may be sold in several buys
+	docTypeBuy: {
+		from: []string{BatchStatusImported, BatchStatusSold},
+		to:   BatchStatusSold,
+		link: func(batch *Batch, id string, name string) {},
+	},
+}
+
+// batchStatus returns the lifecycle state of a batch. Batches written while BatchStatus was free text
+// get the state implied by the last stage linked to them.
+func batchStatus(batch Batch) string {
+	switch batch.BatchStatus {
+	case BatchStatusRegistered, BatchStatusInspected, BatchStatusHarvested, BatchStatusProcessed,
+		BatchStatusExported, BatchStatusImported, BatchStatusSold, BatchStatusSplit, BatchStatusMerged:
+		return batch.BatchStatus
+	}
+
+	switch {
+	case batch.ImporterId != "":
+		return BatchStatusImported
+	case batch.ExporterId != "":
+		return BatchStatusExported
+	case batch.ProcessorId != "":
+		return BatchStatusProcessed
+	case batch.HarvesterId != "":
+		return BatchStatusHarvested
+	case batch.FarmInspectionId != "":
+		return BatchStatusInspected
+	}
+	return BatchStatusRegistered
+}
+
+// getBatchForStage loads the batch a new record of the given docType belongs to and checks that the batch
+// is in the state that stage follows
+func getBatchForStage(ctx contractapi.TransactionContextInterface, docType string, batchId string) (string, Batch, error) {
+	if batchId == "" {
+		return "", Batch{}, fmt.Errorf("%s record must reference a batch", docType)
+	}
+
+	batchKey, batch, err := getBatch(ctx, batchId)
+	if err != nil {
+		return "", Batch{}, err
+	}
+
+	stage := batchStages[docType]
+	status := batchStatus(batch)
+	for _, from := range stage.from {
+		if status == from {
+			return batchKey, batch, nil
+		}
+	}
+	return "", Batch{}, fmt.Errorf("Batch %s is %s, a %s record requires it to be %v", batchId, status, docType, stage.from)
+}
+
+// advanceBatch links the record to the batch, moves the batch to the stage's state and makes mspId responsible for it.
+// The batch's current endorsement policy still applies to this write, so the previous org has to endorse the hand-over.
+func advanceBatch(ctx contractapi.TransactionContextInterface, batchKey string, batch Batch, docType string, id string, name string, mspId string) error {
+	stage := batchStages[docType]
+	stage.link(&batch, id, name)
+	batch.BatchStatus = stage.to
+
+	handOver := batch.OwnerMspId != mspId
+	batch.OwnerMspId = mspId
+
+	batchJSON, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal batch: %v", err)
+	}
+	err = ctx.GetStub().PutState(batchKey, batchJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to update batch: %v", err)
+	}
+
+	if !handOver {
+		return nil
+	}
+	return setOrgEndorsementPolicy(ctx, batchKey, mspId)
+}
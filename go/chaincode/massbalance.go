@@ -0,0 +1,294 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Measure is a quantity of coffee in a unit of weight
+type Measure struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// kilograms per unit accepted in a Measure
+var measureUnits = map[string]float64{
+	"g":  0.001,
+	"kg": 1,
+	"t":  1000,
+	"lb": 0.45359237,
+}
+
+// defaultMassBalanceTolerance is how far, as a fraction, a stage may exceed the one before it when nothing else is configured
+const defaultMassBalanceTolerance = 0.02
+
+const yieldRatioObjectType = "YieldRatio"
+
+// YieldRatio is the expected weight of processed coffee per weight of harvested cherry for a processing method,
+// for example about 0.2 for washed coffee going from cherry to green
+type YieldRatio struct {
+	ProcessingMethod string  `json:"processingMethod"`
+	Ratio            float64 `json:"ratio"`
+	Tolerance        float64 `json:"tolerance"` // fraction the processed weight may exceed the expected one by
+}
+
+// ReconciliationStep compares the weight recorded at a stage with the most the stages before it allow
+type ReconciliationStep struct {
+	Stage      string  `json:"stage"`
+	RecordId   string  `json:"recordId"`
+	Kilograms  float64 `json:"kilograms"`
+	Known      bool    `json:"known"`
+	MaxAllowed float64 `json:"maxAllowed"` // 0 when there is no known upstream weight to compare with
+	Exceeded   bool    `json:"exceeded"`
+}
+
+// BatchReconciliation is the mass balance of a batch from harvest to the buys made from it, in kilograms
+type BatchReconciliation struct {
+	BatchId string               `json:"batchId"`
+	Steps   []ReconciliationStep `json:"steps"`
+	Flagged bool                 `json:"flagged"`
+	Issues  []string             `json:"issues"`
+}
+
+func validateMeasure(measure Measure) error {
+	if measure.Value < 0 {
+		return fmt.Errorf("Quantity cannot be negative")
+	}
+	if measure.Value == 0 && measure.Unit == "" {
+		return nil
+	}
+	if _, ok := measureUnits[measure.Unit]; !ok {
+		return fmt.Errorf("Unknown unit %q", measure.Unit)
+	}
+	return nil
+}
+
+// kilograms converts a measure to kilograms. Records written while quantities were free text fall back to
+// the legacy string when it reads as "<number> <unit>" or a bare number of kilograms.
+func kilograms(measure Measure, legacy string) (float64, bool) {
+	if measure.Value > 0 {
+		factor, ok := measureUnits[measure.Unit]
+		return measure.Value * factor, ok
+	}
+
+	fields := strings.Fields(legacy)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	factor := 1.0
+	if len(fields) == 2 {
+		var ok bool
+		factor, ok = measureUnits[strings.ToLower(fields[1])]
+		if !ok {
+			return 0, false
+		}
+	}
+	return value * factor, true
+}
+
+func yieldRatioKey(ctx contractapi.TransactionContextInterface, processingMethod string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(yieldRatioObjectType, []string{strings.ToLower(processingMethod)})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create yield ratio key: %v", err)
+	}
+	return key, nil
+}
+
+// getYieldRatio returns the ratio configured for a processing method. Without one, processing may not add weight.
+func getYieldRatio(ctx contractapi.TransactionContextInterface, processingMethod string) (YieldRatio, error) {
+	key, err := yieldRatioKey(ctx, processingMethod)
+	if err != nil {
+		return YieldRatio{}, err
+	}
+	ratioJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return YieldRatio{}, fmt.Errorf("Failed to read yield ratio of %s: %v", processingMethod, err)
+	}
+	if ratioJSON == nil {
+		return YieldRatio{ProcessingMethod: processingMethod, Ratio: 1, Tolerance: defaultMassBalanceTolerance}, nil
+	}
+
+	var ratio YieldRatio
+	err = json.Unmarshal(ratioJSON, &ratio)
+	if err != nil {
+		return YieldRatio{}, fmt.Errorf("Failed to unmarshal yield ratio data: %v", err)
+	}
+	return ratio, nil
+}
+
+// SetYieldRatio configures the expected cherry to processed weight ratio of a processing method
+func (s *SmartContract) SetYieldRatio(ctx contractapi.TransactionContextInterface, processingMethod string, ratio float64, tolerance float64) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if processingMethod == "" {
+		return fmt.Errorf("Processing method is required")
+	}
+	if ratio <= 0 {
+		return fmt.Errorf("Yield ratio must be positive")
+	}
+	if tolerance < 0 {
+		return fmt.Errorf("Tolerance cannot be negative")
+	}
+
+	key, err := yieldRatioKey(ctx, processingMethod)
+	if err != nil {
+		return err
+	}
+	ratioJSON, err := json.Marshal(YieldRatio{ProcessingMethod: processingMethod, Ratio: ratio, Tolerance: tolerance})
+	if err != nil {
+		return fmt.Errorf("Failed to marshal yield ratio: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, ratioJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save yield ratio: %v", err)
+	}
+	return nil
+}
+
+// GetAllYieldRatios lists the configured yield ratios
+func (s *SmartContract) GetAllYieldRatios(ctx contractapi.TransactionContextInterface) ([]YieldRatio, error) {
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(yieldRatioObjectType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get yield ratios: %v", err)
+	}
+	defer queryIterator.Close()
+
+	ratios := []YieldRatio{}
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var ratio YieldRatio
+		err = json.Unmarshal(queryResponse.Value, &ratio)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal yield ratio data: %v", err)
+		}
+		ratios = append(ratios, ratio)
+	}
+
+	return ratios, nil
+}
+
+// readStageRecord loads a stage record linked to a batch, it returns false when the batch has no such stage
+func readStageRecord(ctx contractapi.TransactionContextInterface, docType string, id string, record interface{}) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+	key, err := entityKey(ctx, docType, id)
+	if err != nil {
+		return false, err
+	}
+	recordJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read %s %s: %v", docType, id, err)
+	}
+	if recordJSON == nil {
+		return false, nil
+	}
+	err = json.Unmarshal(recordJSON, record)
+	if err != nil {
+		return false, fmt.Errorf("Failed to unmarshal %s data: %v", docType, err)
+	}
+	return true, nil
+}
+
+// ReconcileBatch checks that no stage of a batch holds more coffee than the stages before it allow.
+// Processing may change the weight by the yield ratio of its method, every other stage may only lose weight
+// within tolerance. A stage with an unknown weight is compared with the nearest known stage before it.
+func (s *SmartContract) ReconcileBatch(ctx contractapi.TransactionContextInterface, batchId string) (BatchReconciliation, error) {
+	_, batch, err := getBatch(ctx, batchId)
+	if err != nil {
+		return BatchReconciliation{}, err
+	}
+
+	reconciliation := BatchReconciliation{BatchId: batchId, Steps: []ReconciliationStep{}, Issues: []string{}}
+
+	// upstream is the most the stages so far allow downstream, -1 while no weight is known
+	upstream := -1.0
+	check := func(stage string, recordId string, weight float64, known bool, factor float64, tolerance float64) {
+		step := ReconciliationStep{Stage: stage, RecordId: recordId, Kilograms: weight, Known: known}
+		if upstream >= 0 {
+			upstream *= factor
+			step.MaxAllowed = upstream * (1 + tolerance)
+			if known && weight > step.MaxAllowed {
+				step.Exceeded = true
+				reconciliation.Flagged = true
+				reconciliation.Issues = append(reconciliation.Issues,
+					fmt.Sprintf("%s %s records %.3f kg, at most %.3f kg is accounted for upstream", stage, recordId, weight, step.MaxAllowed))
+			}
+		}
+		if known {
+			upstream = weight
+		}
+		reconciliation.Steps = append(reconciliation.Steps, step)
+	}
+
+	var harvester Harvester
+	if found, err := readStageRecord(ctx, docTypeHarvester, batch.HarvesterId, &harvester); err != nil {
+		return BatchReconciliation{}, err
+	} else if found {
+		weight, known := kilograms(harvester.Volume, "")
+		check(docTypeHarvester, harvester.HarvestId, weight, known, 1, defaultMassBalanceTolerance)
+	}
+
+	var processor Processor
+	if found, err := readStageRecord(ctx, docTypeProcessor, batch.ProcessorId, &processor); err != nil {
+		return BatchReconciliation{}, err
+	} else if found {
+		ratio, err := getYieldRatio(ctx, processor.ProcessingMethod)
+		if err != nil {
+			return BatchReconciliation{}, err
+		}
+		weight, known := kilograms(processor.Volume, processor.Quantity)
+		check(docTypeProcessor, processor.ProcessorId, weight, known, ratio.Ratio, ratio.Tolerance)
+	}
+
+	var exporter Exporter
+	if found, err := readStageRecord(ctx, docTypeExporter, batch.ExporterId, &exporter); err != nil {
+		return BatchReconciliation{}, err
+	} else if found {
+		weight, known := kilograms(exporter.Volume, "")
+		check(docTypeExporter, exporter.ExporterId, weight, known, 1, defaultMassBalanceTolerance)
+	}
+
+	var importer Importer
+	if found, err := readStageRecord(ctx, docTypeImporter, batch.ImporterId, &importer); err != nil {
+		return BatchReconciliation{}, err
+	} else if found {
+		weight, known := kilograms(importer.Volume, importer.Quantity)
+		check(docTypeImporter, importer.ImporterId, weight, known, 1, defaultMassBalanceTolerance)
+	}
+
+	// Buys together may not exceed what was imported
+	buys, err := s.GetBuyTransactionsByBatchId(ctx, batchId)
+	if err != nil {
+		return BatchReconciliation{}, err
+	}
+	if len(buys) > 0 {
+		sold := 0.0
+		allKnown := true
+		for _, buy := range buys {
+			weight, known := kilograms(buy.Volume, buy.Quantity)
+			sold += weight
+			allKnown = allKnown && known
+		}
+		// What is known is a lower bound, it can already show an oversale
+		check(docTypeBuy, "", sold, allKnown || sold > 0, 1, defaultMassBalanceTolerance)
+		if !allKnown {
+			reconciliation.Issues = append(reconciliation.Issues, "Some buys have no readable quantity")
+		}
+	}
+
+	return reconciliation, nil
+}
@@ -0,0 +1,115 @@
+package chaincode
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// mockIdentity is a client certificate carrying an enrollment ID and a role attribute
+type mockIdentity struct {
+	mspId        string
+	enrollmentId string
+	role         string
+}
+
+func (m mockIdentity) GetID() (string, error) {
+	return m.enrollmentId, nil
+}
+
+func (m mockIdentity) GetMSPID() (string, error) {
+	return m.mspId, nil
+}
+
+func (m mockIdentity) GetAttributeValue(name string) (string, bool, error) {
+	switch name {
+	case "hf.EnrollmentID":
+		return m.enrollmentId, true, nil
+	case "role":
+		return m.role, m.role != "", nil
+	}
+	return "", false, nil
+}
+
+func (m mockIdentity) AssertAttributeValue(name string, value string) error {
+	found, ok, _ := m.GetAttributeValue(name)
+	if !ok || found != value {
+		return fmt.Errorf("attribute %s is not %s", name, value)
+	}
+	return nil
+}
+
+func (m mockIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, nil
+}
+
+// mockLedger runs transactions of different callers against one mock world state
+type mockLedger struct {
+	t    *testing.T
+	stub *shimtest.MockStub
+	txs  int
+}
+
+func newMockLedger(t *testing.T) *mockLedger {
+	t.Setenv("CORE_PEER_LOCALMSPID", "Org1MSP")
+	return &mockLedger{t: t, stub: shimtest.NewMockStub("supplychain", nil)}
+}
+
+// as starts a transaction submitted by the given identity
+func (l *mockLedger) as(mspId string, enrollmentId string, role string) contractapi.TransactionContextInterface {
+	l.txs++
+	l.stub.MockTransactionStart(fmt.Sprintf("tx%d", l.txs))
+	ctx := new(contractapi.TransactionContext)
+	ctx.SetStub(l.stub)
+	ctx.SetClientIdentity(mockIdentity{mspId: mspId, enrollmentId: enrollmentId, role: role})
+	return ctx
+}
+
+// put writes a record under its entity key
+func (l *mockLedger) put(docType string, id string, record interface{}) {
+	l.t.Helper()
+	ctx := l.as("Org1MSP", "setup", RoleAdmin)
+	key, err := entityKey(ctx, docType, id)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	recordJSON, _ := json.Marshal(record)
+	if err := l.stub.PutState(key, recordJSON); err != nil {
+		l.t.Fatal(err)
+	}
+}
+
+func (l *mockLedger) addUser(mspId string, userId string, role string) TokenAccount {
+	l.put(docTypeUser, userId, User{DocType: docTypeUser, UserId: userId, UserRole: role, UserMspId: mspId})
+	return TokenAccount{MspId: mspId, EnrollmentId: userId}
+}
+
+func (l *mockLedger) balance(account TokenAccount) int64 {
+	l.t.Helper()
+	balance, err := new(SmartContract).BalanceOf(l.as("Org1MSP", "setup", RoleAdmin), account)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	return balance
+}
+
+// fund initializes the token with Org1MSP as issuer and mints amount to each account
+func (l *mockLedger) fund(amount int64, accounts ...TokenAccount) {
+	l.t.Helper()
+	s := new(SmartContract)
+	if l.stub.State[tokenConfigKey] == nil {
+		err := s.InitializeToken(l.as("Org1MSP", "admin", RoleAdmin), TokenConfig{Name: "Coffee", Symbol: "CFE", IssuerMspId: "Org1MSP"})
+		if err != nil {
+			l.t.Fatal(err)
+		}
+	}
+	for _, account := range accounts {
+		if err := s.Mint(l.as("Org1MSP", "issuer", RoleAdmin), account, amount); err != nil {
+			l.t.Fatal(err)
+		}
+	}
+}
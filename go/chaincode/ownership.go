@@ -0,0 +1,60 @@
+package chaincode
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func getClientMspId(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspId, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get client MSP ID: %v", err)
+	}
+	return mspId, nil
+}
+
+// setOrgEndorsementPolicy requires a peer of the given org to endorse every later change to the key
+func setOrgEndorsementPolicy(ctx contractapi.TransactionContextInterface, key string, mspId string) error {
+	endorsementPolicy, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return fmt.Errorf("Failed to create endorsement policy: %v", err)
+	}
+	err = endorsementPolicy.AddOrgs(statebased.RoleTypePeer, mspId)
+	if err != nil {
+		return fmt.Errorf("Failed to add %s to endorsement policy: %v", mspId, err)
+	}
+	policy, err := endorsementPolicy.Policy()
+	if err != nil {
+		return fmt.Errorf("Failed to build endorsement policy: %v", err)
+	}
+
+	err = ctx.GetStub().SetStateValidationParameter(key, policy)
+	if err != nil {
+		return fmt.Errorf("Failed to set endorsement policy of %s: %v", key, err)
+	}
+	return nil
+}
+
+// checkOwnerOrg makes sure the caller belongs to the org owning the record stored under key and returns the owner to keep.
+// Records written before ownership was tracked are claimed by the first org that updates them.
+func checkOwnerOrg(ctx contractapi.TransactionContextInterface, key string, ownerMspId string) (string, error) {
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if ownerMspId == "" {
+		err = setOrgEndorsementPolicy(ctx, key, mspId)
+		if err != nil {
+			return "", err
+		}
+		return mspId, nil
+	}
+	if ownerMspId != mspId {
+		return "", fmt.Errorf("Record %s is owned by %s and cannot be changed by %s", key, ownerMspId, mspId)
+	}
+
+	return ownerMspId, nil
+}
@@ -0,0 +1,143 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// BatchPage is one page of batches, pass Bookmark back to fetch the next one
+type BatchPage struct {
+	Records      []Batch `json:"records"`
+	Bookmark     string  `json:"bookmark"`
+	FetchedCount int32   `json:"fetchedCount"`
+}
+
+// UserPage is one page of users, pass Bookmark back to fetch the next one
+type UserPage struct {
+	Records      []User `json:"records"`
+	Bookmark     string `json:"bookmark"`
+	FetchedCount int32  `json:"fetchedCount"`
+}
+
+// BuyPage is one page of buys, pass Bookmark back to fetch the next one
+type BuyPage struct {
+	Records      []Buy  `json:"records"`
+	Bookmark     string `json:"bookmark"`
+	FetchedCount int32  `json:"fetchedCount"`
+}
+
+// GetBatchesWithPagination retrieves at most pageSize batches starting at bookmark ("" for the first page)
+func (s *SmartContract) GetBatchesWithPagination(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*BatchPage, error) {
+	queryIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(docTypeBatch, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get batches: %v", err)
+	}
+	defer queryIterator.Close()
+
+	batches := []Batch{}
+
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var batch Batch
+		err = json.Unmarshal(queryResponse.Value, &batch)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal batch data: %v", err)
+		}
+
+		batches = append(batches, batch)
+	}
+
+	return &BatchPage{
+		Records:      batches,
+		Bookmark:     metadata.Bookmark,
+		FetchedCount: metadata.FetchedRecordsCount,
+	}, nil
+}
+
+// GetUsersWithPagination retrieves at most pageSize users starting at bookmark ("" for the first page)
+func (s *SmartContract) GetUsersWithPagination(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*UserPage, error) {
+	queryIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(docTypeUser, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get users: %v", err)
+	}
+	defer queryIterator.Close()
+
+	users := []User{}
+
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var user User
+		err = json.Unmarshal(queryResponse.Value, &user)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal user data: %v", err)
+		}
+
+		users = append(users, user)
+	}
+
+	return &UserPage{
+		Records:      users,
+		Bookmark:     metadata.Bookmark,
+		FetchedCount: metadata.FetchedRecordsCount,
+	}, nil
+}
+
+// getBuysByIndex retrieves at most pageSize buys listed under id in a buy index, starting at bookmark
+func getBuysByIndex(ctx contractapi.TransactionContextInterface, index string, id string, pageSize int32, bookmark string) (*BuyPage, error) {
+	queryIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(index, []string{id}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get buys: %v", err)
+	}
+	defer queryIterator.Close()
+
+	buys := []Buy{}
+
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		buyJSON, err := ctx.GetStub().GetState(string(queryResponse.Value))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read buy: %v", err)
+		}
+		if buyJSON == nil {
+			continue
+		}
+
+		var buy Buy
+		err = json.Unmarshal(buyJSON, &buy)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal buy data: %v", err)
+		}
+
+		buys = append(buys, buy)
+	}
+
+	return &BuyPage{
+		Records:      buys,
+		Bookmark:     metadata.Bookmark,
+		FetchedCount: metadata.FetchedRecordsCount,
+	}, nil
+}
+
+// GetBuysByBuyer retrieves at most pageSize buys made by buyerId starting at bookmark ("" for the first page)
+func (s *SmartContract) GetBuysByBuyer(ctx contractapi.TransactionContextInterface, buyerId string, pageSize int32, bookmark string) (*BuyPage, error) {
+	return getBuysByIndex(ctx, indexBuyByBuyer, buyerId, pageSize, bookmark)
+}
+
+// GetBuysBySeller retrieves at most pageSize buys made from sellerId starting at bookmark ("" for the first page)
+func (s *SmartContract) GetBuysBySeller(ctx contractapi.TransactionContextInterface, sellerId string, pageSize int32, bookmark string) (*BuyPage, error) {
+	return getBuysByIndex(ctx, indexBuyBySeller, sellerId, pageSize, bookmark)
+}
@@ -0,0 +1,451 @@
+package chaincode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Transient map entries carrying the private portion of a user or a buy
+const (
+	userPrivateTransientKey = "userPrivate"
+	buyPrivateTransientKey  = "buyPrivate"
+)
+
+const (
+	userPrivateObjectType = "UserPrivate"
+	buyPrivateObjectType  = "BuyPrivate"
+)
+
+// privateSaltMinLength is the shortest salt accepted with private details, 16 random bytes hex encoded.
+// Contact details and prices are guessable, unsalted their public hash could be brute-forced.
+const privateSaltMinLength = 32
+
+// UserPrivateDetails holds the contact details of a user, kept in the implicit collection of the user's org
+type UserPrivateDetails struct {
+	UserId      string `json:"userId"`
+	UserEmail   string `json:"userEmail"`
+	UserPhone   string `json:"userPhone"`
+	UserAddress string `json:"userAddress"`
+	Salt        string `json:"salt" metadata:",optional"` // random value chosen by the client, hashed along with the details
+}
+
+// BuyPrivateDetails holds the commercial terms of a buy, kept in the implicit collections of the buyer's and seller's orgs
+type BuyPrivateDetails struct {
+	BatchId       string `json:"batchId"`
+	TransactionId string `json:"transactionId"`
+	Price         string `json:"price"`
+	PaymentAmount int64  `json:"paymentAmount" metadata:",optional"` // tokens the buyer pays the seller, settled by peers of either org
+	Salt          string `json:"salt" metadata:",optional"`          // random value chosen by the client, hashed along with the terms
+}
+
+// hashPrivateData hashes private details that carry their salt
+func hashPrivateData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func checkPrivateSalt(salt string) error {
+	if len(salt) < privateSaltMinLength {
+		return fmt.Errorf("Private details need a random salt of at least %d characters", privateSaltMinLength)
+	}
+	return nil
+}
+
+// verifyClientOrgMatchesPeerOrg makes sure private data is only served to clients of the org that hosts the peer
+func verifyClientOrgMatchesPeerOrg(ctx contractapi.TransactionContextInterface) (string, error) {
+	clientMspId, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get client MSP ID: %v", err)
+	}
+	peerMspId, err := shim.GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get peer MSP ID: %v", err)
+	}
+	if clientMspId != peerMspId {
+		return "", fmt.Errorf("Client from %s is not authorized to read private data from a peer of %s", clientMspId, peerMspId)
+	}
+	return clientMspId, nil
+}
+
+// putUserPrivateDetails stores the user's contact details from the transient map and records their salted hash on the user.
+// It leaves the user untouched when no details were sent.
+func putUserPrivateDetails(ctx contractapi.TransactionContextInterface, user *User) error {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("Failed to read transient data: %v", err)
+	}
+	detailsJSON, ok := transientMap[userPrivateTransientKey]
+	if !ok {
+		return nil
+	}
+
+	var details UserPrivateDetails
+	err = json.Unmarshal(detailsJSON, &details)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal user private details: %v", err)
+	}
+	if err := checkPrivateSalt(details.Salt); err != nil {
+		return err
+	}
+	details.UserId = user.UserId
+
+	detailsJSON, err = json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal user private details: %v", err)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(userPrivateObjectType, []string{user.UserId})
+	if err != nil {
+		return fmt.Errorf("Failed to create composite key: %v", err)
+	}
+
+	err = ctx.GetStub().PutPrivateData(orgCollection(user.UserMspId), key, detailsJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save user private details: %v", err)
+	}
+
+	user.UserPrivateHash = hashPrivateData(detailsJSON)
+	return nil
+}
+
+// putBuyPrivateDetails stores the buy's price and payment from the transient map for the buyer's and seller's orgs,
+// and records their salted hash on the buy. It leaves the buy untouched when no details were sent.
+func putBuyPrivateDetails(ctx contractapi.TransactionContextInterface, buy *Buy) error {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("failed to read transient data: %v", err)
+	}
+	detailsJSON, ok := transientMap[buyPrivateTransientKey]
+	if !ok {
+		return nil
+	}
+
+	var details BuyPrivateDetails
+	err = json.Unmarshal(detailsJSON, &details)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal buy private details: %v", err)
+	}
+	if err := checkPrivateSalt(details.Salt); err != nil {
+		return err
+	}
+	details.BatchId = buy.BatchId
+	details.TransactionId = buy.TransactionId
+	if details.PaymentAmount < 0 {
+		return fmt.Errorf("payment amount cannot be negative")
+	}
+
+	detailsJSON, err = json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("failed to marshal buy private details: %v", err)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(buyPrivateObjectType, []string{buy.BatchId, buy.TransactionId})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	callerMspId, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to get client MSP ID: %v", err)
+	}
+	mspIds := map[string]bool{callerMspId: true}
+
+	for _, userId := range []string{buy.SellerId, buy.BuyerId} {
+		userKey, err := entityKey(ctx, docTypeUser, userId)
+		if err != nil {
+			return err
+		}
+		userJSON, err := ctx.GetStub().GetState(userKey)
+		if err != nil {
+			return fmt.Errorf("failed to get user %s: %v", userId, err)
+		}
+		if userJSON == nil {
+			continue
+		}
+		var user User
+		err = json.Unmarshal(userJSON, &user)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal user data: %v", err)
+		}
+		if user.UserMspId != "" {
+			mspIds[user.UserMspId] = true
+		}
+	}
+
+	for mspId := range mspIds {
+		err = ctx.GetStub().PutPrivateData(orgCollection(mspId), key, detailsJSON)
+		if err != nil {
+			return fmt.Errorf("failed to save buy private details: %v", err)
+		}
+	}
+
+	buy.PriceHash = hashPrivateData(detailsJSON)
+	return nil
+}
+
+// buyPaymentAmount reads the tokens a buy settles for from the copy of its private details held by the peer's org.
+// A buy recorded without private details is not paid in tokens.
+func buyPaymentAmount(ctx contractapi.TransactionContextInterface, buy Buy) (int64, error) {
+	if buy.PriceHash == "" {
+		return 0, nil
+	}
+	peerMspId, err := shim.GetMSPID()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get peer MSP ID: %v", err)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(buyPrivateObjectType, []string{buy.BatchId, buy.TransactionId})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create composite key: %v", err)
+	}
+	detailsJSON, err := ctx.GetStub().GetPrivateData(orgCollection(peerMspId), key)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read buy private details: %v", err)
+	}
+	if detailsJSON == nil {
+		return 0, fmt.Errorf("Payment of buy %s is settled by peers of the buyer's or seller's org, not %s", buy.TransactionId, peerMspId)
+	}
+
+	var details BuyPrivateDetails
+	err = json.Unmarshal(detailsJSON, &details)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to unmarshal buy private details: %v", err)
+	}
+	return details.PaymentAmount, nil
+}
+
+// ViewUserPrivateDetails returns a user's contact details to members of the user's org
+func (s *SmartContract) ViewUserPrivateDetails(ctx contractapi.TransactionContextInterface, userId string) (UserPrivateDetails, error) {
+	user, err := s.ViewUser(ctx, userId)
+	if err != nil {
+		return UserPrivateDetails{}, err
+	}
+
+	mspId, err := verifyClientOrgMatchesPeerOrg(ctx)
+	if err != nil {
+		return UserPrivateDetails{}, err
+	}
+	if mspId != user.UserMspId {
+		return UserPrivateDetails{}, fmt.Errorf("Private details of user %s are only visible to %s", userId, user.UserMspId)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(userPrivateObjectType, []string{userId})
+	if err != nil {
+		return UserPrivateDetails{}, fmt.Errorf("Failed to create composite key: %v", err)
+	}
+
+	detailsJSON, err := ctx.GetStub().GetPrivateData(orgCollection(mspId), key)
+	if err != nil || detailsJSON == nil {
+		return UserPrivateDetails{}, fmt.Errorf("Private details of user %s do not exist", userId)
+	}
+
+	var details UserPrivateDetails
+	err = json.Unmarshal(detailsJSON, &details)
+	if err != nil {
+		return UserPrivateDetails{}, fmt.Errorf("Failed to unmarshal user private details: %v", err)
+	}
+
+	return details, nil
+}
+
+// ViewBuyPrivateDetails returns a buy's price to members of the buyer's or seller's org
+func (s *SmartContract) ViewBuyPrivateDetails(ctx contractapi.TransactionContextInterface, batchId string, transactionId string) (BuyPrivateDetails, error) {
+	mspId, err := verifyClientOrgMatchesPeerOrg(ctx)
+	if err != nil {
+		return BuyPrivateDetails{}, err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(buyPrivateObjectType, []string{batchId, transactionId})
+	if err != nil {
+		return BuyPrivateDetails{}, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	detailsJSON, err := ctx.GetStub().GetPrivateData(orgCollection(mspId), key)
+	if err != nil {
+		return BuyPrivateDetails{}, fmt.Errorf("failed to read buy private details: %v", err)
+	}
+	if detailsJSON == nil {
+		return BuyPrivateDetails{}, fmt.Errorf("no private details of buy %s for batch %s are shared with %s", transactionId, batchId, mspId)
+	}
+
+	var details BuyPrivateDetails
+	err = json.Unmarshal(detailsJSON, &details)
+	if err != nil {
+		return BuyPrivateDetails{}, fmt.Errorf("failed to unmarshal buy private details: %v", err)
+	}
+
+	return details, nil
+}
+
+// legacyUserContactFields are the contact details user records carried publicly before they moved to private data
+var legacyUserContactFields = []string{"userEmail", "userPhone", "userAddress"}
+
+// movePublicUserDetails takes the contact details a legacy user record still carries publicly into the implicit
+// collection of the user's org and removes them from the record. Details already stored privately are not overwritten.
+// It returns whether the record changed.
+func movePublicUserDetails(ctx contractapi.TransactionContextInterface, record map[string]interface{}, mspId string) (bool, error) {
+	found := false
+	for _, field := range legacyUserContactFields {
+		if _, ok := record[field]; ok {
+			found = true
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	details := UserPrivateDetails{}
+	details.UserId, _ = record["userId"].(string)
+	details.UserEmail, _ = record["userEmail"].(string)
+	details.UserPhone, _ = record["userPhone"].(string)
+	details.UserAddress, _ = record["userAddress"].(string)
+	for _, field := range legacyUserContactFields {
+		delete(record, field)
+	}
+
+	if hash, _ := record["userPrivateHash"].(string); hash != "" {
+		return true, nil
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return false, fmt.Errorf("Failed to marshal user private details: %v", err)
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(userPrivateObjectType, []string{details.UserId})
+	if err != nil {
+		return false, fmt.Errorf("Failed to create composite key: %v", err)
+	}
+	err = ctx.GetStub().PutPrivateData(orgCollection(mspId), key, detailsJSON)
+	if err != nil {
+		return false, fmt.Errorf("Failed to save user private details: %v", err)
+	}
+	return true, nil
+}
+
+// movePublicBuyPrice takes the price a legacy buy record still carries publicly into the implicit collections
+// of the given orgs and removes it from the record. It returns whether the record changed.
+func movePublicBuyPrice(ctx contractapi.TransactionContextInterface, record map[string]interface{}, mspIds map[string]bool) (bool, error) {
+	price, found := record["price"]
+	if !found {
+		return false, nil
+	}
+	delete(record, "price")
+
+	if hash, _ := record["priceHash"].(string); hash != "" {
+		return true, nil
+	}
+	details := BuyPrivateDetails{}
+	details.BatchId, _ = record["batchId"].(string)
+	details.TransactionId, _ = record["transactionId"].(string)
+	details.Price, _ = price.(string)
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return false, fmt.Errorf("Failed to marshal buy private details: %v", err)
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(buyPrivateObjectType, []string{details.BatchId, details.TransactionId})
+	if err != nil {
+		return false, fmt.Errorf("Failed to create composite key: %v", err)
+	}
+	for mspId := range mspIds {
+		err = ctx.GetStub().PutPrivateData(orgCollection(mspId), key, detailsJSON)
+		if err != nil {
+			return false, fmt.Errorf("Failed to save buy private details: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// MigratePrivateData moves the contact details and buy prices older records still carry publicly into the
+// private collections and rewrites the records without them. Migrated records get no public hash, only details
+// sent with a salt are hashed. It returns the number of records rewritten.
+func (s *SmartContract) MigratePrivateData(ctx contractapi.TransactionContextInterface) (int, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return 0, err
+	}
+
+	users, err := migratePrivateDataOf(ctx, s, docTypeUser)
+	if err != nil {
+		return 0, err
+	}
+	buys, err := migratePrivateDataOf(ctx, s, docTypeBuy)
+	if err != nil {
+		return 0, err
+	}
+	return users + buys, nil
+}
+
+// migratePrivateDataOf rewrites the user or buy records that still carry private fields publicly
+func migratePrivateDataOf(ctx contractapi.TransactionContextInterface, s *SmartContract, docType string) (int, error) {
+	callerMspId, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get client MSP ID: %v", err)
+	}
+
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docType, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get %s records: %v", docType, err)
+	}
+	defer queryIterator.Close()
+
+	migrated := 0
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		// Unmarshal into a map so the dropped fields can be removed without touching the others
+		var record map[string]interface{}
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			continue
+		}
+
+		var changed bool
+		if docType == docTypeUser {
+			mspId, _ := record["userMspId"].(string)
+			if mspId == "" {
+				mspId = callerMspId
+			}
+			changed, err = movePublicUserDetails(ctx, record, mspId)
+		} else {
+			changed, err = movePublicBuyPrice(ctx, record, buyPartyOrgs(ctx, s, record, callerMspId))
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !changed {
+			continue
+		}
+
+		recordJSON, err := json.Marshal(record)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to marshal %s: %v", docType, err)
+		}
+		err = ctx.GetStub().PutState(queryResponse.Key, recordJSON)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to save %s: %v", docType, err)
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// buyPartyOrgs returns the orgs of a buy record's buyer and seller, the given org stands in for parties bound to none
+func buyPartyOrgs(ctx contractapi.TransactionContextInterface, s *SmartContract, record map[string]interface{}, fallbackMspId string) map[string]bool {
+	mspIds := map[string]bool{}
+	for _, field := range []string{"buyerId", "sellerId"} {
+		userId, _ := record[field].(string)
+		user, err := s.ViewUser(ctx, userId)
+		if err != nil || user.UserMspId == "" {
+			mspIds[fallbackMspId] = true
+			continue
+		}
+		mspIds[user.UserMspId] = true
+	}
+	return mspIds
+}
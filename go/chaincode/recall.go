@@ -0,0 +1,410 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	docTypeRecall        = "Recall"
+	recalledBatchIndex   = "RecalledBatch"
+	recallAckObjectType  = "RecallAck"
+	RecallSeverityLow    = "LOW"
+	RecallSeverityMedium = "MEDIUM"
+	RecallSeverityHigh   = "HIGH"
+)
+
+// RecallAcknowledgement records that a holder of recalled coffee took notice of the recall
+type RecallAcknowledgement struct {
+	HolderId       string `json:"holderId"`
+	MspId          string `json:"mspId"`
+	Note           string `json:"note" metadata:",optional"`
+	AcknowledgedAt string `json:"acknowledgedAt"`
+}
+
+// Recall withdraws a batch and every lot split, merged or sold from it.
+// Acknowledgements are stored apart under RecallAck~recallId~holderId, so holders acknowledging at the same time
+// do not conflict on the recall; reads fill them in.
+type Recall struct {
+	DocType          string                  `json:"docType" metadata:",optional"`
+	RecallId         string                  `json:"recallId"`
+	BatchId          string                  `json:"batchId"`
+	Severity         string                  `json:"severity"`
+	Reason           string                  `json:"reason"`
+	AffectedBatches  []string                `json:"affectedBatches" metadata:",optional"`
+	IssuedBy         string                  `json:"issuedBy" metadata:",optional"`
+	IssuedAt         string                  `json:"issuedAt" metadata:",optional"`
+	Acknowledgements []RecallAcknowledgement `json:"acknowledgements" metadata:",optional"`
+}
+
+// RecallImpact lists who holds or bought coffee covered by a recall
+type RecallImpact struct {
+	RecallId         string                  `json:"recallId"`
+	Batches          []Batch                 `json:"batches"`
+	Buys             []Buy                   `json:"buys"`
+	Buyers           []string                `json:"buyers"`
+	HolderMspIds     []string                `json:"holderMspIds"`
+	Acknowledgements []RecallAcknowledgement `json:"acknowledgements"`
+	Unacknowledged   []string                `json:"unacknowledged"` // buyers that did not acknowledge yet
+}
+
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to get transaction timestamp: %v", err)
+	}
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)), nil
+}
+
+func txTimestamp(ctx contractapi.TransactionContextInterface) (string, error) {
+	now, err := txTime(ctx)
+	if err != nil {
+		return "", err
+	}
+	return now.UTC().Format(time.RFC3339), nil
+}
+
+// checkNotRecalled refuses to trade or rework a batch covered by a recall
+func checkNotRecalled(ctx contractapi.TransactionContextInterface, batchId string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(recalledBatchIndex, []string{batchId})
+	if err != nil {
+		return fmt.Errorf("Failed to create recall index key: %v", err)
+	}
+	recallId, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to read recall index: %v", err)
+	}
+	if recallId != nil {
+		return fmt.Errorf("Batch %s is recalled by %s", batchId, string(recallId))
+	}
+	return nil
+}
+
+// downstreamBatches returns a batch and every lot split or merged from it, sorted by ID
+func downstreamBatches(ctx contractapi.TransactionContextInterface, batchId string) ([]Batch, error) {
+	_, root, err := getBatch(ctx, batchId)
+	if err != nil {
+		return nil, err
+	}
+
+	batches := map[string]Batch{batchId: root}
+	queue := []string{batchId}
+	for len(queue) > 0 {
+		current := batches[queue[0]]
+		queue = queue[1:]
+
+		for _, link := range current.ChildBatches {
+			if _, ok := batches[link.BatchId]; ok {
+				continue
+			}
+			_, batch, err := getBatch(ctx, link.BatchId)
+			if err != nil {
+				return nil, err
+			}
+			batches[link.BatchId] = batch
+			queue = append(queue, link.BatchId)
+		}
+	}
+
+	result := []Batch{}
+	for _, batch := range batches {
+		result = append(result, batch)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].BatchId < result[j].BatchId })
+	return result, nil
+}
+
+func getRecall(ctx contractapi.TransactionContextInterface, recallId string) (string, Recall, error) {
+	key, err := entityKey(ctx, docTypeRecall, recallId)
+	if err != nil {
+		return "", Recall{}, err
+	}
+	recallJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return "", Recall{}, fmt.Errorf("Failed to read recall %s: %v", recallId, err)
+	}
+	if recallJSON == nil {
+		return "", Recall{}, fmt.Errorf("Recall with ID %s does not exist", recallId)
+	}
+
+	var recall Recall
+	err = json.Unmarshal(recallJSON, &recall)
+	if err != nil {
+		return "", Recall{}, fmt.Errorf("Failed to unmarshal recall data: %v", err)
+	}
+
+	// acknowledgements have keys of their own, those made before stay inline on the recall
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(recallAckObjectType, []string{recallId})
+	if err != nil {
+		return "", Recall{}, fmt.Errorf("Failed to read acknowledgements of recall %s: %v", recallId, err)
+	}
+	defer iterator.Close()
+	for iterator.HasNext() {
+		response, err := iterator.Next()
+		if err != nil {
+			return "", Recall{}, fmt.Errorf("Failed to iterate acknowledgements: %v", err)
+		}
+		var acknowledgement RecallAcknowledgement
+		err = json.Unmarshal(response.Value, &acknowledgement)
+		if err != nil {
+			return "", Recall{}, fmt.Errorf("Failed to unmarshal acknowledgement: %v", err)
+		}
+		recall.Acknowledgements = append(recall.Acknowledgements, acknowledgement)
+	}
+	return key, recall, nil
+}
+
+// checkRecallScope makes sure the caller's org owns the batch or made its farm inspection. Admins may recall any batch.
+func checkRecallScope(ctx contractapi.TransactionContextInterface, batchId string) error {
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+	_, batch, err := getBatch(ctx, batchId)
+	if err != nil {
+		return err
+	}
+	if batch.OwnerMspId == mspId {
+		return nil
+	}
+
+	var farmInspector FarmInspector
+	found, err := readStageRecord(ctx, docTypeFarmInspector, batch.FarmInspectionId, &farmInspector)
+	if err != nil {
+		return err
+	}
+	if found && farmInspector.OwnerMspId == mspId {
+		return nil
+	}
+	return fmt.Errorf("Batch %s is neither owned nor inspected by %s and cannot be recalled by it", batchId, mspId)
+}
+
+// IssueRecall recalls a batch together with every lot made from it. Recalled lots can no longer be sold,
+// split or merged. The batch records themselves are left alone, their owners' endorsement is not needed.
+// Only the org owning the batch, the org that inspected its farm or an admin may recall it.
+func (s *SmartContract) IssueRecall(ctx contractapi.TransactionContextInterface, recall Recall) error {
+	callerId, role, err := checkAccess(ctx, "IssueRecall")
+	if err != nil {
+		return err
+	}
+
+	if recall.RecallId == "" {
+		return fmt.Errorf("Recall must have an ID")
+	}
+	if recall.Reason == "" {
+		return fmt.Errorf("Recall must give a reason")
+	}
+	switch recall.Severity {
+	case RecallSeverityLow, RecallSeverityMedium, RecallSeverityHigh:
+	default:
+		return fmt.Errorf("Severity must be %s, %s or %s", RecallSeverityLow, RecallSeverityMedium, RecallSeverityHigh)
+	}
+
+	key, err := entityKey(ctx, docTypeRecall, recall.RecallId)
+	if err != nil {
+		return err
+	}
+	recallJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to check if recall exists: %v", err)
+	}
+	if recallJSON != nil {
+		return fmt.Errorf("Recall with ID %s already exists", recall.RecallId)
+	}
+
+	if role != RoleAdmin {
+		err = checkRecallScope(ctx, recall.BatchId)
+		if err != nil {
+			return err
+		}
+	}
+
+	batches, err := downstreamBatches(ctx, recall.BatchId)
+	if err != nil {
+		return err
+	}
+
+	recall.DocType = docTypeRecall
+	recall.AffectedBatches = []string{}
+	recall.Acknowledgements = []RecallAcknowledgement{}
+	recall.IssuedBy = callerId
+	recall.IssuedAt, err = txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range batches {
+		recall.AffectedBatches = append(recall.AffectedBatches, batch.BatchId)
+
+		indexKey, err := ctx.GetStub().CreateCompositeKey(recalledBatchIndex, []string{batch.BatchId})
+		if err != nil {
+			return fmt.Errorf("Failed to create recall index key: %v", err)
+		}
+		err = ctx.GetStub().PutState(indexKey, []byte(recall.RecallId))
+		if err != nil {
+			return fmt.Errorf("Failed to index recalled batch %s: %v", batch.BatchId, err)
+		}
+	}
+
+	recallJSON, err = json.Marshal(recall)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal recall: %v", err)
+	}
+	err = ctx.GetStub().PutState(key, recallJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save recall: %v", err)
+	}
+	return nil
+}
+
+// ViewRecall retrieves a recall by its ID
+func (s *SmartContract) ViewRecall(ctx contractapi.TransactionContextInterface, recallId string) (Recall, error) {
+	_, recall, err := getRecall(ctx, recallId)
+	return recall, err
+}
+
+// GetRecallImpact lists the recalled lots, the buys made from them, their buyers and the orgs holding the lots
+func (s *SmartContract) GetRecallImpact(ctx contractapi.TransactionContextInterface, recallId string) (RecallImpact, error) {
+	_, recall, err := getRecall(ctx, recallId)
+	if err != nil {
+		return RecallImpact{}, err
+	}
+
+	impact := RecallImpact{
+		RecallId:         recallId,
+		Batches:          []Batch{},
+		Buys:             []Buy{},
+		Buyers:           []string{},
+		HolderMspIds:     []string{},
+		Acknowledgements: recall.Acknowledgements,
+		Unacknowledged:   []string{},
+	}
+	if impact.Acknowledgements == nil {
+		impact.Acknowledgements = []RecallAcknowledgement{}
+	}
+
+	acknowledged := map[string]bool{}
+	for _, acknowledgement := range recall.Acknowledgements {
+		acknowledged[acknowledgement.HolderId] = true
+	}
+	buyers := map[string]bool{}
+	holders := map[string]bool{}
+
+	for _, batchId := range recall.AffectedBatches {
+		_, batch, err := getBatch(ctx, batchId)
+		if err != nil {
+			return RecallImpact{}, err
+		}
+		impact.Batches = append(impact.Batches, batch)
+		if batch.OwnerMspId != "" {
+			holders[batch.OwnerMspId] = true
+		}
+
+		buys, err := s.GetBuyTransactionsByBatchId(ctx, batchId)
+		if err != nil {
+			return RecallImpact{}, err
+		}
+		for _, buy := range buys {
+			if status := buyStatus(*buy); status == BuyStatusCancelled || status == BuyStatusRefunded {
+				continue
+			}
+			impact.Buys = append(impact.Buys, *buy)
+			buyers[buy.BuyerId] = true
+		}
+	}
+
+	for buyer := range buyers {
+		impact.Buyers = append(impact.Buyers, buyer)
+		if !acknowledged[buyer] {
+			impact.Unacknowledged = append(impact.Unacknowledged, buyer)
+		}
+	}
+	for mspId := range holders {
+		impact.HolderMspIds = append(impact.HolderMspIds, mspId)
+	}
+
+	// Map order is random, sort so every peer returns the same result
+	sort.Strings(impact.Buyers)
+	sort.Strings(impact.Unacknowledged)
+	sort.Strings(impact.HolderMspIds)
+
+	return impact, nil
+}
+
+// AcknowledgeRecall records that the caller, a buyer of recalled coffee or a member of an org holding a recalled lot,
+// took notice of the recall
+func (s *SmartContract) AcknowledgeRecall(ctx contractapi.TransactionContextInterface, recallId string, note string) error {
+	callerId, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, recall, err := getRecall(ctx, recallId)
+	if err != nil {
+		return err
+	}
+	for _, acknowledgement := range recall.Acknowledgements {
+		if acknowledgement.HolderId == callerId {
+			return fmt.Errorf("%s already acknowledged recall %s", callerId, recallId)
+		}
+	}
+
+	holder := false
+	for _, batchId := range recall.AffectedBatches {
+		if holder {
+			break
+		}
+		_, batch, err := getBatch(ctx, batchId)
+		if err != nil {
+			return err
+		}
+		if batch.OwnerMspId == mspId {
+			holder = true
+			break
+		}
+
+		buys, err := s.GetBuyTransactionsByBatchId(ctx, batchId)
+		if err != nil {
+			return err
+		}
+		for _, buy := range buys {
+			if buy.BuyerId == callerId {
+				holder = true
+			}
+		}
+	}
+	if !holder {
+		return fmt.Errorf("%s holds no coffee covered by recall %s", callerId, recallId)
+	}
+
+	acknowledgedAt, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	acknowledgementJSON, err := json.Marshal(RecallAcknowledgement{
+		HolderId:       callerId,
+		MspId:          mspId,
+		Note:           note,
+		AcknowledgedAt: acknowledgedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to marshal acknowledgement: %v", err)
+	}
+	ackKey, err := ctx.GetStub().CreateCompositeKey(recallAckObjectType, []string{recallId, callerId})
+	if err != nil {
+		return fmt.Errorf("Failed to create acknowledgement key: %v", err)
+	}
+	err = ctx.GetStub().PutState(ackKey, acknowledgementJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save acknowledgement: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package chaincode
+
+import "testing"
+
+func TestIssueRecallOnlyByOwnerInspectorOrAdmin(t *testing.T) {
+	l := newMockLedger(t)
+	s := new(SmartContract)
+	l.addUser("Org1MSP", "alice", RoleFarmInspector)
+	l.addUser("Org2MSP", "bob", RoleFarmInspector)
+	l.addUser("Org3MSP", "carol", RoleFarmInspector)
+	l.put(docTypeFarmInspector, "F1", FarmInspector{DocType: docTypeFarmInspector, FarmInspectionId: "F1", OwnerMspId: "Org2MSP", BatchId: "B1"})
+	l.put(docTypeBatch, "B1", Batch{DocType: docTypeBatch, BatchId: "B1", FarmInspectionId: "F1", OwnerMspId: "Org1MSP", Remaining: Measure{Value: 100, Unit: "kg"}})
+
+	recall := func(mspId string, callerId string, role string, recallId string) error {
+		return s.IssueRecall(l.as(mspId, callerId, role), Recall{RecallId: recallId, BatchId: "B1", Severity: RecallSeverityHigh, Reason: "mould"})
+	}
+
+	if err := recall("Org3MSP", "carol", RoleFarmInspector, "R1"); err == nil {
+		t.Fatal("an inspector of an org that neither owns nor inspected the batch recalled it")
+	}
+	if err := recall("Org1MSP", "alice", RoleFarmInspector, "R1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := recall("Org2MSP", "bob", RoleFarmInspector, "R2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := recall("Org3MSP", "admin", RoleAdmin, "R3"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -8,16 +8,14 @@ import (
 
 // Structs for each entity
 type User struct {
+	DocType       string `json:"docType" metadata:",optional"`
 	UserId        string `json:"userId"`
 	UserType      string `json:"userType"`
 	UserRole      string `json:"userRole"`
 	UserName      string `json:"userName"`
-	UserEmail     string `json:"userEmail"`
-	UserPhone     string `json:"userPhone"`
-	UserAddress   string `json:"userAddress"`
-	UserPassword   string `json:"userPassword"`
+	UserPrivateHash string `json:"userPrivateHash" metadata:",optional"` // hash of the email, phone and address held in the user's org collection
+	UserMspId     string `json:"userMspId" metadata:",optional"` // MSP of the X.509 identity whose enrollment ID is UserId
 	UserWalletAddress string `json:"userWalletAddress"`
-	UserBuyProducts   []Buy  `json:"userBuyProducts"` // 👈 optional
 	UserStatus    string `json:"userStatus"`
 	UserIsDeleted string `json:"userIsDeleted"`
 	UserCreatedAt string `json:"userCreatedAt"`
@@ -29,6 +27,7 @@ type User struct {
 }
 
 type FarmInspector struct {
+	DocType            string   `json:"docType" metadata:",optional"`
 	FarmInspectionId   string   `json:"farmInspectionId"`
 	FarmInspectionName string   `json:"farmInspectionName"`
 	CertificateNo      string   `json:"certificateNo"`
@@ -41,23 +40,28 @@ type FarmInspector struct {
 	FarmInspectionCreatedAt string   `json:"farmInspectionCreatedAt"`
 	FarmInspectionUpdatedAt string   `json:"farmInspectionUpdatedAt"`
 	FarmInspectionDeletedAt string   `json:"farmInspectionDeletedAt"`
+	OwnerMspId         string   `json:"ownerMspId" metadata:",optional"` // MSP of the org that created the record
 	BatchId            string   `json:"batchId"` // Link to Batch
 }
 
 type Harvester struct {
+	DocType          string `json:"docType" metadata:",optional"`
 	HarvestId        string `json:"harvestId"`
 	HarvesterName     string `json:"harvesterName"`
 	CropSampling     string `json:"cropSampling"`
 	TempratureLevel  string `json:"temperatureLevel"`
 	Humidity         string `json:"humidityLevel"`
 	HarvestStatus    string `json:"harvestStatus"`
+	Volume           Measure `json:"volume" metadata:",optional"` // weight of cherry harvested
 	HarvestCreatedAt string `json:"harvestCreatedAt"`
 	HarvestUpdatedAt string `json:"harvestUpdatedAt"`
 	HarvestDeletedAt string `json:"harvestDeletedAt"`
+	OwnerMspId       string `json:"ownerMspId" metadata:",optional"` // MSP of the org that created the record
 	BatchId          string `json:"batchId"` // Link to Batch
 }
 
 type Importer struct {
+	DocType              string `json:"docType" metadata:",optional"`
 	ImporterId           string `json:"importerId"`
 	ImporterName     string `json:"importerName"`
 	Quantity             string `json:"quantity"`
@@ -67,13 +71,16 @@ type Importer struct {
 	WarehouseArrivalDate string `json:"warehouseArrivalDate"`
 	ImporterAddress      string `json:"importerAddress"`
 	ImporterStatus       string `json:"importerStatus"`
+	Volume               Measure `json:"volume" metadata:",optional"` // weight received, replaces the free-text Quantity
 	ImporterCreatedAt    string `json:"importerCreated"`
 	ImporterUpdatedAt    string `json:"importerUpdated"`
 	ImporterDeletedAt    string `json:"importerDeleted"`
+	OwnerMspId           string `json:"ownerMspId" metadata:",optional"` // MSP of the org that created the record
 	BatchId              string `json:"batchId"` // Link to Batch
 }
 
 type Exporter struct {
+	DocType             string `json:"docType" metadata:",optional"`
 	ExporterId          string `json:"exporterId"`
 	CoordinationAddress string `json:"coordinationAddress"`
 	ExporterName        string `json:"exporterName"`
@@ -83,13 +90,16 @@ type Exporter struct {
 	EstimatedDate       string `json:"estimatedDate"`
 	ExportedTo          string `json:"exportedTo"`
 	ExporterStatus      string `json:"exporterStatus"`
+	Volume              Measure `json:"volume" metadata:",optional"` // weight shipped
 	ExporterCreatedAt   string `json:"exporterCreated"`
 	ExporterUpdatedAt   string `json:"exporterUpdated"`
 	ExporterDeletedAt   string `json:"exporterDeleted"`
+	OwnerMspId          string `json:"ownerMspId" metadata:",optional"` // MSP of the org that created the record
 	BatchId             string `json:"batchId"` // Link to Batch
 }
 
 type Processor struct {
+	DocType            string   `json:"docType" metadata:",optional"`
 	ProcessorId        string   `json:"processorId"`
 	Quantity           string   `json:"quantity"`
 	ProcessingMethod   string   `json:"processingMethod"`
@@ -101,14 +111,17 @@ type Processor struct {
 	WarehouseLocation  string   `json:"warehouseLocation"`
 	Destination        string   `json:"destination"`
 	ProcessorStatus    string   `json:"processorStatus"`
+	Volume             Measure  `json:"volume" metadata:",optional"` // weight after processing, replaces the free-text Quantity
 	ProcessorCreatedAt string   `json:"processorCreated"`
 	ProcessorUpdatedAt string   `json:"processorUpdated"`
 	ProcessorDeletedAt string   `json:"processorDeleted"`
 	Image              []string `json:"image" metadata:",optional"`
+	OwnerMspId         string   `json:"ownerMspId" metadata:",optional"` // MSP of the org that created the record
 	BatchId            string   `json:"batchId"` // Link to Batch
 }
 
 type Batch struct {
+	DocType             string `json:"docType" metadata:",optional"`
 	BatchId             string `json:"batchId"`
 	FarmerRegNo         string `json:"farmerRegNo"`
 	FarmerName          string `json:"farmerName"`
@@ -133,15 +146,23 @@ type Batch struct {
 	BatchCreatedBy      string `json:"batchCreatedBy"`
 	BatchUpdatedBy      string `json:"batchUpdatedBy"`
 	BatchDeletedBy      string `json:"batchDeletedBy"`
+	OwnerMspId          string `json:"ownerMspId" metadata:",optional"` // MSP of the org responsible for the batch's current stage
+	Quantity            string `json:"quantity" metadata:",optional"`
+	ParentBatches       []BatchLink `json:"parentBatches" metadata:",optional"` // lots this batch was split or merged from
+	ChildBatches        []BatchLink `json:"childBatches" metadata:",optional"`  // lots split or merged from this batch
+	Remaining           Measure `json:"remaining" metadata:",optional"` // weight of the imported batch still for sale, in kilograms
 }
 type Buy struct {
+	DocType      string `json:"docType" metadata:",optional"`
 	BatchId      string `json:"batchId"`
 	TransactionId string `json:"transactionId"`
 	BuyerId      string `json:"buyerId"`
 	SellerId      string `json:"sellerId"`
 	Quantity     string `json:"quantity"`
-	Price        string `json:"price"`
-	BuyStatus    string `json:"buyStatus"`
+	Volume       Measure `json:"volume" metadata:",optional"` // weight bought, replaces the free-text Quantity
+	PriceHash    string `json:"priceHash" metadata:",optional"` // hash of the price and payment held in the buyer's and seller's org collections
+	BuyStatus    string `json:"buyStatus"` // PENDING, PAID, DELIVERED, CANCELLED or REFUNDED
+	PurchasedBatchId string `json:"purchasedBatchId" metadata:",optional"` // lot split off for the buyer on delivery
 	BuyCreatedAt string `json:"buyCreated"`
 	BuyUpdatedAt string `json:"buyUpdated"`
 }
@@ -153,8 +174,18 @@ type SmartContract struct {
 
 
 func (s *SmartContract) CreateUser(ctx contractapi.TransactionContextInterface, user User) error {
+	if _, _, err := checkAccess(ctx, "CreateUser"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeUser, user.UserId)
+	if err != nil {
+		return err
+	}
+	user.DocType = docTypeUser
+
 	// Check if user already exists
-	userJSON, err := ctx.GetStub().GetState(user.UserId)
+	userJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return fmt.Errorf("Failed to check if user exists: %v", err)
 	}
@@ -162,13 +193,40 @@ func (s *SmartContract) CreateUser(ctx contractapi.TransactionContextInterface,
 		return fmt.Errorf("Batch with ID %s already exists", user.UserId)
 	}
 
+	// Bind the user to an identity of the creating org unless another MSP was given
+	if user.UserMspId == "" {
+		user.UserMspId, err = ctx.GetClientIdentity().GetMSPID()
+		if err != nil {
+			return fmt.Errorf("Failed to get client MSP ID: %v", err)
+		}
+	}
+
+	// Only a salted hash of the password is kept, in the user's org-private collection
+	password, err := getTransientPassword(ctx)
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		err = putUserCredential(ctx, user.UserId, user.UserMspId, password)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Contact details go to the user's org collection, only their hash stays public
+	user.UserPrivateHash = ""
+	err = putUserPrivateDetails(ctx, &user)
+	if err != nil {
+		return err
+	}
+
 	// Add user to the ledger
 	userJSON, err = json.Marshal(user)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal user: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(user.UserId, userJSON)
+	err = ctx.GetStub().PutState(key, userJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to create user: %v", err)
 	}
@@ -179,8 +237,18 @@ func (s *SmartContract) CreateUser(ctx contractapi.TransactionContextInterface,
 // Create Functions for Batch, FarmInspector, Harvester, Importer, Exporter, and Processor
 
 func (s *SmartContract) CreateBatch(ctx contractapi.TransactionContextInterface, batch Batch) error {
+	if _, _, err := checkAccess(ctx, "CreateBatch"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeBatch, batch.BatchId)
+	if err != nil {
+		return err
+	}
+	batch.DocType = docTypeBatch
+
 	// Check if batch already exists
-	batchJSON, err := ctx.GetStub().GetState(batch.BatchId)
+	batchJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return fmt.Errorf("Failed to check if batch exists: %v", err)
 	}
@@ -188,23 +256,56 @@ func (s *SmartContract) CreateBatch(ctx contractapi.TransactionContextInterface,
 		return fmt.Errorf("Batch with ID %s already exists", batch.BatchId)
 	}
 
+	// Every batch starts unlinked, the stage transactions fill in the rest
+	batch.BatchStatus = BatchStatusRegistered
+	batch.FarmInspectionId = ""
+	batch.HarvesterId = ""
+	batch.ProcessorId = ""
+	batch.ExporterId = ""
+	batch.ImporterId = ""
+	batch.ParentBatches = nil
+	batch.ChildBatches = nil
+	batch.Remaining = Measure{}
+
+	// The creating org owns the record and must endorse any change to it
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+	batch.OwnerMspId = mspId
+
 	// Add batch to the ledger
 	batchJSON, err = json.Marshal(batch)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal batch: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(batch.BatchId, batchJSON)
+	err = ctx.GetStub().PutState(key, batchJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to create batch: %v", err)
 	}
 
+	err = setOrgEndorsementPolicy(ctx, key, mspId)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
 func (s *SmartContract) CreateFarmInspector(ctx contractapi.TransactionContextInterface, farmInspector FarmInspector) error {
+	if _, _, err := checkAccess(ctx, "CreateFarmInspector"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeFarmInspector, farmInspector.FarmInspectionId)
+	if err != nil {
+		return err
+	}
+	farmInspector.DocType = docTypeFarmInspector
+
 	// Check if farm inspector already exists
-	farmInspectorJSON, err := ctx.GetStub().GetState(farmInspector.FarmInspectionId)
+	farmInspectorJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return fmt.Errorf("Failed to check if farm inspector exists: %v", err)
 	}
@@ -212,8 +313,32 @@ func (s *SmartContract) CreateFarmInspector(ctx contractapi.TransactionContextIn
 		return fmt.Errorf("Farm inspector with ID %s already exists", farmInspector.FarmInspectionId)
 	}
 
-	// Link to BatchId
-	// farmInspector.BatchId = farmInspector.FarmInspectionId
+	// The batch must have completed the previous stage
+	batchKey, batch, err := getBatchForStage(ctx, docTypeFarmInspector, farmInspector.BatchId)
+	if err != nil {
+		return err
+	}
+
+	// The cited certificate must be registered and in force
+	err = checkInspectionCertificate(ctx, farmInspector, batch)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	err = indexCertificateUse(ctx, farmInspector, batch, now)
+	if err != nil {
+		return err
+	}
+
+	// The creating org owns the record and must endorse any change to it
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+	farmInspector.OwnerMspId = mspId
 
 	// Add farm inspector to the ledger
 	farmInspectorJSON, err = json.Marshal(farmInspector)
@@ -221,17 +346,36 @@ func (s *SmartContract) CreateFarmInspector(ctx contractapi.TransactionContextIn
 		return fmt.Errorf("Failed to marshal farm inspector: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(farmInspector.FarmInspectionId, farmInspectorJSON)
+	err = ctx.GetStub().PutState(key, farmInspectorJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to create farm inspector: %v", err)
 	}
 
-	return nil
+	err = setOrgEndorsementPolicy(ctx, key, mspId)
+	if err != nil {
+		return err
+	}
+
+	// Link the record into the batch and advance it, changes to the batch now need this org's endorsement
+	return advanceBatch(ctx, batchKey, batch, docTypeFarmInspector, farmInspector.FarmInspectionId, farmInspector.FarmInspectionName, mspId)
 }
 
 func (s *SmartContract) CreateHarvester(ctx contractapi.TransactionContextInterface, harvester Harvester) error {
+	if _, _, err := checkAccess(ctx, "CreateHarvester"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeHarvester, harvester.HarvestId)
+	if err != nil {
+		return err
+	}
+	harvester.DocType = docTypeHarvester
+	if err := validateMeasure(harvester.Volume); err != nil {
+		return err
+	}
+
 	// Check if harvester already exists
-	harvesterJSON, err := ctx.GetStub().GetState(harvester.HarvestId)
+	harvesterJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return fmt.Errorf("Failed to check if harvester exists: %v", err)
 	}
@@ -239,8 +383,24 @@ func (s *SmartContract) CreateHarvester(ctx contractapi.TransactionContextInterf
 		return fmt.Errorf("Harvester with ID %s already exists", harvester.HarvestId)
 	}
 
-	// Link to BatchId
-	// harvester.BatchId = harvester.HarvestId
+	// The batch must have completed the previous stage
+	batchKey, batch, err := getBatchForStage(ctx, docTypeHarvester, harvester.BatchId)
+	if err != nil {
+		return err
+	}
+
+	// The harvest counts against the volume the batch's certificate may cover this season
+	err = recordCertifiedVolume(ctx, batch, harvester.Volume)
+	if err != nil {
+		return err
+	}
+
+	// The creating org owns the record and must endorse any change to it
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+	harvester.OwnerMspId = mspId
 
 	// Add harvester to the ledger
 	harvesterJSON, err = json.Marshal(harvester)
@@ -248,17 +408,36 @@ func (s *SmartContract) CreateHarvester(ctx contractapi.TransactionContextInterf
 		return fmt.Errorf("Failed to marshal harvester: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(harvester.HarvestId, harvesterJSON)
+	err = ctx.GetStub().PutState(key, harvesterJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to create harvester: %v", err)
 	}
 
-	return nil
+	err = setOrgEndorsementPolicy(ctx, key, mspId)
+	if err != nil {
+		return err
+	}
+
+	// Link the record into the batch and advance it, changes to the batch now need this org's endorsement
+	return advanceBatch(ctx, batchKey, batch, docTypeHarvester, harvester.HarvestId, harvester.HarvesterName, mspId)
 }
 
 func (s *SmartContract) CreateImporter(ctx contractapi.TransactionContextInterface, importer Importer) error {
+	if _, _, err := checkAccess(ctx, "CreateImporter"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeImporter, importer.ImporterId)
+	if err != nil {
+		return err
+	}
+	importer.DocType = docTypeImporter
+	if err := validateMeasure(importer.Volume); err != nil {
+		return err
+	}
+
 	// Check if importer already exists
-	importerJSON, err := ctx.GetStub().GetState(importer.ImporterId)
+	importerJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return fmt.Errorf("Failed to check if importer exists: %v", err)
 	}
@@ -266,8 +445,18 @@ func (s *SmartContract) CreateImporter(ctx contractapi.TransactionContextInterfa
 		return fmt.Errorf("Importer with ID %s already exists", importer.ImporterId)
 	}
 
-	// Link to BatchId
-	// importer.BatchId = importer.ImporterId
+	// The batch must have completed the previous stage
+	batchKey, batch, err := getBatchForStage(ctx, docTypeImporter, importer.BatchId)
+	if err != nil {
+		return err
+	}
+
+	// The creating org owns the record and must endorse any change to it
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+	importer.OwnerMspId = mspId
 
 	// Add importer to the ledger
 	importerJSON, err = json.Marshal(importer)
@@ -275,17 +464,41 @@ func (s *SmartContract) CreateImporter(ctx contractapi.TransactionContextInterfa
 		return fmt.Errorf("Failed to marshal importer: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(importer.ImporterId, importerJSON)
+	err = ctx.GetStub().PutState(key, importerJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to create importer: %v", err)
 	}
 
-	return nil
+	err = setOrgEndorsementPolicy(ctx, key, mspId)
+	if err != nil {
+		return err
+	}
+
+	// What was imported is what can be sold from the batch
+	if weight, known := kilograms(importer.Volume, importer.Quantity); known {
+		batch.Remaining = Measure{Value: weight, Unit: "kg"}
+	}
+
+	// Link the record into the batch and advance it, changes to the batch now need this org's endorsement
+	return advanceBatch(ctx, batchKey, batch, docTypeImporter, importer.ImporterId, importer.ImporterName, mspId)
 }
 
 func (s *SmartContract) CreateExporter(ctx contractapi.TransactionContextInterface, exporter Exporter) error {
+	if _, _, err := checkAccess(ctx, "CreateExporter"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeExporter, exporter.ExporterId)
+	if err != nil {
+		return err
+	}
+	exporter.DocType = docTypeExporter
+	if err := validateMeasure(exporter.Volume); err != nil {
+		return err
+	}
+
 	// Check if exporter already exists
-	exporterJSON, err := ctx.GetStub().GetState(exporter.ExporterId)
+	exporterJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return fmt.Errorf("Failed to check if exporter exists: %v", err)
 	}
@@ -293,8 +506,18 @@ func (s *SmartContract) CreateExporter(ctx contractapi.TransactionContextInterfa
 		return fmt.Errorf("Exporter with ID %s already exists", exporter.ExporterId)
 	}
 
-	// Link to BatchId
-	// exporter.BatchId = exporter.ExporterId
+	// The batch must have completed the previous stage
+	batchKey, batch, err := getBatchForStage(ctx, docTypeExporter, exporter.BatchId)
+	if err != nil {
+		return err
+	}
+
+	// The creating org owns the record and must endorse any change to it
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+	exporter.OwnerMspId = mspId
 
 	// Add exporter to the ledger
 	exporterJSON, err = json.Marshal(exporter)
@@ -302,17 +525,36 @@ func (s *SmartContract) CreateExporter(ctx contractapi.TransactionContextInterfa
 		return fmt.Errorf("Failed to marshal exporter: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(exporter.ExporterId, exporterJSON)
+	err = ctx.GetStub().PutState(key, exporterJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to create exporter: %v", err)
 	}
 
-	return nil
+	err = setOrgEndorsementPolicy(ctx, key, mspId)
+	if err != nil {
+		return err
+	}
+
+	// Link the record into the batch and advance it, changes to the batch now need this org's endorsement
+	return advanceBatch(ctx, batchKey, batch, docTypeExporter, exporter.ExporterId, exporter.ExporterName, mspId)
 }
 
 func (s *SmartContract) CreateProcessor(ctx contractapi.TransactionContextInterface, processor Processor) error {
+	if _, _, err := checkAccess(ctx, "CreateProcessor"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeProcessor, processor.ProcessorId)
+	if err != nil {
+		return err
+	}
+	processor.DocType = docTypeProcessor
+	if err := validateMeasure(processor.Volume); err != nil {
+		return err
+	}
+
 	// Check if processor already exists
-	processorJSON, err := ctx.GetStub().GetState(processor.ProcessorId)
+	processorJSON, err := ctx.GetStub().GetState(key)
 	if err != nil {
 		return fmt.Errorf("Failed to check if processor exists: %v", err)
 	}
@@ -320,8 +562,18 @@ func (s *SmartContract) CreateProcessor(ctx contractapi.TransactionContextInterf
 		return fmt.Errorf("Processor with ID %s already exists", processor.ProcessorId)
 	}
 
-	// Link to BatchId
-	// processor.BatchId = processor.ProcessorId
+	// The batch must have completed the previous stage
+	batchKey, batch, err := getBatchForStage(ctx, docTypeProcessor, processor.BatchId)
+	if err != nil {
+		return err
+	}
+
+	// The creating org owns the record and must endorse any change to it
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+	processor.OwnerMspId = mspId
 
 	// Add processor to the ledger
 	processorJSON, err = json.Marshal(processor)
@@ -329,21 +581,36 @@ func (s *SmartContract) CreateProcessor(ctx contractapi.TransactionContextInterf
 		return fmt.Errorf("Failed to marshal processor: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(processor.ProcessorId, processorJSON)
+	err = ctx.GetStub().PutState(key, processorJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to create processor: %v", err)
 	}
 
-	return nil
+	err = setOrgEndorsementPolicy(ctx, key, mspId)
+	if err != nil {
+		return err
+	}
+
+	// Link the record into the batch and advance it, changes to the batch now need this org's endorsement
+	return advanceBatch(ctx, batchKey, batch, docTypeProcessor, processor.ProcessorId, processor.ProcessorName, mspId)
 }
 
-// CreateBuy creates a new buy record with composite key Buy~BatchId~TransactionId and updates the user's buy history
+// CreateBuy creates a new buy record with composite key Buy~BatchId~TransactionId and lists it in the BuyByBuyer and BuyBySeller indexes
 func (s *SmartContract) CreateBuy(ctx contractapi.TransactionContextInterface, buy Buy) error {
+	callerId, role, err := checkAccess(ctx, "CreateBuy")
+	if err != nil {
+		return err
+	}
+
 	// Create a composite key using batchId and transactionId
-	compositeKey, err := ctx.GetStub().CreateCompositeKey("Buy", []string{buy.BatchId, buy.TransactionId})
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(docTypeBuy, []string{buy.BatchId, buy.TransactionId})
 	if err != nil {
 		return fmt.Errorf("failed to create composite key: %v", err)
 	}
+	buy.DocType = docTypeBuy
+	if err := validateMeasure(buy.Volume); err != nil {
+		return err
+	}
 
 	// Check if this specific transaction already exists
 	existing, err := ctx.GetStub().GetState(compositeKey)
@@ -354,49 +621,76 @@ func (s *SmartContract) CreateBuy(ctx contractapi.TransactionContextInterface, b
 		return fmt.Errorf("buy transaction already exists for BatchId %s and TransactionId %s", buy.BatchId, buy.TransactionId)
 	}
 
-	// Marshal the buy object
-	buyJSON, err := json.Marshal(buy)
+	// Only imported batches can be sold
+	batchKey, batch, err := getBatchForStage(ctx, docTypeBuy, buy.BatchId)
 	if err != nil {
-		return fmt.Errorf("failed to marshal buy: %v", err)
+		return err
+	}
+	if err := checkNotRecalled(ctx, buy.BatchId); err != nil {
+		return err
 	}
 
-	// Save the buy record with composite key
-	err = ctx.GetStub().PutState(compositeKey, buyJSON)
+	// The seller records the sale and must be of the org holding the batch
+	if role != RoleAdmin && callerId != buy.SellerId {
+		return fmt.Errorf("buy must be submitted by its seller %s", buy.SellerId)
+	}
+	if buy.BuyerId == buy.SellerId {
+		return fmt.Errorf("buyer and seller must differ")
+	}
+	if _, err := s.ViewUser(ctx, buy.BuyerId); err != nil {
+		return err
+	}
+	seller, err := s.ViewUser(ctx, buy.SellerId)
 	if err != nil {
-		return fmt.Errorf("failed to save buy: %v", err)
+		return err
+	}
+	if seller.UserMspId != batch.OwnerMspId {
+		return fmt.Errorf("seller %s does not hold batch %s", buy.SellerId, buy.BatchId)
 	}
 
-	// Get the buyer user data
-	userJSON, err := ctx.GetStub().GetState(buy.BuyerId)
+	// The buy may not exceed what is left of the batch
+	bought, known := kilograms(buy.Volume, buy.Quantity)
+	if !known || bought <= 0 {
+		return fmt.Errorf("buy must have a positive quantity")
+	}
+	remaining, err := sellableKilograms(ctx, s, batch)
 	if err != nil {
-		return fmt.Errorf("failed to get user %s: %v", buy.BuyerId, err)
+		return err
 	}
-	if userJSON == nil {
-		return fmt.Errorf("user with ID %s does not exist", buy.BuyerId)
+	if bought > remaining {
+		return fmt.Errorf("batch %s has %s kg left, cannot sell %s kg", buy.BatchId, formatKilograms(remaining), formatKilograms(bought))
 	}
+	batch.Remaining = Measure{Value: remaining - bought, Unit: "kg"}
+	buy.BuyStatus = BuyStatusPending
+	buy.PurchasedBatchId = ""
 
-	var user User
-	err = json.Unmarshal(userJSON, &user)
+	// The price and payment go to the buyer's and seller's org collections, only their hash stays public
+	buy.PriceHash = ""
+	err = putBuyPrivateDetails(ctx, &buy)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal user data: %v", err)
+		return err
 	}
 
-	// Append buy to UserBuyProducts
-	user.UserBuyProducts = append(user.UserBuyProducts, buy)
+	// Marshal the buy object
+	buyJSON, err := json.Marshal(buy)
+	if err != nil {
+		return fmt.Errorf("failed to marshal buy: %v", err)
+	}
 
-	// Marshal updated user
-	updatedUserJSON, err := json.Marshal(user)
+	// Save the buy record with composite key
+	err = ctx.GetStub().PutState(compositeKey, buyJSON)
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated user: %v", err)
+		return fmt.Errorf("failed to save buy: %v", err)
 	}
 
-	// Save updated user state
-	err = ctx.GetStub().PutState(user.UserId, updatedUserJSON)
+	// The batch stays with the importer's org
+	err = advanceBatch(ctx, batchKey, batch, docTypeBuy, buy.TransactionId, "", batch.OwnerMspId)
 	if err != nil {
-		return fmt.Errorf("failed to save updated user: %v", err)
+		return err
 	}
 
-	return nil
+	// List the buy under its buyer and seller
+	return putBuyIndexes(ctx, buy, compositeKey)
 }
 
 
@@ -404,19 +698,68 @@ func (s *SmartContract) CreateBuy(ctx contractapi.TransactionContextInterface, b
 // Update Functions
 
 func (s *SmartContract) UpdateUser(ctx contractapi.TransactionContextInterface, user User) error {
+	// Users may update their own profile, anyone else needs the UpdateUser permission
+	callerId, role, err := getCallerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if callerId != user.UserId {
+		if _, _, err := checkAccess(ctx, "UpdateUser"); err != nil {
+			return err
+		}
+	}
+
+	key, err := entityKey(ctx, docTypeUser, user.UserId)
+	if err != nil {
+		return err
+	}
+	user.DocType = docTypeUser
+
 	// Check if user exists
-	userJSON, err := ctx.GetStub().GetState(user.UserId)
+	userJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || userJSON == nil {
 		return fmt.Errorf("User with ID %s does not exist", user.UserId)
 	}
 
+	var existingUser User
+	err = json.Unmarshal(userJSON, &existingUser)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal user data: %v", err)
+	}
+	if role != RoleAdmin && existingUser.UserRole != user.UserRole {
+		return fmt.Errorf("Only %s may change the role of user %s", RoleAdmin, user.UserId)
+	}
+	if user.UserMspId == "" {
+		user.UserMspId = existingUser.UserMspId
+	}
+	if role != RoleAdmin && existingUser.UserMspId != user.UserMspId {
+		return fmt.Errorf("Only %s may rebind user %s to another MSP", RoleAdmin, user.UserId)
+	}
+
+	password, err := getTransientPassword(ctx)
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		err = putUserCredential(ctx, user.UserId, user.UserMspId, password)
+		if err != nil {
+			return err
+		}
+	}
+
+	user.UserPrivateHash = existingUser.UserPrivateHash
+	err = putUserPrivateDetails(ctx, &user)
+	if err != nil {
+		return err
+	}
+
 	// Update user information
 	updatedUserJSON, err := json.Marshal(user)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal updated user: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(user.UserId, updatedUserJSON)
+	err = ctx.GetStub().PutState(key, updatedUserJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to update user: %v", err)
 	}
@@ -426,19 +769,51 @@ func (s *SmartContract) UpdateUser(ctx contractapi.TransactionContextInterface,
 
 
 func (s *SmartContract) UpdateBatch(ctx contractapi.TransactionContextInterface, batch Batch) error {
+	if _, _, err := checkAccess(ctx, "UpdateBatch"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeBatch, batch.BatchId)
+	if err != nil {
+		return err
+	}
+	batch.DocType = docTypeBatch
+
 	// Check if batch exists
-	batchJSON, err := ctx.GetStub().GetState(batch.BatchId)
+	batchJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || batchJSON == nil {
 		return fmt.Errorf("Batch with ID %s does not exist", batch.BatchId)
 	}
 
+	// Only the owning org may change the record
+	var existingBatch Batch
+	err = json.Unmarshal(batchJSON, &existingBatch)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal batch data: %v", err)
+	}
+	batch.OwnerMspId, err = checkOwnerOrg(ctx, key, existingBatch.OwnerMspId)
+	if err != nil {
+		return err
+	}
+
+	// The status and stage links only change through the stage transactions
+	batch.BatchStatus = existingBatch.BatchStatus
+	batch.FarmInspectionId = existingBatch.FarmInspectionId
+	batch.HarvesterId = existingBatch.HarvesterId
+	batch.ProcessorId = existingBatch.ProcessorId
+	batch.ExporterId = existingBatch.ExporterId
+	batch.ImporterId = existingBatch.ImporterId
+	batch.ParentBatches = existingBatch.ParentBatches
+	batch.ChildBatches = existingBatch.ChildBatches
+	batch.Remaining = existingBatch.Remaining
+
 	// Update batch information
 	updatedBatchJSON, err := json.Marshal(batch)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal updated batch: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(batch.BatchId, updatedBatchJSON)
+	err = ctx.GetStub().PutState(key, updatedBatchJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to update batch: %v", err)
 	}
@@ -450,19 +825,67 @@ func (s *SmartContract) UpdateBatch(ctx contractapi.TransactionContextInterface,
 
 // UpdateFarmInspector updates farm inspector information
 func (s *SmartContract) UpdateFarmInspector(ctx contractapi.TransactionContextInterface, farmInspector FarmInspector) error {
+	if _, _, err := checkAccess(ctx, "UpdateFarmInspector"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeFarmInspector, farmInspector.FarmInspectionId)
+	if err != nil {
+		return err
+	}
+	farmInspector.DocType = docTypeFarmInspector
+
 	// Check if farm inspector exists
-	farmInspectorJSON, err := ctx.GetStub().GetState(farmInspector.FarmInspectionId)
+	farmInspectorJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || farmInspectorJSON == nil {
 		return fmt.Errorf("Farm Inspector with ID %s does not exist", farmInspector.FarmInspectionId)
 	}
 
+	// Only the owning org may change the record
+	var existingFarmInspector FarmInspector
+	err = json.Unmarshal(farmInspectorJSON, &existingFarmInspector)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal farm inspector data: %v", err)
+	}
+	farmInspector.OwnerMspId, err = checkOwnerOrg(ctx, key, existingFarmInspector.OwnerMspId)
+	if err != nil {
+		return err
+	}
+	if farmInspector.BatchId != existingFarmInspector.BatchId {
+		return fmt.Errorf("Farm inspector %s cannot be moved to another batch", farmInspector.FarmInspectionId)
+	}
+	if farmInspector.CertificateNo != existingFarmInspector.CertificateNo || farmInspector.CertificateFrom != existingFarmInspector.CertificateFrom || farmInspector.ProductName != existingFarmInspector.ProductName {
+		_, batch, err := getBatch(ctx, farmInspector.BatchId)
+		if err != nil {
+			return err
+		}
+		err = checkInspectionCertificate(ctx, farmInspector, batch)
+		if err != nil {
+			return err
+		}
+		if farmInspector.CertificateNo != existingFarmInspector.CertificateNo {
+			err = unindexCertificateUse(ctx, existingFarmInspector.CertificateNo, batch.BatchId)
+			if err != nil {
+				return err
+			}
+			now, err := txTime(ctx)
+			if err != nil {
+				return err
+			}
+			err = indexCertificateUse(ctx, farmInspector, batch, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	// Update farm inspector
 	updatedFarmInspectorJSON, err := json.Marshal(farmInspector)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal updated farm inspector: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(farmInspector.FarmInspectionId, updatedFarmInspectorJSON)
+	err = ctx.GetStub().PutState(key, updatedFarmInspectorJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to update farm inspector: %v", err)
 	}
@@ -472,19 +895,56 @@ func (s *SmartContract) UpdateFarmInspector(ctx contractapi.TransactionContextIn
 
 // UpdateHarvester updates harvester information
 func (s *SmartContract) UpdateHarvester(ctx contractapi.TransactionContextInterface, harvester Harvester) error {
+	if _, _, err := checkAccess(ctx, "UpdateHarvester"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeHarvester, harvester.HarvestId)
+	if err != nil {
+		return err
+	}
+	harvester.DocType = docTypeHarvester
+	if err := validateMeasure(harvester.Volume); err != nil {
+		return err
+	}
+
 	// Check if harvester exists
-	harvesterJSON, err := ctx.GetStub().GetState(harvester.HarvestId)
+	harvesterJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || harvesterJSON == nil {
 		return fmt.Errorf("Harvester with ID %s does not exist", harvester.HarvestId)
 	}
 
+	// Only the owning org may change the record
+	var existingHarvester Harvester
+	err = json.Unmarshal(harvesterJSON, &existingHarvester)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal harvester data: %v", err)
+	}
+	harvester.OwnerMspId, err = checkOwnerOrg(ctx, key, existingHarvester.OwnerMspId)
+	if err != nil {
+		return err
+	}
+	if harvester.BatchId != existingHarvester.BatchId {
+		return fmt.Errorf("Harvester %s cannot be moved to another batch", harvester.HarvestId)
+	}
+	if harvester.Volume != existingHarvester.Volume {
+		_, batch, err := getBatch(ctx, harvester.BatchId)
+		if err != nil {
+			return err
+		}
+		err = recordCertifiedVolume(ctx, batch, harvester.Volume)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Update harvester
 	updatedHarvesterJSON, err := json.Marshal(harvester)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal updated harvester: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(harvester.HarvestId, updatedHarvesterJSON)
+	err = ctx.GetStub().PutState(key, updatedHarvesterJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to update harvester: %v", err)
 	}
@@ -494,19 +954,46 @@ func (s *SmartContract) UpdateHarvester(ctx contractapi.TransactionContextInterf
 
 // UpdateImporter updates importer information
 func (s *SmartContract) UpdateImporter(ctx contractapi.TransactionContextInterface, importer Importer) error {
+	if _, _, err := checkAccess(ctx, "UpdateImporter"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeImporter, importer.ImporterId)
+	if err != nil {
+		return err
+	}
+	importer.DocType = docTypeImporter
+	if err := validateMeasure(importer.Volume); err != nil {
+		return err
+	}
+
 	// Check if importer exists
-	importerJSON, err := ctx.GetStub().GetState(importer.ImporterId)
+	importerJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || importerJSON == nil {
 		return fmt.Errorf("Importer with ID %s does not exist", importer.ImporterId)
 	}
 
+	// Only the owning org may change the record
+	var existingImporter Importer
+	err = json.Unmarshal(importerJSON, &existingImporter)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal importer data: %v", err)
+	}
+	importer.OwnerMspId, err = checkOwnerOrg(ctx, key, existingImporter.OwnerMspId)
+	if err != nil {
+		return err
+	}
+	if importer.BatchId != existingImporter.BatchId {
+		return fmt.Errorf("Importer %s cannot be moved to another batch", importer.ImporterId)
+	}
+
 	// Update importer
 	updatedImporterJSON, err := json.Marshal(importer)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal updated importer: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(importer.ImporterId, updatedImporterJSON)
+	err = ctx.GetStub().PutState(key, updatedImporterJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to update importer: %v", err)
 	}
@@ -516,19 +1003,46 @@ func (s *SmartContract) UpdateImporter(ctx contractapi.TransactionContextInterfa
 
 // UpdateExporter updates exporter information
 func (s *SmartContract) UpdateExporter(ctx contractapi.TransactionContextInterface, exporter Exporter) error {
+	if _, _, err := checkAccess(ctx, "UpdateExporter"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeExporter, exporter.ExporterId)
+	if err != nil {
+		return err
+	}
+	exporter.DocType = docTypeExporter
+	if err := validateMeasure(exporter.Volume); err != nil {
+		return err
+	}
+
 	// Check if exporter exists
-	exporterJSON, err := ctx.GetStub().GetState(exporter.ExporterId)
+	exporterJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || exporterJSON == nil {
 		return fmt.Errorf("Exporter with ID %s does not exist", exporter.ExporterId)
 	}
 
+	// Only the owning org may change the record
+	var existingExporter Exporter
+	err = json.Unmarshal(exporterJSON, &existingExporter)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal exporter data: %v", err)
+	}
+	exporter.OwnerMspId, err = checkOwnerOrg(ctx, key, existingExporter.OwnerMspId)
+	if err != nil {
+		return err
+	}
+	if exporter.BatchId != existingExporter.BatchId {
+		return fmt.Errorf("Exporter %s cannot be moved to another batch", exporter.ExporterId)
+	}
+
 	// Update exporter
 	updatedExporterJSON, err := json.Marshal(exporter)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal updated exporter: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(exporter.ExporterId, updatedExporterJSON)
+	err = ctx.GetStub().PutState(key, updatedExporterJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to update exporter: %v", err)
 	}
@@ -538,19 +1052,46 @@ func (s *SmartContract) UpdateExporter(ctx contractapi.TransactionContextInterfa
 
 // UpdateProcessor updates processor information
 func (s *SmartContract) UpdateProcessor(ctx contractapi.TransactionContextInterface, processor Processor) error {
+	if _, _, err := checkAccess(ctx, "UpdateProcessor"); err != nil {
+		return err
+	}
+
+	key, err := entityKey(ctx, docTypeProcessor, processor.ProcessorId)
+	if err != nil {
+		return err
+	}
+	processor.DocType = docTypeProcessor
+	if err := validateMeasure(processor.Volume); err != nil {
+		return err
+	}
+
 	// Check if processor exists
-	processorJSON, err := ctx.GetStub().GetState(processor.ProcessorId)
+	processorJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || processorJSON == nil {
 		return fmt.Errorf("Processor with ID %s does not exist", processor.ProcessorId)
 	}
 
+	// Only the owning org may change the record
+	var existingProcessor Processor
+	err = json.Unmarshal(processorJSON, &existingProcessor)
+	if err != nil {
+		return fmt.Errorf("Failed to unmarshal processor data: %v", err)
+	}
+	processor.OwnerMspId, err = checkOwnerOrg(ctx, key, existingProcessor.OwnerMspId)
+	if err != nil {
+		return err
+	}
+	if processor.BatchId != existingProcessor.BatchId {
+		return fmt.Errorf("Processor %s cannot be moved to another batch", processor.ProcessorId)
+	}
+
 	// Update processor
 	updatedProcessorJSON, err := json.Marshal(processor)
 	if err != nil {
 		return fmt.Errorf("Failed to marshal updated processor: %v", err)
 	}
 
-	err = ctx.GetStub().PutState(processor.ProcessorId, updatedProcessorJSON)
+	err = ctx.GetStub().PutState(key, updatedProcessorJSON)
 	if err != nil {
 		return fmt.Errorf("Failed to update processor: %v", err)
 	}
@@ -561,8 +1102,13 @@ func (s *SmartContract) UpdateProcessor(ctx contractapi.TransactionContextInterf
 
 // ViewUser retrieves the user details by userId
 func (s *SmartContract) ViewUser(ctx contractapi.TransactionContextInterface, userId string) (User, error) {
+	key, err := entityKey(ctx, docTypeUser, userId)
+	if err != nil {
+		return User{}, err
+	}
+
 	// Fetch user details
-	userJSON, err := ctx.GetStub().GetState(userId)
+	userJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || userJSON == nil {
 		return User{}, fmt.Errorf("User with ID %s does not exist", userId)
 	}
@@ -574,11 +1120,6 @@ func (s *SmartContract) ViewUser(ctx contractapi.TransactionContextInterface, us
 		return User{}, fmt.Errorf("Failed to unmarshal user data: %v", err)
 	}
 
-	// 👇 Ensure userBuyProducts is always initialized
-	if user.UserBuyProducts == nil {
-		user.UserBuyProducts = []Buy{}
-	}
-
 	return user, nil
 }
 
@@ -587,8 +1128,13 @@ func (s *SmartContract) ViewUser(ctx contractapi.TransactionContextInterface, us
 
 // ViewBatch retrieves the batch details by batchId
 func (s *SmartContract) ViewBatch(ctx contractapi.TransactionContextInterface, batchId string) (Batch, error) {
+	key, err := entityKey(ctx, docTypeBatch, batchId)
+	if err != nil {
+		return Batch{}, err
+	}
+
 	// Fetch batch details
-	batchJSON, err := ctx.GetStub().GetState(batchId)
+	batchJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || batchJSON == nil {
 		return Batch{}, fmt.Errorf("Batch with ID %s does not exist", batchId)
 	}
@@ -605,8 +1151,13 @@ func (s *SmartContract) ViewBatch(ctx contractapi.TransactionContextInterface, b
 
 // ViewFarmInspector retrieves the farm inspector details by farmInspectionId
 func (s *SmartContract) ViewFarmInspector(ctx contractapi.TransactionContextInterface, farmInspectionId string) (FarmInspector, error) {
+	key, err := entityKey(ctx, docTypeFarmInspector, farmInspectionId)
+	if err != nil {
+		return FarmInspector{}, err
+	}
+
 	// Fetch farm inspector details
-	farmInspectorJSON, err := ctx.GetStub().GetState(farmInspectionId)
+	farmInspectorJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || farmInspectorJSON == nil {
 		return FarmInspector{}, fmt.Errorf("Farm inspector with ID %s does not exist", farmInspectionId)
 	}
@@ -623,8 +1174,13 @@ func (s *SmartContract) ViewFarmInspector(ctx contractapi.TransactionContextInte
 
 // ViewHarvester retrieves the harvester details by harvestId
 func (s *SmartContract) ViewHarvester(ctx contractapi.TransactionContextInterface, harvestId string) (Harvester, error) {
+	key, err := entityKey(ctx, docTypeHarvester, harvestId)
+	if err != nil {
+		return Harvester{}, err
+	}
+
 	// Fetch harvester details
-	harvesterJSON, err := ctx.GetStub().GetState(harvestId)
+	harvesterJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || harvesterJSON == nil {
 		return Harvester{}, fmt.Errorf("Harvester with ID %s does not exist", harvestId)
 	}
@@ -641,8 +1197,13 @@ func (s *SmartContract) ViewHarvester(ctx contractapi.TransactionContextInterfac
 
 // ViewImporter retrieves the importer details by importerId
 func (s *SmartContract) ViewImporter(ctx contractapi.TransactionContextInterface, importerId string) (Importer, error) {
+	key, err := entityKey(ctx, docTypeImporter, importerId)
+	if err != nil {
+		return Importer{}, err
+	}
+
 	// Fetch importer details
-	importerJSON, err := ctx.GetStub().GetState(importerId)
+	importerJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || importerJSON == nil {
 		return Importer{}, fmt.Errorf("Importer with ID %s does not exist", importerId)
 	}
@@ -659,8 +1220,13 @@ func (s *SmartContract) ViewImporter(ctx contractapi.TransactionContextInterface
 
 // ViewExporter retrieves the exporter details by exporterId
 func (s *SmartContract) ViewExporter(ctx contractapi.TransactionContextInterface, exporterId string) (Exporter, error) {
+	key, err := entityKey(ctx, docTypeExporter, exporterId)
+	if err != nil {
+		return Exporter{}, err
+	}
+
 	// Fetch exporter details
-	exporterJSON, err := ctx.GetStub().GetState(exporterId)
+	exporterJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || exporterJSON == nil {
 		return Exporter{}, fmt.Errorf("Exporter with ID %s does not exist", exporterId)
 	}
@@ -677,8 +1243,13 @@ func (s *SmartContract) ViewExporter(ctx contractapi.TransactionContextInterface
 
 // ViewProcessor retrieves the processor details by processorId
 func (s *SmartContract) ViewProcessor(ctx contractapi.TransactionContextInterface, processorId string) (Processor, error) {
+	key, err := entityKey(ctx, docTypeProcessor, processorId)
+	if err != nil {
+		return Processor{}, err
+	}
+
 	// Fetch processor details
-	processorJSON, err := ctx.GetStub().GetState(processorId)
+	processorJSON, err := ctx.GetStub().GetState(key)
 	if err != nil || processorJSON == nil {
 		return Processor{}, fmt.Errorf("Processor with ID %s does not exist", processorId)
 	}
@@ -697,9 +1268,9 @@ func (s *SmartContract) ViewProcessor(ctx contractapi.TransactionContextInterfac
 
 // GetAllBatches retrieves all batch records from the ledger
 func (s *SmartContract) GetAllBatches(ctx contractapi.TransactionContextInterface) ([]Batch, error) {
-	queryIterator, err := ctx.GetStub().GetStateByRange("", "")
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeBatch, []string{})
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get state by range: %v", err)
+		return nil, fmt.Errorf("Failed to get batches: %v", err)
 	}
 	defer queryIterator.Close()
 
@@ -725,9 +1296,9 @@ func (s *SmartContract) GetAllBatches(ctx contractapi.TransactionContextInterfac
 
 // GetAllUsers retrieves all user records from the ledger
 func (s *SmartContract) GetAllUsers(ctx contractapi.TransactionContextInterface) ([]User, error) {
-	queryIterator, err := ctx.GetStub().GetStateByRange("", "")
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeUser, []string{})
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get state by range: %v", err)
+		return nil, fmt.Errorf("Failed to get users: %v", err)
 	}
 	defer queryIterator.Close()
 
@@ -745,23 +1316,158 @@ func (s *SmartContract) GetAllUsers(ctx contractapi.TransactionContextInterface)
 			return nil, fmt.Errorf("Failed to unmarshal user data: %v", err)
 		}
 
-		// 👇 Ensure userBuyProducts is always initialized
-		if user.UserBuyProducts == nil {
-			user.UserBuyProducts = []Buy{}
-		}
-
 		users = append(users, user)
 	}
 
 	return users, nil
 }
 
+// GetAllFarmInspectors retrieves all farm inspector records from the ledger
+func (s *SmartContract) GetAllFarmInspectors(ctx contractapi.TransactionContextInterface) ([]FarmInspector, error) {
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeFarmInspector, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get farm inspectors: %v", err)
+	}
+	defer queryIterator.Close()
+
+	farmInspectors := []FarmInspector{}
+
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var farmInspector FarmInspector
+		err = json.Unmarshal(queryResponse.Value, &farmInspector)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal farm inspector data: %v", err)
+		}
+
+		farmInspectors = append(farmInspectors, farmInspector)
+	}
+
+	return farmInspectors, nil
+}
+
+// GetAllHarvesters retrieves all harvester records from the ledger
+func (s *SmartContract) GetAllHarvesters(ctx contractapi.TransactionContextInterface) ([]Harvester, error) {
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeHarvester, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get harvesters: %v", err)
+	}
+	defer queryIterator.Close()
+
+	harvesters := []Harvester{}
+
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var harvester Harvester
+		err = json.Unmarshal(queryResponse.Value, &harvester)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal harvester data: %v", err)
+		}
+
+		harvesters = append(harvesters, harvester)
+	}
+
+	return harvesters, nil
+}
+
+// GetAllProcessors retrieves all processor records from the ledger
+func (s *SmartContract) GetAllProcessors(ctx contractapi.TransactionContextInterface) ([]Processor, error) {
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeProcessor, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get processors: %v", err)
+	}
+	defer queryIterator.Close()
+
+	processors := []Processor{}
+
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var processor Processor
+		err = json.Unmarshal(queryResponse.Value, &processor)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal processor data: %v", err)
+		}
+
+		processors = append(processors, processor)
+	}
+
+	return processors, nil
+}
+
+// GetAllExporters retrieves all exporter records from the ledger
+func (s *SmartContract) GetAllExporters(ctx contractapi.TransactionContextInterface) ([]Exporter, error) {
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeExporter, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get exporters: %v", err)
+	}
+	defer queryIterator.Close()
+
+	exporters := []Exporter{}
+
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var exporter Exporter
+		err = json.Unmarshal(queryResponse.Value, &exporter)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal exporter data: %v", err)
+		}
+
+		exporters = append(exporters, exporter)
+	}
+
+	return exporters, nil
+}
+
+// GetAllImporters retrieves all importer records from the ledger
+func (s *SmartContract) GetAllImporters(ctx contractapi.TransactionContextInterface) ([]Importer, error) {
+	queryIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeImporter, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get importers: %v", err)
+	}
+	defer queryIterator.Close()
+
+	importers := []Importer{}
+
+	for queryIterator.HasNext() {
+		queryResponse, err := queryIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to iterate over results: %v", err)
+		}
+
+		var importer Importer
+		err = json.Unmarshal(queryResponse.Value, &importer)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal importer data: %v", err)
+		}
+
+		importers = append(importers, importer)
+	}
+
+	return importers, nil
+}
+
 
 
 
 // GetBuyTransactionsByBatchId returns all buy transactions for a specific BatchId
 func (s *SmartContract) GetBuyTransactionsByBatchId(ctx contractapi.TransactionContextInterface, batchId string) ([]*Buy, error) {
-	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("Buy", []string{batchId})
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeBuy, []string{batchId})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get transactions for batchId %s: %v", batchId, err)
 	}
@@ -0,0 +1,353 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// The coffee batch token. It pays for buys and lives in this chaincode's namespace only: the order chaincode
+// (supplychain1.go) runs a token of its own for order escrow, with its own config, supply and balances.
+// The two are separate currencies and tokens cannot move between them.
+//
+// Token accounts are enrollment IDs qualified by the MSP that issued them, an enrollment ID alone is only unique within its CA
+const (
+	tokenConfigKey           = "TokenConfig"
+	tokenSupplyKey           = "TokenSupply"
+	tokenBalanceObjectType   = "TokenBalance"
+	tokenAllowanceObjectType = "TokenAllowance"
+)
+
+// TokenConfig describes the payment token and the org allowed to mint it
+type TokenConfig struct {
+	Name        string `json:"name"`
+	Symbol      string `json:"symbol"`
+	IssuerMspId string `json:"issuerMspId"`
+}
+
+// TokenAccount names the holder of a token balance
+type TokenAccount struct {
+	MspId        string `json:"mspId"`
+	EnrollmentId string `json:"enrollmentId"`
+}
+
+func (a TokenAccount) String() string {
+	return a.EnrollmentId + "@" + a.MspId
+}
+
+// getCallerAccount returns the token account of the submitting client
+func getCallerAccount(ctx contractapi.TransactionContextInterface) (TokenAccount, error) {
+	callerId, _, err := getCallerIdentity(ctx)
+	if err != nil {
+		return TokenAccount{}, err
+	}
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return TokenAccount{}, err
+	}
+	return TokenAccount{MspId: mspId, EnrollmentId: callerId}, nil
+}
+
+// getUserAccount returns the token account of a registered user, who must be bound to an MSP
+func getUserAccount(ctx contractapi.TransactionContextInterface, s *SmartContract, userId string) (TokenAccount, error) {
+	user, err := s.ViewUser(ctx, userId)
+	if err != nil {
+		return TokenAccount{}, err
+	}
+	if user.UserMspId == "" {
+		return TokenAccount{}, fmt.Errorf("User %s is not bound to an MSP and cannot hold tokens", userId)
+	}
+	return TokenAccount{MspId: user.UserMspId, EnrollmentId: user.UserId}, nil
+}
+
+// checkRegisteredAccount refuses accounts no registered user holds, tokens sent there could be claimed by whoever registers first
+func checkRegisteredAccount(ctx contractapi.TransactionContextInterface, s *SmartContract, account TokenAccount) error {
+	holder, err := getUserAccount(ctx, s, account.EnrollmentId)
+	if err != nil {
+		return err
+	}
+	if holder != account {
+		return fmt.Errorf("User %s is bound to %s, not %s", account.EnrollmentId, holder.MspId, account.MspId)
+	}
+	return nil
+}
+
+func getTokenConfig(ctx contractapi.TransactionContextInterface) (TokenConfig, error) {
+	configJSON, err := ctx.GetStub().GetState(tokenConfigKey)
+	if err != nil {
+		return TokenConfig{}, fmt.Errorf("Failed to read token config: %v", err)
+	}
+	if configJSON == nil {
+		return TokenConfig{}, fmt.Errorf("Token has not been initialized")
+	}
+
+	var config TokenConfig
+	err = json.Unmarshal(configJSON, &config)
+	if err != nil {
+		return TokenConfig{}, fmt.Errorf("Failed to unmarshal token config: %v", err)
+	}
+	return config, nil
+}
+
+// readTokenAmount reads an amount stored under key, a missing key holds 0
+func readTokenAmount(ctx contractapi.TransactionContextInterface, key string) (int64, error) {
+	amountBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read %s: %v", key, err)
+	}
+	if amountBytes == nil {
+		return 0, nil
+	}
+	amount, err := strconv.ParseInt(string(amountBytes), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse amount of %s: %v", key, err)
+	}
+	return amount, nil
+}
+
+func writeTokenAmount(ctx contractapi.TransactionContextInterface, key string, amount int64) error {
+	if amount == 0 {
+		err := ctx.GetStub().DelState(key)
+		if err != nil {
+			return fmt.Errorf("Failed to delete %s: %v", key, err)
+		}
+		return nil
+	}
+	err := ctx.GetStub().PutState(key, []byte(strconv.FormatInt(amount, 10)))
+	if err != nil {
+		return fmt.Errorf("Failed to save %s: %v", key, err)
+	}
+	return nil
+}
+
+func tokenBalanceKey(ctx contractapi.TransactionContextInterface, account TokenAccount) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(tokenBalanceObjectType, []string{account.MspId, account.EnrollmentId})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create balance key for %s: %v", account, err)
+	}
+	return key, nil
+}
+
+func tokenAllowanceKey(ctx contractapi.TransactionContextInterface, owner TokenAccount, spender TokenAccount) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(tokenAllowanceObjectType, []string{owner.MspId, owner.EnrollmentId, spender.MspId, spender.EnrollmentId})
+	if err != nil {
+		return "", fmt.Errorf("Failed to create allowance key for %s and %s: %v", owner, spender, err)
+	}
+	return key, nil
+}
+
+// addTokens changes the balance of an account by delta, refusing overdrafts and overflow
+func addTokens(ctx contractapi.TransactionContextInterface, account TokenAccount, delta int64) error {
+	if account.MspId == "" || account.EnrollmentId == "" {
+		return fmt.Errorf("Token account needs an MSP and an enrollment ID")
+	}
+	key, err := tokenBalanceKey(ctx, account)
+	if err != nil {
+		return err
+	}
+	balance, err := readTokenAmount(ctx, key)
+	if err != nil {
+		return err
+	}
+	if delta < 0 && balance < -delta {
+		return fmt.Errorf("Account %s has %d tokens, %d are needed", account, balance, -delta)
+	}
+	if delta > 0 && balance > math.MaxInt64-delta {
+		return fmt.Errorf("Balance of account %s would overflow", account)
+	}
+	return writeTokenAmount(ctx, key, balance+delta)
+}
+
+// transferTokens moves amount from one account to another
+func transferTokens(ctx contractapi.TransactionContextInterface, from TokenAccount, to TokenAccount, amount int64) error {
+	if amount <= 0 {
+		return fmt.Errorf("Transfer amount must be positive")
+	}
+	if from == to {
+		return fmt.Errorf("Cannot transfer tokens to the same account")
+	}
+	err := addTokens(ctx, from, -amount)
+	if err != nil {
+		return err
+	}
+	return addTokens(ctx, to, amount)
+}
+
+// spendAllowance moves amount from owner to recipient out of what owner allowed spender to use
+func spendAllowance(ctx contractapi.TransactionContextInterface, owner TokenAccount, spender TokenAccount, recipient TokenAccount, amount int64) error {
+	key, err := tokenAllowanceKey(ctx, owner, spender)
+	if err != nil {
+		return err
+	}
+	allowance, err := readTokenAmount(ctx, key)
+	if err != nil {
+		return err
+	}
+	if allowance < amount {
+		return fmt.Errorf("%s allowed %s to spend %d tokens, %d are needed", owner, spender, allowance, amount)
+	}
+	err = transferTokens(ctx, owner, recipient, amount)
+	if err != nil {
+		return err
+	}
+	return writeTokenAmount(ctx, key, allowance-amount)
+}
+
+// InitializeToken names the payment token and designates the org whose clients may mint it, once
+func (s *SmartContract) InitializeToken(ctx contractapi.TransactionContextInterface, config TokenConfig) error {
+	if err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	if config.Name == "" || config.Symbol == "" {
+		return fmt.Errorf("Token name and symbol are required")
+	}
+	if config.IssuerMspId == "" {
+		return fmt.Errorf("Token issuer MSP is required")
+	}
+
+	// The issuer decides who may mint, it is set once and no admin can change it afterwards
+	existing, err := ctx.GetStub().GetState(tokenConfigKey)
+	if err != nil {
+		return fmt.Errorf("Failed to read token config: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("Token has already been initialized")
+	}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal token config: %v", err)
+	}
+	err = ctx.GetStub().PutState(tokenConfigKey, configJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to save token config: %v", err)
+	}
+	// Rewriting the config, even from an upgraded chaincode, needs the issuer org's endorsement
+	return setOrgEndorsementPolicy(ctx, tokenConfigKey, config.IssuerMspId)
+}
+
+// GetTokenConfig returns the payment token's name, symbol and issuer
+func (s *SmartContract) GetTokenConfig(ctx contractapi.TransactionContextInterface) (TokenConfig, error) {
+	return getTokenConfig(ctx)
+}
+
+// Mint creates new tokens in a registered user's account, only clients of the issuer org may mint
+func (s *SmartContract) Mint(ctx contractapi.TransactionContextInterface, recipient TokenAccount, amount int64) error {
+	config, err := getTokenConfig(ctx)
+	if err != nil {
+		return err
+	}
+	mspId, err := getClientMspId(ctx)
+	if err != nil {
+		return err
+	}
+	if mspId != config.IssuerMspId {
+		return fmt.Errorf("Only clients of %s may mint %s", config.IssuerMspId, config.Symbol)
+	}
+	if amount <= 0 {
+		return fmt.Errorf("Mint amount must be positive")
+	}
+	err = checkRegisteredAccount(ctx, s, recipient)
+	if err != nil {
+		return err
+	}
+
+	supply, err := readTokenAmount(ctx, tokenSupplyKey)
+	if err != nil {
+		return err
+	}
+	if supply > math.MaxInt64-amount {
+		return fmt.Errorf("Total supply would overflow")
+	}
+	err = addTokens(ctx, recipient, amount)
+	if err != nil {
+		return err
+	}
+	return writeTokenAmount(ctx, tokenSupplyKey, supply+amount)
+}
+
+// Transfer moves tokens from the caller's account to the account of a registered recipient
+func (s *SmartContract) Transfer(ctx contractapi.TransactionContextInterface, recipient TokenAccount, amount int64) error {
+	caller, err := getCallerAccount(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkRegisteredAccount(ctx, s, recipient)
+	if err != nil {
+		return err
+	}
+	return transferTokens(ctx, caller, recipient, amount)
+}
+
+// Approve allows spender to move up to amount of the caller's tokens, replacing any earlier allowance
+func (s *SmartContract) Approve(ctx contractapi.TransactionContextInterface, spender TokenAccount, amount int64) error {
+	caller, err := getCallerAccount(ctx)
+	if err != nil {
+		return err
+	}
+	if amount < 0 {
+		return fmt.Errorf("Allowance cannot be negative")
+	}
+	if spender.MspId == "" || spender.EnrollmentId == "" || spender == caller {
+		return fmt.Errorf("Spender must be another account")
+	}
+
+	key, err := tokenAllowanceKey(ctx, caller, spender)
+	if err != nil {
+		return err
+	}
+	return writeTokenAmount(ctx, key, amount)
+}
+
+// TransferFrom moves tokens from owner to a registered recipient out of the allowance owner gave the caller
+func (s *SmartContract) TransferFrom(ctx contractapi.TransactionContextInterface, owner TokenAccount, recipient TokenAccount, amount int64) error {
+	caller, err := getCallerAccount(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkRegisteredAccount(ctx, s, recipient)
+	if err != nil {
+		return err
+	}
+	return spendAllowance(ctx, owner, caller, recipient, amount)
+}
+
+// BalanceOf returns the tokens held by an account
+func (s *SmartContract) BalanceOf(ctx contractapi.TransactionContextInterface, account TokenAccount) (int64, error) {
+	key, err := tokenBalanceKey(ctx, account)
+	if err != nil {
+		return 0, err
+	}
+	return readTokenAmount(ctx, key)
+}
+
+// ClientAccountBalance returns the tokens held by the caller
+func (s *SmartContract) ClientAccountBalance(ctx contractapi.TransactionContextInterface) (int64, error) {
+	caller, err := getCallerAccount(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return s.BalanceOf(ctx, caller)
+}
+
+// ClientAccountID returns the account the caller's tokens are held in
+func (s *SmartContract) ClientAccountID(ctx contractapi.TransactionContextInterface) (TokenAccount, error) {
+	return getCallerAccount(ctx)
+}
+
+// Allowance returns how many of owner's tokens spender may still move
+func (s *SmartContract) Allowance(ctx contractapi.TransactionContextInterface, owner TokenAccount, spender TokenAccount) (int64, error) {
+	key, err := tokenAllowanceKey(ctx, owner, spender)
+	if err != nil {
+		return 0, err
+	}
+	return readTokenAmount(ctx, key)
+}
+
+// TotalSupply returns the number of tokens minted
+func (s *SmartContract) TotalSupply(ctx contractapi.TransactionContextInterface) (int64, error) {
+	return readTokenAmount(ctx, tokenSupplyKey)
+}
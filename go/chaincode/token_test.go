@@ -0,0 +1,126 @@
+package chaincode
+
+import "testing"
+
+func TestInitializeTokenOnlyOnce(t *testing.T) {
+	l := newMockLedger(t)
+	s := new(SmartContract)
+	config := TokenConfig{Name: "Coffee", Symbol: "CFE", IssuerMspId: "Org1MSP"}
+
+	if err := s.InitializeToken(l.as("Org1MSP", "admin", RoleAdmin), config); err != nil {
+		t.Fatal(err)
+	}
+	config.IssuerMspId = "Org2MSP"
+	if err := s.InitializeToken(l.as("Org2MSP", "admin", RoleAdmin), config); err == nil {
+		t.Fatal("a second InitializeToken replaced the issuer")
+	}
+}
+
+func TestMintOnlyByIssuerToRegisteredAccount(t *testing.T) {
+	l := newMockLedger(t)
+	s := new(SmartContract)
+	alice := l.addUser("Org2MSP", "alice", RoleAdmin)
+	l.fund(0)
+
+	if err := s.Mint(l.as("Org2MSP", "alice", RoleAdmin), alice, 10); err == nil {
+		t.Fatal("a client outside the issuer org minted tokens")
+	}
+	if err := s.Mint(l.as("Org1MSP", "issuer", RoleAdmin), TokenAccount{MspId: "Org1MSP", EnrollmentId: "alice"}, 10); err == nil {
+		t.Fatal("tokens were minted to alice under another MSP")
+	}
+	if err := s.Mint(l.as("Org1MSP", "issuer", RoleAdmin), alice, 10); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.balance(alice); got != 10 {
+		t.Fatalf("alice holds %d tokens, want 10", got)
+	}
+}
+
+func TestTransferRefusesOverdraft(t *testing.T) {
+	l := newMockLedger(t)
+	s := new(SmartContract)
+	alice := l.addUser("Org1MSP", "alice", RoleAdmin)
+	bob := l.addUser("Org2MSP", "bob", RoleAdmin)
+	l.fund(100, alice)
+
+	if err := s.Transfer(l.as("Org1MSP", "alice", ""), bob, 101); err == nil {
+		t.Fatal("alice transferred more tokens than alice holds")
+	}
+	if err := s.Transfer(l.as("Org1MSP", "alice", ""), bob, 0); err == nil {
+		t.Fatal("a transfer of 0 tokens was accepted")
+	}
+	if err := s.Transfer(l.as("Org1MSP", "alice", ""), bob, 60); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.balance(alice); got != 40 {
+		t.Fatalf("alice holds %d tokens, want 40", got)
+	}
+	if got := l.balance(bob); got != 60 {
+		t.Fatalf("bob holds %d tokens, want 60", got)
+	}
+}
+
+func TestTransferFromSpendsAllowance(t *testing.T) {
+	l := newMockLedger(t)
+	s := new(SmartContract)
+	alice := l.addUser("Org1MSP", "alice", RoleAdmin)
+	bob := l.addUser("Org2MSP", "bob", RoleAdmin)
+	carol := l.addUser("Org2MSP", "carol", RoleAdmin)
+	l.fund(100, alice)
+
+	if err := s.TransferFrom(l.as("Org2MSP", "bob", ""), alice, carol, 10); err == nil {
+		t.Fatal("bob spent alice's tokens without an allowance")
+	}
+	if err := s.Approve(l.as("Org1MSP", "alice", ""), bob, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TransferFrom(l.as("Org2MSP", "bob", ""), alice, carol, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TransferFrom(l.as("Org2MSP", "bob", ""), alice, carol, 21); err == nil {
+		t.Fatal("bob spent more than the rest of the allowance")
+	}
+	// the allowance is keyed by MSP too, the same enrollment ID elsewhere has none
+	if err := s.TransferFrom(l.as("Org1MSP", "bob", ""), alice, carol, 1); err == nil {
+		t.Fatal("bob of another MSP spent alice's allowance")
+	}
+
+	allowance, err := s.Allowance(l.as("Org1MSP", "alice", ""), alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowance != 20 {
+		t.Fatalf("bob may still spend %d tokens, want 20", allowance)
+	}
+	if got := l.balance(alice); got != 70 {
+		t.Fatalf("alice holds %d tokens, want 70", got)
+	}
+	if got := l.balance(carol); got != 30 {
+		t.Fatalf("carol holds %d tokens, want 30", got)
+	}
+}
+
+func TestTransferOnlyToRegisteredAccounts(t *testing.T) {
+	l := newMockLedger(t)
+	s := new(SmartContract)
+	alice := l.addUser("Org1MSP", "alice", RoleAdmin)
+	bob := l.addUser("Org2MSP", "bob", RoleAdmin)
+	l.fund(100, alice)
+	if err := s.Approve(l.as("Org1MSP", "alice", ""), bob, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	unregistered := TokenAccount{MspId: "Org2MSP", EnrollmentId: "mallory"}
+	misbound := TokenAccount{MspId: "Org3MSP", EnrollmentId: "bob"}
+	for _, recipient := range []TokenAccount{unregistered, misbound} {
+		if err := s.Transfer(l.as("Org1MSP", "alice", ""), recipient, 10); err == nil {
+			t.Fatalf("alice transferred tokens to %s, which no registered user holds", recipient)
+		}
+		if err := s.TransferFrom(l.as("Org2MSP", "bob", ""), alice, recipient, 10); err == nil {
+			t.Fatalf("bob spent alice's allowance on %s, which no registered user holds", recipient)
+		}
+	}
+	if got := l.balance(alice); got != 100 {
+		t.Fatalf("alice holds %d tokens, want 100", got)
+	}
+}
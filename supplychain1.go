@@ -1,13 +1,20 @@
 package chaincode
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/peer"
 )
 
 type SmartContract struct {
@@ -23,7 +30,6 @@ type User struct {
 	UserCode    string 			`json:"userCode"`
 	PhoneNumber string 			`json:"phoneNumber"`
 	Email       string 			`json:"email"`
-	Password    string 			`json:"password"`
 	FullName    string 			`json:"fullName"`
 	UserName    string 			`json:"userName"`
 	Address     string 			`json:"address"`
@@ -33,6 +39,8 @@ type User struct {
 	Status      string 			`json:"status"`
 	Signature   string 			`json:"signature"`
 	Cart		[]ProductIdItem `json:"cart" metadata:",optional"`
+	MSPID       string 			`json:"mspId" metadata:",optional"`
+	EnrollmentID string 		`json:"enrollmentId" metadata:",optional"`
 }
 
 type Actor struct {
@@ -43,6 +51,7 @@ type Actor struct {
 	Address     string `json:"address"`
 	Avatar     	string `json:"avatar"`
 	Role        string `json:"role"`
+	MSPID       string `json:"mspId" metadata:",optional"`
 }
 
 type ProductDate struct {
@@ -65,6 +74,7 @@ type Product struct {
 	Status         string         `json:"status"`
 	Description    string         `json:"description"`
 	CertificateUrl string         `json:"certificateUrl"`
+	CertificateNo  string         `json:"certificateNo" metadata:",optional"`
 	QRCode		   string		  `json:"qrCode"`
 }
 
@@ -93,6 +103,7 @@ type ProductPayload struct {
 	Unit           string        `json:"unit"`
 	Description    string        `json:"description"`
 	CertificateUrl string        `json:"certificateUrl"`
+	CertificateNo  string        `json:"certificateNo"`
 }
 
 type ProductHistory struct {
@@ -122,8 +133,11 @@ type ProductItem struct {
 }
 
 type ProductCommercialItem struct {
-	Product  ProductCommercial 	`json:"product"`
-	Quantity string  			`json:"quantity"`
+	Product  			ProductCommercial 	`json:"product"`
+	Quantity 			string  			`json:"quantity"`
+	ShippedQuantity 	string 				`json:"shippedQuantity" metadata:",optional"` // quantity dispatched in shipments
+	DeliveredQuantity 	string 				`json:"deliveredQuantity" metadata:",optional"` // quantity of delivered shipments
+	ReturnedQuantity 	string 				`json:"returnedQuantity" metadata:",optional"` // quantity held by open or completed returns
 }
 
 type ProductIdItem struct {
@@ -133,6 +147,7 @@ type ProductIdItem struct {
 
 type ProductIdQRCodeItem struct {
 	ProductId  	string 	`json:"productId"`
+	ProductCode string 	`json:"productCode" metadata:",optional"` // ordered by code when ProductId is empty, filled first-expired-first-out
 	Quantity 	string  `json:"quantity"`
 	QRCode 		string  `json:"qrCode"`
 }
@@ -153,7 +168,9 @@ type DeliveryStatusCreateOrder struct {
 	Address			string    	`json:"address"`
 }
 
+// Order carries a docType, other records such as shipments, returns and escrows have an orderId and a status too
 type Order struct {
+	DocType 		string 					`json:"docType" metadata:",optional"`
 	OrderId 		string      	 		`json:"orderId"`
 	ProductItemList []ProductCommercialItem	`json:"productItemList" metadata:",optional"`
 	DeliveryStatuses[]DeliveryStatus 		`json:"deliveryStatuses" metadata:",optional"`
@@ -166,6 +183,7 @@ type Order struct {
 	Retailer     	Actor 			 		`json:"retailer"`
 	Manufacturer  	Actor 			 		`json:"manufacturer"`
 	Distributor  	Actor 			 		`json:"distributor"`
+	PaidAmount 		int64 					`json:"paidAmount" metadata:",optional"` // tokens paid out for delivered items
 }
 
 type OrderForCreate struct {
@@ -175,12 +193,95 @@ type OrderForCreate struct {
 	QRCode		   			string		 				`json:"qrCode"`
 }
 
+type OrderItemAmendment struct {
+	ProductCommercialId string `json:"productCommercialId"`
+	Quantity 			string `json:"quantity"`
+}
+
+type OrderForAmend struct {
+	OrderId 		string      	 			`json:"orderId"`
+	Items 			[]OrderItemAmendment 		`json:"items" metadata:",optional"`
+	DeliveryStatus 	DeliveryStatusCreateOrder 	`json:"deliveryStatus"`
+}
+
+type Shipment struct {
+	ShipmentId 			string 					`json:"shipmentId"`
+	OrderId 			string 					`json:"orderId"`
+	Items 				[]OrderItemAmendment 	`json:"items" metadata:",optional"`
+	DeliveryStatuses 	[]DeliveryStatus 		`json:"deliveryStatuses" metadata:",optional"`
+	Signatures 			[]string 				`json:"signatures" metadata:",optional"`
+	Status 				string 					`json:"status"`
+	Distributor 		Actor 					`json:"distributor"`
+	CreateDate 			string 					`json:"createDate"`
+	FinishDate 			string 					`json:"finishDate"`
+	PaymentDue 			int64 					`json:"paymentDue" metadata:",optional"` // tokens released when the retailer confirms receipt
+	ReceiveDate 		string 					`json:"receiveDate" metadata:",optional"`
+}
+
+type ShipmentForCreate struct {
+	OrderId 		string 						`json:"orderId"`
+	Items 			[]OrderItemAmendment 		`json:"items" metadata:",optional"`
+	DeliveryStatus 	DeliveryStatusCreateOrder 	`json:"deliveryStatus"`
+	Signature 		string 						`json:"signature"`
+}
+
+type ShipmentForUpdate struct {
+	ShipmentId 		string 						`json:"shipmentId"`
+	DeliveryStatus 	DeliveryStatusCreateOrder 	`json:"deliveryStatus"`
+	Signature 		string 						`json:"signature"`
+}
+
+type ReturnRequest struct {
+	ReturnId 		string 					`json:"returnId"`
+	OrderId 		string 					`json:"orderId"`
+	Items 			[]OrderItemAmendment 	`json:"items" metadata:",optional"`
+	Reason 			string 					`json:"reason"`
+	DisputeReason 	string 					`json:"disputeReason"`
+	Statuses 		[]DeliveryStatus 		`json:"statuses" metadata:",optional"`
+	Status 			string 					`json:"status"`
+	CreateDate 		string 					`json:"createDate"`
+	UpdateDate 		string 					`json:"updateDate"`
+	Retailer 		Actor 					`json:"retailer"`
+	Manufacturer 	Actor 					`json:"manufacturer"`
+	Distributor 	Actor 					`json:"distributor"`
+}
+
+type ReturnForCreate struct {
+	OrderId 	string 					`json:"orderId"`
+	Items 		[]OrderItemAmendment 	`json:"items" metadata:",optional"`
+	Reason 		string 					`json:"reason"`
+}
+
+// OrderConfig holds the settings of the order flow
+type OrderConfig struct {
+	PendingOrderTTLHours int `json:"pendingOrderTtlHours"` // PENDING orders older than this are closed by ExpireStaleOrders
+	DistributorFeeBps 	 int `json:"distributorFeeBps" metadata:",optional"` // basis points of each escrow release paid to the distributor
+}
+
 type OrderForUpdateFinish struct {
 	OrderId 		string      	 			`json:"orderId"`
 	DeliveryStatus 	DeliveryStatusCreateOrder 	`json:"deliveryStatus"`
 	Signature 		string 						`json:"signature"`
 }
 
+type ProductPage struct {
+	Records  		[]*Product 	`json:"records"`
+	Bookmark 		string 		`json:"bookmark"`
+	FetchedCount 	int32 		`json:"fetchedCount"`
+}
+
+type ProductCommercialPage struct {
+	Records  		[]*ProductCommercial 	`json:"records"`
+	Bookmark 		string 					`json:"bookmark"`
+	FetchedCount 	int32 					`json:"fetchedCount"`
+}
+
+type OrderPage struct {
+	Records  		[]*Order 	`json:"records"`
+	Bookmark 		string 		`json:"bookmark"`
+	FetchedCount 	int32 		`json:"fetchedCount"`
+}
+
 func parseUserToActor(user User) Actor {
 	actor := Actor{
 		UserId:user.UserId,
@@ -190,10 +291,177 @@ func parseUserToActor(user User) Actor {
 		Address:user.Address,
 		Avatar:user.Avatar,
 		Role:user.Role,
+		MSPID:user.MSPID,
 	}
 	return actor
 }
 
+// isActor tells whether actor is the given user. Actors recorded before they carried an MSP ID match on the user ID alone.
+func isActor(actor Actor, user User) bool {
+	if actor.UserId == "" || actor.UserId != user.UserId {
+		return false
+	}
+	return actor.MSPID == "" || actor.MSPID == user.MSPID
+}
+
+const userIdentityIndex = "UserIdentity"
+
+func userIdentityKey(ctx contractapi.TransactionContextInterface, mspID string, enrollmentID string) (string, error) {
+	return ctx.GetStub().CreateCompositeKey(userIdentityIndex, []string{mspID, enrollmentID})
+}
+
+// getClientIdentity returns the MSP ID, enrollment ID and role attribute of the submitting client certificate
+func getClientIdentity(ctx contractapi.TransactionContextInterface) (string, string, string, error) {
+	identity := ctx.GetClientIdentity()
+
+	mspID, err := identity.GetMSPID()
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to get client MSP ID: %s", err.Error())
+	}
+
+	enrollmentID, found, err := identity.GetAttributeValue("hf.EnrollmentID")
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to read enrollment ID attribute: %s", err.Error())
+	}
+	if !found {
+		// certificates not issued by a Fabric CA carry no enrollment ID, fall back to the X.509 subject
+		enrollmentID, err = identity.GetID()
+		if err != nil {
+			return "", "", "", fmt.Errorf("failed to get client ID: %s", err.Error())
+		}
+	}
+
+	role, _, err := identity.GetAttributeValue("role")
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to read role attribute: %s", err.Error())
+	}
+
+	return mspID, enrollmentID, role, nil
+}
+
+// getSubmittingUser resolves the registered user bound to the submitting client certificate
+func getSubmittingUser(ctx contractapi.TransactionContextInterface) (User, error) {
+	mspID, enrollmentID, role, err := getClientIdentity(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	key, err := userIdentityKey(ctx, mspID, enrollmentID)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to create user key: %s", err.Error())
+	}
+
+	userBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if userBytes == nil {
+		return User{}, fmt.Errorf("identity %s of %s is not registered", enrollmentID, mspID)
+	}
+
+	var user User
+	_ = json.Unmarshal(userBytes, &user)
+
+	// the certificate attribute is authoritative, a stale ledger role must not grant access
+	if role != "" && role != user.Role {
+		return User{}, fmt.Errorf("certificate role %s does not match registered role %s", role, user.Role)
+	}
+
+	return user, nil
+}
+
+// RegisterUser binds a user profile to the submitting client certificate
+func (s *SmartContract) RegisterUser(ctx contractapi.TransactionContextInterface, userObj User) (*User, error) {
+	mspID, enrollmentID, role, err := getClientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role == "" {
+		return nil, fmt.Errorf("client certificate has no role attribute")
+	}
+
+	key, err := userIdentityKey(ctx, mspID, enrollmentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user key: %s", err.Error())
+	}
+
+	userBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if userBytes != nil {
+		return nil, fmt.Errorf("identity %s of %s is already registered", enrollmentID, mspID)
+	}
+
+	user := userObj
+	user.UserId = enrollmentID
+	user.Role = role
+	user.MSPID = mspID
+	user.EnrollmentID = enrollmentID
+
+	userAsBytes, _ := json.Marshal(user)
+	err = ctx.GetStub().PutState(key, userAsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register user: %s", err.Error())
+	}
+
+	return &user, nil
+}
+
+// ScrubUserPasswords rewrites registered users without the plaintext password older records carried.
+// Users authenticate with their certificate, so the password is dropped rather than kept anywhere.
+func (s *SmartContract) ScrubUserPasswords(ctx contractapi.TransactionContextInterface) (int, error) {
+	_, _, role, err := getClientIdentity(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if role != "admin" {
+		return 0, fmt.Errorf("user must be an admin")
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(userIdentityIndex, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	scrubbed := 0
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		var legacy map[string]interface{}
+		_ = json.Unmarshal(response.Value, &legacy)
+		if _, ok := legacy["password"]; !ok {
+			continue
+		}
+
+		// User has no password field, so re-marshalling drops it
+		var user User
+		_ = json.Unmarshal(response.Value, &user)
+		userAsBytes, _ := json.Marshal(user)
+		err = ctx.GetStub().PutState(response.Key, userAsBytes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update user: %s", err.Error())
+		}
+		scrubbed++
+	}
+
+	return scrubbed, nil
+}
+
+// GetCurrentUser returns the registered user of the submitting client certificate
+func (s *SmartContract) GetCurrentUser(ctx contractapi.TransactionContextInterface) (*User, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
 // Initialize chaincode
 func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface) error {
 	error := initCounter(ctx)
@@ -224,7 +492,7 @@ func initCounter(ctx contractapi.TransactionContextInterface) error {
 		}
 	}
 
-	OrderCounterBytes, _ := ctx.GetStub().GetState("OrdertCounterNO")
+	OrderCounterBytes, _ := ctx.GetStub().GetState("OrderCounterNO")
 	if OrderCounterBytes == nil {
 		var OrderCounter = CounterNO{Counter: 0}
 		OrderCounterBytes, _ := json.Marshal(OrderCounter)
@@ -257,47 +525,290 @@ func parseProductToProductCommercial(product Product) ProductCommercial {
 	return productCommercial
 }
 
-func (s *SmartContract) GetCounterOfType(ctx contractapi.TransactionContextInterface, assetType string) (int, error) {
-	counterAsBytes, _ := ctx.GetStub().GetState(assetType)
-	counterAsset := CounterNO{}
-	json.Unmarshal(counterAsBytes, &counterAsset)
-	return counterAsset.Counter, nil
+// productTransition is one step of the product lifecycle
+// CULTIVATED -> HARVESTED -> IMPORTED -> MANUFACTURED -> EXPORTED -> DISTRIBUTING -> RETAILING -> SOLD
+// IssueRecall moves a product to RECALLED from any status, recalled goods can only be returned
+type productTransition struct {
+	From      []string // statuses the product may move from
+	Roles     []string // roles allowed to submit the step
+	Custodian string   // status whose actor must be the submitting user, "" if any user with Role may act
 }
 
-func getCounter(ctx contractapi.TransactionContextInterface, assetType string) (int, error) {
-	counterAsBytes, _ := ctx.GetStub().GetState(assetType)
-	counterAsset := CounterNO{}
-	json.Unmarshal(counterAsBytes, &counterAsset)
-	return counterAsset.Counter, nil
+var productTransitions = map[string]productTransition{
+	"HARVESTED":    {From: []string{"CULTIVATED"}, Roles: []string{"supplier"}, Custodian: "CULTIVATED"},
+	"IMPORTED":     {From: []string{"HARVESTED"}, Roles: []string{"manufacturer"}},
+	"MANUFACTURED": {From: []string{"IMPORTED"}, Roles: []string{"manufacturer"}, Custodian: "IMPORTED"},
+	"EXPORTED":     {From: []string{"MANUFACTURED"}, Roles: []string{"manufacturer"}, Custodian: "MANUFACTURED"},
+	"DISTRIBUTING": {From: []string{"EXPORTED"}, Roles: []string{"distributor"}},
+	"RETAILING":    {From: []string{"DISTRIBUTING"}, Roles: []string{"retailer", "distributor"}}, // FinishOrder delivers to the retailer
+	"SOLD":         {From: []string{"RETAILING"}, Roles: []string{"retailer"}, Custodian: "RETAILING"},
+	"RETURNED":     {From: []string{"DISTRIBUTING", "RETAILING", "RETURNED", "RECALLED"}, Roles: []string{"distributor"}}, // picked up for a return, possibly in parts
 }
 
-func incrementCounter(ctx contractapi.TransactionContextInterface, assetType string) (int, error) {
-	counterAsBytes, _ := ctx.GetStub().GetState(assetType)
-	counterAsset := CounterNO{}
+// checkProductTransition returns an error unless user may move the product from its current status to the given one
+func checkProductTransition(user User, productId string, current string, dates []ProductDate, status string) error {
+	transition, ok := productTransitions[status]
+	if !ok {
+		return fmt.Errorf("unknown product status %s", status)
+	}
 
-	json.Unmarshal(counterAsBytes, &counterAsset)
-	counterAsset.Counter++
-	counterAsBytes, _ = json.Marshal(counterAsset)
+	allowed := false
+	for _, role := range transition.Roles {
+		if user.Role == role {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("user must be a %s", strings.Join(transition.Roles, " or "))
+	}
+
+	allowed = false
+	for _, from := range transition.From {
+		if current == from {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("product %s is %s and cannot become %s, it must be %v", productId, current, status, transition.From)
+	}
+
+	if transition.Custodian == "" {
+		return nil
+	}
+	// the latest entry counts, a step may have been repeated
+	for i := len(dates) - 1; i >= 0; i-- {
+		if dates[i].Status == transition.Custodian {
+			if !isActor(dates[i].Actor, user) {
+				return fmt.Errorf("permission denied: product %s was %s by %s", productId, transition.Custodian, dates[i].Actor.UserId)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("product %s has no %s record", productId, transition.Custodian)
+}
+
+const (
+	productObjectType = "Product"
+	productCommercialObjectType = "ProductCommercial"
+	orderObjectType = "Order"
+	returnObjectType = "Return"
+	shipmentObjectType = "Shipment"
+	inventoryObjectType = "Inventory"
+)
+
+// productKey, productCommercialKey and orderKey return the composite ledger key of a record.
+// Composite keys keep each type in its own namespace so partial key scans return every record, whatever its ID.
+func productKey(ctx contractapi.TransactionContextInterface, productId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(productObjectType, []string{productId})
+	return key
+}
+
+func productCommercialKey(ctx contractapi.TransactionContextInterface, productCommercialId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(productCommercialObjectType, []string{productCommercialId})
+	return key
+}
+
+func orderKey(ctx contractapi.TransactionContextInterface, orderId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(orderObjectType, []string{orderId})
+	return key
+}
+
+func returnKey(ctx contractapi.TransactionContextInterface, returnId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(returnObjectType, []string{returnId})
+	return key
+}
+
+const idempotencyTransientKey = "idempotencyKey"
 
-	err := ctx.GetStub().PutState(assetType, counterAsBytes)
+const (
+	sequencePendingIndex = "SequencePending"
+	sequenceNumberIndex = "SequenceNo"
+)
+
+// newAssetId derives the ID of the index-th record of the given type created by this transaction.
+// IDs come from the transaction ID, or from the caller's identity and the idempotency key passed in the
+// transient map, so no shared counter is read and parallel transactions never conflict.
+func newAssetId(ctx contractapi.TransactionContextInterface, prefix string, index int) (string, error) {
+	seed := ctx.GetStub().GetTxID()
+
+	transientMap, err := ctx.GetStub().GetTransient()
 	if err != nil {
-		return -1, fmt.Errorf("failed to Increment Counter: %s", err.Error())
+		return "", fmt.Errorf("failed to read transient data: %s", err.Error())
 	}
-	return counterAsset.Counter, nil
+	if idempotencyKey := transientMap[idempotencyTransientKey]; len(idempotencyKey) > 0 {
+		mspID, enrollmentID, _, err := getClientIdentity(ctx)
+		if err != nil {
+			return "", err
+		}
+		seed = mspID + ":" + enrollmentID + ":" + string(idempotencyKey)
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d", seed, prefix, index)))
+	return prefix + hex.EncodeToString(sum[:8]), nil
 }
 
-func incrementWithIntCounter(ctx contractapi.TransactionContextInterface, assetType string, i int) (int, error) {
-	counterAsBytes, _ := ctx.GetStub().GetState(assetType)
-	counterAsset := CounterNO{}
+// enqueueSequenceNumber queues a new record for AssignSequenceNumbers. The queue key is unique to the
+// record, so creating it never conflicts with other transactions.
+func enqueueSequenceNumber(ctx contractapi.TransactionContextInterface, objectType string, id string) error {
+	txTime, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("transaction timeStamp error")
+	}
 
-	json.Unmarshal(counterAsBytes, &counterAsset)
-	counterAsset.Counter = i
-	counterAsBytes, _ = json.Marshal(counterAsset)
+	key := sequencePendingKey(ctx, objectType, time.Unix(txTime.Seconds, int64(txTime.Nanos)), id)
+	return ctx.GetStub().PutState(key, []byte(id))
+}
+
+func sequencePendingKey(ctx contractapi.TransactionContextInterface, objectType string, createdAt time.Time, id string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(sequencePendingIndex, []string{objectType, fmt.Sprintf("%020d", createdAt.UnixNano()), id})
+	return key
+}
+
+// dequeueSequenceNumber takes a record that was removed again off the AssignSequenceNumbers queue, or drops the number
+// it was given already. createdAt is the time of the transaction that enqueued it.
+func dequeueSequenceNumber(ctx contractapi.TransactionContextInterface, objectType string, createdAt time.Time, id string) error {
+	err := ctx.GetStub().DelState(sequencePendingKey(ctx, objectType, createdAt, id))
+	if err != nil {
+		return fmt.Errorf("failed to dequeue %s: %s", id, err.Error())
+	}
+	sequenceKey, err := ctx.GetStub().CreateCompositeKey(sequenceNumberIndex, []string{objectType, id})
+	if err != nil {
+		return fmt.Errorf("failed to create sequence key: %s", err.Error())
+	}
+	err = ctx.GetStub().DelState(sequenceKey)
+	if err != nil {
+		return fmt.Errorf("failed to remove sequence number of %s: %s", id, err.Error())
+	}
+	return nil
+}
+
+// AssignSequenceNumbers gives up to limit queued records of a type (Product, ProductCommercial or Order) their
+// human-readable sequence number, in creation order. It is the only writer of the type's counter, so record
+// creation never waits on it; run it periodically. It returns the number of records assigned.
+func (s *SmartContract) AssignSequenceNumbers(ctx contractapi.TransactionContextInterface, objectType string, limit int) (int, error) {
+	if _, err := getSubmittingUser(ctx); err != nil {
+		return 0, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(sequencePendingIndex, []string{objectType})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	counterKey := objectType + "CounterNO"
+	counter, _ := getCounter(ctx, counterKey)
+
+	assigned := 0
+	for resultsIterator.HasNext() && assigned < limit {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		counter++
+		id := string(response.Value)
+		sequenceAsBytes, _ := json.Marshal(CounterNO{Counter: counter})
+		sequenceKey, _ := ctx.GetStub().CreateCompositeKey(sequenceNumberIndex, []string{objectType, id})
+		err = ctx.GetStub().PutState(sequenceKey, sequenceAsBytes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to assign sequence number to %s: %s", id, err.Error())
+		}
+		err = ctx.GetStub().DelState(response.Key)
+		if err != nil {
+			return 0, fmt.Errorf("failed to dequeue %s: %s", id, err.Error())
+		}
+		assigned++
+	}
+
+	if assigned > 0 {
+		counterAsBytes, _ := json.Marshal(CounterNO{Counter: counter})
+		err = ctx.GetStub().PutState(counterKey, counterAsBytes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to Increment Counter: %s", err.Error())
+		}
+	}
+
+	return assigned, nil
+}
+
+// GetSequenceNumber returns the human-readable sequence number of a record, or 0 if it has not been assigned yet
+func (s *SmartContract) GetSequenceNumber(ctx contractapi.TransactionContextInterface, objectType string, id string) (int, error) {
+	sequenceKey, _ := ctx.GetStub().CreateCompositeKey(sequenceNumberIndex, []string{objectType, id})
+	sequenceAsBytes, err := ctx.GetStub().GetState(sequenceKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+
+	sequence := CounterNO{}
+	_ = json.Unmarshal(sequenceAsBytes, &sequence)
+	return sequence.Counter, nil
+}
 
-	err := ctx.GetStub().PutState(assetType, counterAsBytes)
+// MigrateLegacyKeys moves products, commercial products and orders stored under their raw ID
+// (ProductN, ProductCommercialN, OrderN) to composite keys. IDs are left unchanged, so lookups by old ID keep working.
+func (s *SmartContract) MigrateLegacyKeys(ctx contractapi.TransactionContextInterface) (int, error) {
+	_, _, role, err := getClientIdentity(ctx)
 	if err != nil {
-		return -1, fmt.Errorf("failed to Increment Counter: %s", err.Error())
+		return 0, err
+	}
+	if role != "admin" {
+		return 0, fmt.Errorf("user must be an admin")
+	}
+
+	// the character after "9" bounds each range to the prefix followed by digits, which leaves out counters
+	// and, for "Product", the ProductCommercial records
+	ranges := []struct {
+		objectType string
+		startKey   string
+		endKey     string
+	}{
+		{productObjectType, "Product0", "Product:"},
+		{productCommercialObjectType, "ProductCommercial0", "ProductCommercial:"},
+		{orderObjectType, "Order0", "Order:"},
+	}
+
+	migrated := 0
+	for _, r := range ranges {
+		resultsIterator, err := ctx.GetStub().GetStateByRange(r.startKey, r.endKey)
+		if err != nil {
+			return 0, err
+		}
+		defer resultsIterator.Close()
+
+		for resultsIterator.HasNext() {
+			response, err := resultsIterator.Next()
+			if err != nil {
+				return 0, err
+			}
+
+			key, _ := ctx.GetStub().CreateCompositeKey(r.objectType, []string{response.Key})
+			err = ctx.GetStub().PutState(key, response.Value)
+			if err != nil {
+				return 0, fmt.Errorf("failed to migrate %s: %s", response.Key, err.Error())
+			}
+			err = ctx.GetStub().DelState(response.Key)
+			if err != nil {
+				return 0, fmt.Errorf("failed to delete legacy key %s: %s", response.Key, err.Error())
+			}
+			migrated++
+		}
 	}
+
+	return migrated, nil
+}
+
+func (s *SmartContract) GetCounterOfType(ctx contractapi.TransactionContextInterface, assetType string) (int, error) {
+	counterAsBytes, _ := ctx.GetStub().GetState(assetType)
+	counterAsset := CounterNO{}
+	json.Unmarshal(counterAsBytes, &counterAsset)
+	return counterAsset.Counter, nil
+}
+
+func getCounter(ctx contractapi.TransactionContextInterface, assetType string) (int, error) {
+	counterAsBytes, _ := ctx.GetStub().GetState(assetType)
+	counterAsset := CounterNO{}
+	json.Unmarshal(counterAsBytes, &counterAsset)
 	return counterAsset.Counter, nil
 }
 
@@ -311,13 +822,30 @@ func (s *SmartContract) GetTxTimestampChannel(ctx contractapi.TransactionContext
 	return timeStr, nil
 }
 
-func (s *SmartContract) CultivateProduct(ctx contractapi.TransactionContextInterface, user User, productObj ProductPayload) (*Product, error) {
+func (s *SmartContract) CultivateProduct(ctx contractapi.TransactionContextInterface, productObj ProductPayload) (*Product, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	if user.Role != "supplier" {
 		return nil, fmt.Errorf("user must be a supplier")
 	}
 
-	productCounter, _ := getCounter(ctx, "ProductCounterNO")
-	productCounter++
+	productId, err := newAssetId(ctx, productObjectType, 0)
+	if err != nil {
+		return nil, err
+	}
+	// a retried submission with the same idempotency key returns what the first one created
+	if existing, _ := s.GetProduct(ctx, productId); existing != nil {
+		return existing, nil
+	}
+
+	// the certificate backing the product must be registered and in force
+	_, err = s.checkCertificate(ctx, productObj.CertificateNo, user.UserId, productObj.ProductCode, productObj.ProductName)
+	if err != nil {
+		return nil, err
+	}
 
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
@@ -334,7 +862,7 @@ func (s *SmartContract) CultivateProduct(ctx contractapi.TransactionContextInter
 	dates := append(datesArray, date)
 	
 	var product = Product{
-		ProductId:      "Product" + strconv.Itoa(productCounter),
+		ProductId:      productId,
 		ProductCode:    productObj.ProductCode,
 		ProductName:    productObj.ProductName,
 		Image:          productObj.Image,
@@ -345,32 +873,72 @@ func (s *SmartContract) CultivateProduct(ctx contractapi.TransactionContextInter
 		Status:         "CULTIVATED",
 		Description:    productObj.Description,
 		CertificateUrl: productObj.CertificateUrl,
+		CertificateNo:  productObj.CertificateNo,
 		Supplier:  		actor,
 	}
 	productAsBytes, _ := json.Marshal(product)
-	incrementCounter(ctx, "ProductCounterNO")
 
-	ctx.GetStub().PutState(product.ProductId, productAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, product.ProductId), productAsBytes)
+
+	book := newInventoryBook(ctx)
+	err = book.add(&product)
+	if err != nil {
+		return nil, err
+	}
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
+	err = enqueueSequenceNumber(ctx, productObjectType, product.ProductId)
+	if err != nil {
+		return nil, err
+	}
 
 	return &product, nil
 }
 
-func (s *SmartContract) InventoryProduct(ctx contractapi.TransactionContextInterface, user User, productObj Product) (*Product, error) {
-	if user.Role != "manufacturer" {
-		return nil, fmt.Errorf("user must be a manufacturer")
-	}
+func (s *SmartContract) InventoryProduct(ctx contractapi.TransactionContextInterface, productObj Product) (*Product, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "manufacturer" {
+		return nil, fmt.Errorf("user must be a manufacturer")
+	}
+	if _, _, err := parseExpiry(productObj.Expired); err != nil {
+		return nil, err
+	}
+
+	productId, err := newAssetId(ctx, productObjectType, 0)
+	if err != nil {
+		return nil, err
+	}
+	// a retried submission with the same idempotency key returns what the first one created
+	if existing, _ := s.GetProduct(ctx, productId); existing != nil {
+		return existing, nil
+	}
 
-	productCounter, _ := getCounter(ctx, "ProductCounterNO")
-	productCounter++
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
 
+	// the creating manufacturer is the custodian of the MANUFACTURED step
 	actor := parseUserToActor(user)
+	date := ProductDate{
+		Status: "MANUFACTURED",
+		Time: txTimeAsPtr,
+		Actor: actor,
+	}
+	dates := append(productObj.Dates, date)
 	
 	var product = Product{
-		ProductId:      "Product" + strconv.Itoa(productCounter),
+		ProductId:      productId,
 		ProductCode:    productObj.ProductCode,
 		ProductName:    productObj.ProductName,
 		Image:          productObj.Image,
-		Dates:          productObj.Dates,
+		Dates:          dates,
 		Expired:        productObj.Expired,
 		Price:          productObj.Price,
 		Amount:         productObj.Amount,
@@ -382,20 +950,38 @@ func (s *SmartContract) InventoryProduct(ctx contractapi.TransactionContextInter
 		Supplier:  		actor,
 	}
 	productAsBytes, _ := json.Marshal(product)
-	incrementCounter(ctx, "ProductCounterNO")
 
-	ctx.GetStub().PutState(product.ProductId, productAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, product.ProductId), productAsBytes)
+
+	book := newInventoryBook(ctx)
+	err = book.add(&product)
+	if err != nil {
+		return nil, err
+	}
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
+	err = enqueueSequenceNumber(ctx, productObjectType, product.ProductId)
+	if err != nil {
+		return nil, err
+	}
+	err = indexProductByCode(ctx, nil, &product)
+	if err != nil {
+		return nil, err
+	}
 
 	return &product, nil
 }
 
-func (s *SmartContract) HarvestProduct(ctx contractapi.TransactionContextInterface, user User, productObj Product) (*Product, error) {
-	if user.Role != "supplier" {
-		return nil, fmt.Errorf("user must be a supplier")
+func (s *SmartContract) HarvestProduct(ctx contractapi.TransactionContextInterface, productObj Product) (*Product, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	// get product details
-	productBytes, _ := ctx.GetStub().GetState(productObj.ProductId)
+	productBytes, _ := ctx.GetStub().GetState(productKey(ctx, productObj.ProductId))
 	if productBytes == nil {
 		return nil, fmt.Errorf("product not found")
 	}
@@ -403,6 +989,11 @@ func (s *SmartContract) HarvestProduct(ctx contractapi.TransactionContextInterfa
 	product := new(Product)
 	_ = json.Unmarshal(productBytes, product)
 
+	err = checkProductTransition(user, product.ProductId, product.Status, product.Dates, "HARVESTED")
+	if err != nil {
+		return nil, err
+	}
+
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
 		return nil, fmt.Errorf("transaction timeStamp error")
@@ -419,17 +1010,46 @@ func (s *SmartContract) HarvestProduct(ctx contractapi.TransactionContextInterfa
 	// update product
 	product.Dates = dates
 	product.Status = "HARVESTED"
-	product.Amount = productObj.Amount
+
+	// the harvested amount is the stock on hand, a harvest of unknown size cannot be stocked
+	if productObj.Amount == "" {
+		return nil, fmt.Errorf("harvested amount of %s is required", product.ProductId)
+	}
+	harvested, err := parseQuantity(productObj.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if harvested < 0 {
+		return nil, fmt.Errorf("harvested amount of %s cannot be negative", product.ProductId)
+	}
+	book := newInventoryBook(ctx)
+	err = book.setOnHand(product.ProductId, harvested)
+	if err != nil {
+		return nil, err
+	}
+	product.Amount = formatQuantity(harvested)
 
 	updatedProductAsBytes, _ := json.Marshal(product)
-	ctx.GetStub().PutState(product.ProductId, updatedProductAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, product.ProductId), updatedProductAsBytes)
+
+	// the book loaded the product as it was, file the stock with the record written here
+	book.handOver(product)
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
 
 	return product, nil
 }
 
-func (s *SmartContract) UpdateProduct(ctx contractapi.TransactionContextInterface, user User, productObj Product) (*Product, error) {
+func (s *SmartContract) UpdateProduct(ctx contractapi.TransactionContextInterface, productObj Product) (*Product, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	// get product
-	productBytes, _ := ctx.GetStub().GetState(productObj.ProductId)
+	productBytes, _ := ctx.GetStub().GetState(productKey(ctx, productObj.ProductId))
 	if productBytes == nil {
 		return nil, fmt.Errorf("product not found")
 	}
@@ -437,20 +1057,53 @@ func (s *SmartContract) UpdateProduct(ctx contractapi.TransactionContextInterfac
 	product := new(Product)
 	_ = json.Unmarshal(productBytes, product)
 
-	// update product
+	if !isActor(productHolder(product), user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+
+	_, _, err = parseExpiry(productObj.Expired)
+	if err != nil {
+		return nil, err
+	}
+
+	// a certificate only replaces the one on record once the registry vouches for it, and it must still
+	// cover the product if the product is renamed
+	if productObj.CertificateNo == "" {
+		productObj.CertificateNo = product.CertificateNo
+	}
+	certified := productObj.CertificateNo != ""
+	changed := productObj.CertificateNo != product.CertificateNo || productObj.ProductCode != product.ProductCode || productObj.ProductName != product.ProductName
+	if certified && changed {
+		_, err = s.checkCertificate(ctx, productObj.CertificateNo, product.Supplier.UserId, productObj.ProductCode, productObj.ProductName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// update product, the status only changes through the lifecycle transactions and the amount through inventory
+	productObj.Status = product.Status
+	productObj.Dates = product.Dates
+	productObj.Amount = product.Amount
+	productObj.Supplier = product.Supplier
+	previous := product
 	product = &productObj
 	updatedProductAsBytes, _ := json.Marshal(product)
-	ctx.GetStub().PutState(product.ProductId, updatedProductAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, product.ProductId), updatedProductAsBytes)
+	err = indexProductByCode(ctx, previous, product)
+	if err != nil {
+		return nil, err
+	}
 
 	return product, nil
 }
 
-func (s *SmartContract) ImportProduct(ctx contractapi.TransactionContextInterface, user User, productObj Product) (*Product, error) {
-	if user.Role != "manufacturer" {
-		return nil, fmt.Errorf("user must be a manufacturer")
+func (s *SmartContract) ImportProduct(ctx contractapi.TransactionContextInterface, productObj Product) (*Product, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	productBytes, _ := ctx.GetStub().GetState(productObj.ProductId)
+	productBytes, _ := ctx.GetStub().GetState(productKey(ctx, productObj.ProductId))
 	if productBytes == nil {
 		return nil, fmt.Errorf("product not found")
 	}
@@ -458,6 +1111,11 @@ func (s *SmartContract) ImportProduct(ctx contractapi.TransactionContextInterfac
 	product := new(Product)
 	_ = json.Unmarshal(productBytes, product)
 
+	err = checkProductTransition(user, product.ProductId, product.Status, product.Dates, "IMPORTED")
+	if err != nil {
+		return nil, err
+	}
+
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
 		return nil, fmt.Errorf("transaction timeStamp error")
@@ -469,7 +1127,7 @@ func (s *SmartContract) ImportProduct(ctx contractapi.TransactionContextInterfac
 		Time: txTimeAsPtr,
 		Actor: actor,
 	}
-	dates := append(productObj.Dates, date)
+	dates := append(product.Dates, date)
 
 	// update product
 	product.Dates = dates
@@ -478,17 +1136,32 @@ func (s *SmartContract) ImportProduct(ctx contractapi.TransactionContextInterfac
 	product.Status = "IMPORTED"
 
 	updatedProductAsBytes, _ := json.Marshal(product)
-	ctx.GetStub().PutState(product.ProductId, updatedProductAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, product.ProductId), updatedProductAsBytes)
+
+	// the manufacturer takes the stock over from the supplier
+	book := newInventoryBook(ctx)
+	inventory, err := book.lookup(product.ProductId)
+	if err != nil {
+		return nil, err
+	}
+	if inventory != nil {
+		book.handOver(product)
+		err = book.save()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return product, nil
 }
 
-func (s *SmartContract) ManufactureProduct(ctx contractapi.TransactionContextInterface, user User, productObj Product) (*Product, error) {
-	if user.Role != "manufacturer" {
-		return nil, fmt.Errorf("user must be a manufacturer")
+func (s *SmartContract) ManufactureProduct(ctx contractapi.TransactionContextInterface, productObj Product) (*Product, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	productBytes, _ := ctx.GetStub().GetState(productObj.ProductId)
+	productBytes, _ := ctx.GetStub().GetState(productKey(ctx, productObj.ProductId))
 	if productBytes == nil {
 		return nil, fmt.Errorf("product not found")
 	}
@@ -496,15 +1169,20 @@ func (s *SmartContract) ManufactureProduct(ctx contractapi.TransactionContextInt
 	product := new(Product)
 	_ = json.Unmarshal(productBytes, product)
 
+	err = checkProductTransition(user, product.ProductId, product.Status, product.Dates, "MANUFACTURED")
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = parseExpiry(productObj.Expired)
+	if err != nil {
+		return nil, err
+	}
+
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
 		return nil, fmt.Errorf("transaction timeStamp error")
 	}
 
-	if product.Dates[2].Actor.UserId != user.UserId {
-		return nil, fmt.Errorf("Permission denied!")
-	}
-
 	actor := parseUserToActor(user)
 	date := ProductDate{
 		Status: "MANUFACTURED",
@@ -521,17 +1199,22 @@ func (s *SmartContract) ManufactureProduct(ctx contractapi.TransactionContextInt
 	product.Status = "MANUFACTURED"
 
 	updatedProductAsBytes, _ := json.Marshal(product)
-	ctx.GetStub().PutState(product.ProductId, updatedProductAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, product.ProductId), updatedProductAsBytes)
+	err = indexProductByCode(ctx, nil, product)
+	if err != nil {
+		return nil, err
+	}
 
 	return product, nil
 }
 
-func (s *SmartContract) ExportProduct(ctx contractapi.TransactionContextInterface, user User, productObj ProductCommercial) (*ProductCommercial, error) {
-	if user.Role != "manufacturer" {
-		return nil, fmt.Errorf("user must be a manufacturer")
+func (s *SmartContract) ExportProduct(ctx contractapi.TransactionContextInterface, productObj ProductCommercial) (*ProductCommercial, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	productBytes, _ := ctx.GetStub().GetState(productObj.ProductId)
+	productBytes, _ := ctx.GetStub().GetState(productKey(ctx, productObj.ProductId))
 	if productBytes == nil {
 		return nil, fmt.Errorf("product not found")
 	}
@@ -539,15 +1222,16 @@ func (s *SmartContract) ExportProduct(ctx contractapi.TransactionContextInterfac
 	productCommercial := new(ProductCommercial)
 	_ = json.Unmarshal(productBytes, productCommercial)
 
+	err = checkProductTransition(user, productCommercial.ProductId, productCommercial.Status, productCommercial.Dates, "EXPORTED")
+	if err != nil {
+		return nil, err
+	}
+
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
 		return nil, fmt.Errorf("transaction timeStamp error")
 	}
 
-	if productCommercial.Dates[3].Actor.UserId != user.UserId {
-		return nil, fmt.Errorf("Permission denied!")
-	}
-
 	actor := parseUserToActor(user)
 	date := ProductDate{
 		Status: "EXPORTED",
@@ -562,17 +1246,18 @@ func (s *SmartContract) ExportProduct(ctx contractapi.TransactionContextInterfac
 	productCommercial.Status = "EXPORTED"
 
 	updatedProductAsBytes, _ := json.Marshal(productCommercial)
-	ctx.GetStub().PutState(productCommercial.ProductId, updatedProductAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, productCommercial.ProductId), updatedProductAsBytes)
 
 	return productCommercial, nil
 }
 
-func (s *SmartContract) DistributeProduct(ctx contractapi.TransactionContextInterface, user User, productObj ProductCommercial) (*ProductCommercial, error) {
-	if user.Role != "distributor" {
-		return nil, fmt.Errorf("user must be a distributor")
+func (s *SmartContract) DistributeProduct(ctx contractapi.TransactionContextInterface, productObj ProductCommercial) (*ProductCommercial, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	productBytes, _ := ctx.GetStub().GetState(productObj.ProductId)
+	productBytes, _ := ctx.GetStub().GetState(productKey(ctx, productObj.ProductId))
 	if productBytes == nil {
 		return nil, fmt.Errorf("product not found")
 	}
@@ -580,6 +1265,11 @@ func (s *SmartContract) DistributeProduct(ctx contractapi.TransactionContextInte
 	productCommercial := new(ProductCommercial)
 	_ = json.Unmarshal(productBytes, productCommercial)
 
+	err = checkProductTransition(user, productCommercial.ProductId, productCommercial.Status, productCommercial.Dates, "DISTRIBUTING")
+	if err != nil {
+		return nil, err
+	}
+
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
 		return nil, fmt.Errorf("transaction timeStamp error")
@@ -598,18 +1288,19 @@ func (s *SmartContract) DistributeProduct(ctx contractapi.TransactionContextInte
 	productCommercial.Status = "DISTRIBUTING"
 
 	updatedProductAsBytes, _ := json.Marshal(productCommercial)
-	ctx.GetStub().PutState(productCommercial.ProductId, updatedProductAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, productCommercial.ProductId), updatedProductAsBytes)
 
 	return productCommercial, nil
 }
 
-func (s *SmartContract) ImportRetailerProduct(ctx contractapi.TransactionContextInterface, user User, productObj ProductCommercial) (*ProductCommercial, error) {
-	if user.Role != "retailer" {
-		return nil, fmt.Errorf("user must be a retailer")
+func (s *SmartContract) ImportRetailerProduct(ctx contractapi.TransactionContextInterface, productObj ProductCommercial) (*ProductCommercial, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	// get product
-	productBytes, _ := ctx.GetStub().GetState(productObj.ProductId)
+	productBytes, _ := ctx.GetStub().GetState(productKey(ctx, productObj.ProductId))
 	if productBytes == nil {
 		return nil, fmt.Errorf("product not found")
 	}
@@ -617,6 +1308,19 @@ func (s *SmartContract) ImportRetailerProduct(ctx contractapi.TransactionContext
 	productCommercial := new(ProductCommercial)
 	_ = json.Unmarshal(productBytes, productCommercial)
 
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = checkNotExpired(productCommercial.ProductId, productCommercial.Expired, now)
+	if err != nil {
+		return nil, err
+	}
+	err = checkProductTransition(user, productCommercial.ProductId, productCommercial.Status, productCommercial.Dates, "RETAILING")
+	if err != nil {
+		return nil, err
+	}
+
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
 		return nil, fmt.Errorf("transaction timeStamp error")
@@ -636,18 +1340,19 @@ func (s *SmartContract) ImportRetailerProduct(ctx contractapi.TransactionContext
 	productCommercial.Status = "RETAILING"
 
 	updatedProductAsBytes, _ := json.Marshal(productCommercial)
-	ctx.GetStub().PutState(productCommercial.ProductId, updatedProductAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, productCommercial.ProductId), updatedProductAsBytes)
 
 	return productCommercial, nil
 }
 
-func (s *SmartContract) SellProduct(ctx contractapi.TransactionContextInterface, user User, productObj ProductCommercial) (*ProductCommercial, error) {
-	if user.Role != "retailer" {
-		return nil, fmt.Errorf("user must be a retailer")
+func (s *SmartContract) SellProduct(ctx contractapi.TransactionContextInterface, productObj ProductCommercial) (*ProductCommercial, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	// get product
-	productBytes, _ := ctx.GetStub().GetState(productObj.ProductId)
+	productBytes, _ := ctx.GetStub().GetState(productKey(ctx, productObj.ProductId))
 	if productBytes == nil {
 		return nil, fmt.Errorf("product not found")
 	}
@@ -655,6 +1360,23 @@ func (s *SmartContract) SellProduct(ctx contractapi.TransactionContextInterface,
 	productCommercial := new(ProductCommercial)
 	_ = json.Unmarshal(productBytes, productCommercial)
 
+	err = checkProductNotRecalled(ctx, productCommercial.ProductId)
+	if err != nil {
+		return nil, err
+	}
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = checkNotExpired(productCommercial.ProductId, productCommercial.Expired, now)
+	if err != nil {
+		return nil, err
+	}
+	err = checkProductTransition(user, productCommercial.ProductId, productCommercial.Status, productCommercial.Dates, "SOLD")
+	if err != nil {
+		return nil, err
+	}
+
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
 		return nil, fmt.Errorf("transaction timeStamp error")
@@ -674,13 +1396,13 @@ func (s *SmartContract) SellProduct(ctx contractapi.TransactionContextInterface,
 	productCommercial.Status = "SOLD"
 
 	updatedProductAsBytes, _ := json.Marshal(productCommercial)
-	ctx.GetStub().PutState(productCommercial.ProductId, updatedProductAsBytes)
+	ctx.GetStub().PutState(productKey(ctx, productCommercial.ProductId), updatedProductAsBytes)
 
 	return productCommercial, nil
 }
 
 func (s *SmartContract) GetProduct(ctx contractapi.TransactionContextInterface, ProductId string) (*Product, error) {
-	productAsBytes, err := ctx.GetStub().GetState(ProductId)
+	productAsBytes, err := ctx.GetStub().GetState(productKey(ctx, ProductId))
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
@@ -696,7 +1418,7 @@ func (s *SmartContract) GetProduct(ctx contractapi.TransactionContextInterface,
 }
 
 func (s *SmartContract) GetProductCommercial(ctx contractapi.TransactionContextInterface, ProductId string) (*ProductCommercial, error) {
-	productAsBytes, err := ctx.GetStub().GetState(ProductId)
+	productAsBytes, err := ctx.GetStub().GetState(productCommercialKey(ctx, ProductId))
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
@@ -712,24 +1434,7 @@ func (s *SmartContract) GetProductCommercial(ctx contractapi.TransactionContextI
 }
 
 func (s *SmartContract) GetAllProducts(ctx contractapi.TransactionContextInterface) ([]*Product, error) {
-	productCounter, _ := getCounter(ctx, "ProductCounterNO")
-	var startKey string = "Product1"
-	var endKey string
-
-	// Limit product amount: > 99 products
-	if productCounter == 99 {
-		endKey = "Product99"
-	} else
-		if productCounter >= 89 && productCounter <= 98 {
-			endKey = "Product" + strconv.Itoa(productCounter+1)
-		} else
-			if productCounter >= 9 {
-				endKey = "Product9"
-			} else {
-				endKey = "Product" + strconv.Itoa(productCounter+1)
-			}
-				
-	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey+"\x00")
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productObjectType, []string{})
 	if err != nil {
 		return nil, err
 	}
@@ -760,24 +1465,7 @@ func (s *SmartContract) GetAllProducts(ctx contractapi.TransactionContextInterfa
 }
 
 func (s *SmartContract) GetAllProductsCommercial(ctx contractapi.TransactionContextInterface) ([]*ProductCommercial, error) {
-	productCounter, _ := getCounter(ctx, "ProductCommercialCounterNO")
-	var startKey string = "ProductCommercial1"
-	var endKey string
-
-	// Limit product commercial amount: > 99 products
-	if productCounter == 99 {
-		endKey = "ProductCommercial99"
-	} else
-		if productCounter >= 89 && productCounter <= 98 {
-			endKey = "ProductCommercial" + strconv.Itoa(productCounter+1)
-		} else
-			if productCounter >= 9 {
-				endKey = "ProductCommercial9"
-			} else {
-				endKey = "ProductCommercial" + strconv.Itoa(productCounter+1)
-			}
-				
-	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey+"\x00")
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productCommercialObjectType, []string{})
 	if err != nil {
 		return nil, err
 	}
@@ -807,7 +1495,7 @@ func (s *SmartContract) GetAllProductsCommercial(ctx contractapi.TransactionCont
 }
 
 func (s *SmartContract) GetOrder(ctx contractapi.TransactionContextInterface, OrderId string) (*Order, error) {
-	orderAsBytes, err := ctx.GetStub().GetState(OrderId)
+	orderAsBytes, err := ctx.GetStub().GetState(orderKey(ctx, OrderId))
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
@@ -818,29 +1506,13 @@ func (s *SmartContract) GetOrder(ctx contractapi.TransactionContextInterface, Or
 
 	order := new(Order)
 	_ = json.Unmarshal(orderAsBytes, order)
+	order.DocType = orderObjectType
 
 	return order, nil
 }
 
 func (s *SmartContract) GetAllOrders(ctx contractapi.TransactionContextInterface, status string) ([]*Order, error) {
-	orderCounter, _ := getCounter(ctx, "OrderCounterNO")
-	var startKey string = "Order1"
-	var endKey string
-
-	// Limit order amount: > 99 orders
-	if orderCounter == 99 {
-		endKey = "Order99"
-	} else
-		if orderCounter >= 89 && orderCounter <= 98 {
-			endKey = "Order" + strconv.Itoa(orderCounter+1)
-		} else
-			if orderCounter >= 9 {
-				endKey = "Order9"
-			} else {
-				endKey = "Order" + strconv.Itoa(orderCounter+1)
-			}
-
-	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey+"\x00")
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderObjectType, []string{})
 	if err != nil {
 		return nil, err
 	}
@@ -870,24 +1542,7 @@ func (s *SmartContract) GetAllOrders(ctx contractapi.TransactionContextInterface
 }
 
 func (s *SmartContract) GetAllOrdersOfManufacturer(ctx contractapi.TransactionContextInterface, userId string, status string) ([]*Order, error) {
-    orderCounter, _ := getCounter(ctx, "OrderCounterNO")
-	var startKey string = "Order1"
-	var endKey string
-
-	// Limit order amount: > 99 orders
-	if orderCounter == 99 {
-		endKey = "Order99"
-	} else
-		if orderCounter >= 89 && orderCounter <= 98 {
-			endKey = "Order" + strconv.Itoa(orderCounter+1)
-		} else
-			if orderCounter >= 9 {
-				endKey = "Order9"
-			} else {
-				endKey = "Order" + strconv.Itoa(orderCounter+1)
-			}
-
-	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey+"\x00")
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderObjectType, []string{})
 	if err != nil {
 		return nil, err
 	}
@@ -917,24 +1572,7 @@ func (s *SmartContract) GetAllOrdersOfManufacturer(ctx contractapi.TransactionCo
 }
 
 func (s *SmartContract) GetAllOrdersOfDistributor(ctx contractapi.TransactionContextInterface, userId string, status string) ([]*Order, error) {
-    orderCounter, _ := getCounter(ctx, "OrderCounterNO")
-	var startKey string = "Order1"
-	var endKey string
-
-	// Limit order amount: > 99 orders
-	if orderCounter == 99 {
-		endKey = "Order99"
-	} else
-		if orderCounter >= 89 && orderCounter <= 98 {
-			endKey = "Order" + strconv.Itoa(orderCounter+1)
-		} else
-			if orderCounter >= 9 {
-				endKey = "Order9"
-			} else {
-				endKey = "Order" + strconv.Itoa(orderCounter+1)
-			}
-
-	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey+"\x00")
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderObjectType, []string{})
 	if err != nil {
 		return nil, err
 	}
@@ -964,24 +1602,7 @@ func (s *SmartContract) GetAllOrdersOfDistributor(ctx contractapi.TransactionCon
 }
 
 func (s *SmartContract) GetAllOrdersOfRetailer(ctx contractapi.TransactionContextInterface, userId string, status string) ([]*Order, error) {
-    orderCounter, _ := getCounter(ctx, "OrderCounterNO")
-	var startKey string = "Order1"
-	var endKey string
-
-	// Limit order amount: > 99 orders
-	if orderCounter == 99 {
-		endKey = "Order99"
-	} else
-		if orderCounter >= 89 && orderCounter <= 98 {
-			endKey = "Order" + strconv.Itoa(orderCounter+1)
-		} else
-			if orderCounter >= 9 {
-				endKey = "Order9"
-			} else {
-				endKey = "Order" + strconv.Itoa(orderCounter+1)
-			}
-
-	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey+"\x00")
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderObjectType, []string{})
 	if err != nil {
 		return nil, err
 	}
@@ -1010,13 +1631,129 @@ func (s *SmartContract) GetAllOrdersOfRetailer(ctx contractapi.TransactionContex
 	return orders, nil
 }
 
-func (s *SmartContract) CreateOrder(ctx contractapi.TransactionContextInterface, user User, orderObj OrderForCreate) (*Order, error) {
+// GetProductsWithPagination returns at most pageSize products starting at bookmark ("" for the first page)
+func (s *SmartContract) GetProductsWithPagination(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*ProductPage, error) {
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(productObjectType, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	products := []*Product{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var product Product
+		err = json.Unmarshal(response.Value, &product)
+		if err != nil {
+			return nil, err
+		}
+
+		products = append(products, &product)
+	}
+
+	return &ProductPage{
+		Records: products,
+		Bookmark: metadata.Bookmark,
+		FetchedCount: metadata.FetchedRecordsCount,
+	}, nil
+}
+
+// GetProductsCommercialWithPagination returns at most pageSize commercial products starting at bookmark ("" for the first page)
+func (s *SmartContract) GetProductsCommercialWithPagination(ctx contractapi.TransactionContextInterface, pageSize int32, bookmark string) (*ProductCommercialPage, error) {
+	resultsIterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(productCommercialObjectType, []string{}, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	productCommercials := []*ProductCommercial{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var productCommercial ProductCommercial
+		err = json.Unmarshal(response.Value, &productCommercial)
+		if err != nil {
+			return nil, err
+		}
+
+		productCommercials = append(productCommercials, &productCommercial)
+	}
+
+	return &ProductCommercialPage{
+		Records: productCommercials,
+		Bookmark: metadata.Bookmark,
+		FetchedCount: metadata.FetchedRecordsCount,
+	}, nil
+}
+
+// GetOrdersWithPagination returns at most pageSize orders starting at bookmark ("" for the first page).
+// Filtering by status needs a rich query, so it is only available on CouchDB peers.
+func (s *SmartContract) GetOrdersWithPagination(ctx contractapi.TransactionContextInterface, status string, pageSize int32, bookmark string) (*OrderPage, error) {
+	var resultsIterator shim.StateQueryIteratorInterface
+	var metadata *peer.QueryResponseMetadata
+	var err error
+
+	if status == "" {
+		resultsIterator, metadata, err = ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(orderObjectType, []string{}, pageSize, bookmark)
+	} else {
+		selector := map[string]interface{}{
+			"selector": map[string]interface{}{
+				"docType": orderObjectType,
+				"status": status,
+			},
+		}
+		queryString, _ := json.Marshal(selector)
+		resultsIterator, metadata, err = ctx.GetStub().GetQueryResultWithPagination(string(queryString), pageSize, bookmark)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	orders := []*Order{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var order Order
+		_ = json.Unmarshal(response.Value, &order)
+		orders = append(orders, &order)
+	}
+
+	return &OrderPage{
+		Records: orders,
+		Bookmark: metadata.Bookmark,
+		FetchedCount: metadata.FetchedRecordsCount,
+	}, nil
+}
+
+func (s *SmartContract) CreateOrder(ctx contractapi.TransactionContextInterface, orderObj OrderForCreate) (*Order, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	if user.Role != "retailer" {
 		return nil, fmt.Errorf("user must be a retailer")
 	}
 
-	orderCounter, _ := getCounter(ctx, "OrderCounterNO")
-	orderCounter++
+	orderId, err := newAssetId(ctx, orderObjectType, 0)
+	if err != nil {
+		return nil, err
+	}
+	// a retried submission with the same idempotency key returns what the first one created
+	if existing, _ := s.GetOrder(ctx, orderId); existing != nil {
+		return existing, nil
+	}
 
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
@@ -1035,11 +1772,81 @@ func (s *SmartContract) CreateOrder(ctx contractapi.TransactionContextInterface,
 	var deliveryStatuses []DeliveryStatus
 	deliveryStatuses = append(deliveryStatuses, delivery)
 
-	var productItemList []ProductCommercialItem
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	productCommercialCounter, _ := getCounter(ctx, "ProductCommercialCounterNO")
+	// hold the ordered stock, the order is refused if any product runs short or has expired.
+	// items ordered by product code take the stock that expires first. One manufacturer approves the order,
+	// so every item must come from the same one.
+	book := newInventoryBook(ctx)
+	var manufacturer TokenAccount
 	for _, item := range orderObj.ProductIdQRCodeItems {
-		productAsBytes, err := ctx.GetStub().GetState(item.ProductId)
+		if item.ProductId == "" {
+			continue
+		}
+		_, err = book.get(item.ProductId)
+		if err != nil {
+			return nil, err
+		}
+		itemManufacturer := actorAccount(productManufacturer(book.products[item.ProductId].Dates))
+		if manufacturer.UserId != "" && itemManufacturer != manufacturer {
+			return nil, fmt.Errorf("order items must all come from one manufacturer, %s is from %s and not %s", item.ProductId, itemManufacturer, manufacturer)
+		}
+		manufacturer = itemManufacturer
+	}
+
+	var orderItems []ProductIdQRCodeItem
+	for _, item := range orderObj.ProductIdQRCodeItems {
+		quantity, err := parseQuantity(item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		if quantity <= 0 {
+			return nil, fmt.Errorf("ordered quantity of %s%s must be positive", item.ProductId, item.ProductCode)
+		}
+
+		if item.ProductId == "" {
+			if item.ProductCode == "" {
+				return nil, fmt.Errorf("order items need a productId or a productCode")
+			}
+			allocated, itemManufacturer, err := allocateByExpiry(ctx, book, item, quantity, now, manufacturer)
+			if err != nil {
+				return nil, err
+			}
+			manufacturer = itemManufacturer
+			orderItems = append(orderItems, allocated...)
+			continue
+		}
+
+		err = checkProductNotRecalled(ctx, item.ProductId)
+		if err != nil {
+			return nil, err
+		}
+		_, err = book.get(item.ProductId)
+		if err != nil {
+			return nil, err
+		}
+		err = checkNotExpired(item.ProductId, book.products[item.ProductId].Expired, now)
+		if err != nil {
+			return nil, err
+		}
+		err = book.reserve(item.ProductId, quantity)
+		if err != nil {
+			return nil, err
+		}
+		orderItems = append(orderItems, item)
+	}
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
+
+	var productItemList []ProductCommercialItem
+
+	for i, item := range orderItems {
+		productAsBytes, err := ctx.GetStub().GetState(productKey(ctx, item.ProductId))
 		if err != nil {
 			return nil, fmt.Errorf("product not found")
 		}
@@ -1047,24 +1854,35 @@ func (s *SmartContract) CreateOrder(ctx contractapi.TransactionContextInterface,
 		product := new(Product)
 		_ = json.Unmarshal(productAsBytes, product)
 
-		productCommercialCounter++
+		productCommercialId, err := newAssetId(ctx, productCommercialObjectType, i)
+		if err != nil {
+			return nil, err
+		}
 
 		parsedProduct := parseProductToProductCommercial(*product)
-		parsedProduct.ProductCommercialId = "ProductCommercial" + strconv.Itoa(productCommercialCounter)
+		parsedProduct.ProductCommercialId = productCommercialId
 		parsedProduct.QRCode = item.QRCode
 		productCommercialAsBytes, _ := json.Marshal(parsedProduct)
-		ctx.GetStub().PutState(parsedProduct.ProductCommercialId, productCommercialAsBytes)
+		ctx.GetStub().PutState(productCommercialKey(ctx, parsedProduct.ProductCommercialId), productCommercialAsBytes)
+		err = enqueueSequenceNumber(ctx, productCommercialObjectType, parsedProduct.ProductCommercialId)
+		if err != nil {
+			return nil, err
+		}
+		err = indexProductCommercial(ctx, &parsedProduct)
+		if err != nil {
+			return nil, err
+		}
 
 		productItem := ProductCommercialItem{ 
 			Product: parsedProduct, 
 			Quantity: item.Quantity, 
 		}
-		incrementWithIntCounter(ctx, "ProductCommercialCounterNO", productCommercialCounter)
 		productItemList = append(productItemList, productItem)
 	}
 
 	var order = Order{
-		OrderId:   			"Order" + strconv.Itoa(orderCounter),
+		DocType: 			orderObjectType,
+		OrderId:   			orderId,
 		ProductItemList: 	productItemList,
 		Signatures:       	orderObj.Signatures,
 		DeliveryStatuses:   deliveryStatuses,
@@ -1078,19 +1896,37 @@ func (s *SmartContract) CreateOrder(ctx contractapi.TransactionContextInterface,
 		FinishDate: 		"",
 	}
 
+	// the retailer pays into escrow up front, the order is refused if the retailer cannot cover it
+	err = lockOrderPayment(ctx, &order, txTimeAsPtr)
+	if err != nil {
+		return nil, err
+	}
+
 	orderAsBytes, _ := json.Marshal(order)
-	incrementCounter(ctx, "OrderCounterNO")
-	ctx.GetStub().PutState(order.OrderId, orderAsBytes)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+	err = enqueueSequenceNumber(ctx, orderObjectType, order.OrderId)
+	if err != nil {
+		return nil, err
+	}
+	err = indexOrderProducts(ctx, &order)
+	if err != nil {
+		return nil, err
+	}
 
 	return &order, nil
 }
 
-func (s *SmartContract) ApproveOrder(ctx contractapi.TransactionContextInterface, user User, orderId string) (*Order, error) {
+func (s *SmartContract) ApproveOrder(ctx contractapi.TransactionContextInterface, orderId string) (*Order, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	if user.Role != "manufacturer" {
 		return nil, fmt.Errorf("user must be a manufacturer")
 	}
 
-	orderAsBytes, err := ctx.GetStub().GetState(orderId)
+	orderAsBytes, err := ctx.GetStub().GetState(orderKey(ctx, orderId))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
 	}
@@ -1101,6 +1937,10 @@ func (s *SmartContract) ApproveOrder(ctx contractapi.TransactionContextInterface
 	order := new(Order)
 	_ = json.Unmarshal(orderAsBytes, order)
 
+	if order.Status != "PENDING" {
+		return nil, fmt.Errorf("order %s is %s, only PENDING orders can be approved", order.OrderId, order.Status)
+	}
+
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
 		return nil, fmt.Errorf("transaction timeStamp error")
@@ -1109,6 +1949,11 @@ func (s *SmartContract) ApproveOrder(ctx contractapi.TransactionContextInterface
 	// export products in order
 	var productItemList []ProductCommercialItem
 	for _, item := range order.ProductItemList {
+		err = checkProductTransition(user, item.Product.ProductCommercialId, item.Product.Status, item.Product.Dates, "EXPORTED")
+		if err != nil {
+			return nil, err
+		}
+
 		actor := parseUserToActor(user)
 		date := ProductDate{
 			Status: "EXPORTED",
@@ -1122,7 +1967,7 @@ func (s *SmartContract) ApproveOrder(ctx contractapi.TransactionContextInterface
 		item.Product.Status = "EXPORTED"
 
 		updatedProductAsBytes, _ := json.Marshal(item.Product)
-		ctx.GetStub().PutState(item.Product.ProductCommercialId, updatedProductAsBytes)
+		ctx.GetStub().PutState(productCommercialKey(ctx, item.Product.ProductCommercialId), updatedProductAsBytes)
 
 		// update updated products into order
 		productItem := ProductCommercialItem{
@@ -1152,17 +1997,22 @@ func (s *SmartContract) ApproveOrder(ctx contractapi.TransactionContextInterface
 	order.Status = "APPROVED"
 
 	updateOrderAsBytes, _ := json.Marshal(order)
-	ctx.GetStub().PutState(order.OrderId, updateOrderAsBytes)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), updateOrderAsBytes)
 
 	return order, nil
 }
 
-func (s *SmartContract) RejectOrder(ctx contractapi.TransactionContextInterface, user User, orderId string) (*Order, error) {
+func (s *SmartContract) RejectOrder(ctx contractapi.TransactionContextInterface, orderId string) (*Order, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	if user.Role != "manufacturer" {
 		return nil, fmt.Errorf("user must be a manufacturer")
 	}
 
-	orderAsBytes, err := ctx.GetStub().GetState(orderId)
+	orderAsBytes, err := ctx.GetStub().GetState(orderKey(ctx, orderId))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
 	}
@@ -1173,14 +2023,36 @@ func (s *SmartContract) RejectOrder(ctx contractapi.TransactionContextInterface,
 	order := new(Order)
 	_ = json.Unmarshal(orderAsBytes, order)
 
+	if order.Status != "PENDING" {
+		return nil, fmt.Errorf("order %s is %s, only PENDING orders can be rejected", order.OrderId, order.Status)
+	}
+
 	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
 	if errTx != nil {
 		return nil, fmt.Errorf("transaction timeStamp error")
 	}
 
-	// if order.Manufacturer.UserId != user.UserId {
-	// 	return nil, fmt.Errorf("This manufacturer is not allowed to approve this order!")
-	// }
+	// only the manufacturer of the ordered stock may turn the order down, rejecting it refunds the retailer
+	for _, item := range order.ProductItemList {
+		if !isActor(productManufacturer(item.Product.Dates), user) {
+			return nil, fmt.Errorf("permission denied: %s of order %s was not manufactured by %s", item.Product.ProductCommercialId, order.OrderId, user.UserId)
+		}
+	}
+
+	book := newInventoryBook(ctx)
+	err = releaseOrderReservations(book, order)
+	if err != nil {
+		return nil, err
+	}
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
+
+	err = refundOrderPayment(ctx, order, txTimeAsPtr)
+	if err != nil {
+		return nil, err
+	}
 
 	actor := parseUserToActor(user)
 	delivery := DeliveryStatus{
@@ -1197,12 +2069,17 @@ func (s *SmartContract) RejectOrder(ctx contractapi.TransactionContextInterface,
 	order.Status = "REJECTED"
 
 	updateOrderAsBytes, _ := json.Marshal(order)
-	ctx.GetStub().PutState(order.OrderId, updateOrderAsBytes)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), updateOrderAsBytes)
 
 	return order, nil
 }
 
-func (s *SmartContract) UpdateOrder(ctx contractapi.TransactionContextInterface, user User, orderObj OrderForUpdateFinish) (*Order, error) {
+func (s *SmartContract) UpdateOrder(ctx contractapi.TransactionContextInterface, orderObj OrderForUpdateFinish) (*Order, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	if user.Role != "distributor" {
 		return nil, fmt.Errorf("user must be a distributor")
 	}
@@ -1212,7 +2089,7 @@ func (s *SmartContract) UpdateOrder(ctx contractapi.TransactionContextInterface,
 		return nil, fmt.Errorf("transaction timeStamp error")
 	}
 
-	orderBytes, _ := ctx.GetStub().GetState(orderObj.OrderId)
+	orderBytes, _ := ctx.GetStub().GetState(orderKey(ctx, orderObj.OrderId))
 	if orderBytes == nil {
 		return nil, fmt.Errorf("cannot find this order")
 	}
@@ -1220,34 +2097,18 @@ func (s *SmartContract) UpdateOrder(ctx contractapi.TransactionContextInterface,
 	order := new(Order)
 	_ = json.Unmarshal(orderBytes, order)
 
-	// if order.Distributor.UserId != user.UserId {
-	// 	return nil, fmt.Errorf("Permission denied!")
-	// }
-
-	// distribute products in order
-	var productItemList []ProductCommercialItem
-	for _, item := range order.ProductItemList {
-		actor := parseUserToActor(user)
-		date := ProductDate{
-			Status: "DISTRIBUTING",
-			Time: txTimeAsPtr,
-			Actor: actor,
-		}
-		dates := append(item.Product.Dates, date)
-
-		// update product in chaincode
-		item.Product.Dates = dates
-		item.Product.Status = "DISTRIBUTING"
-
-		updatedProductAsBytes, _ := json.Marshal(item.Product)
-		ctx.GetStub().PutState(item.Product.ProductCommercialId, updatedProductAsBytes)
+	if order.Status != "APPROVED" {
+		return nil, fmt.Errorf("order %s is %s, only APPROVED orders can be shipped", order.OrderId, order.Status)
+	}
+	err = checkAssignedDistributor(order, user)
+	if err != nil {
+		return nil, err
+	}
 
-		// update updated products into order
-		productItem := ProductCommercialItem{
-			Product: item.Product,
-			Quantity: item.Quantity,
-		}
-		productItemList = append(productItemList, productItem)
+	// ship everything in a single shipment
+	_, err = dispatchShipment(ctx, user, order, remainingOrderItems(order), orderObj.DeliveryStatus.Address, orderObj.Signature, 0, txTimeAsPtr)
+	if err != nil {
+		return nil, err
 	}
 
 	actor := parseUserToActor(user)
@@ -1260,19 +2121,20 @@ func (s *SmartContract) UpdateOrder(ctx contractapi.TransactionContextInterface,
 	deliveryStatuses := append(order.DeliveryStatuses, delivery)
 
 	order.Signatures = append(order.Signatures, orderObj.Signature)
-	order.ProductItemList = productItemList
 	order.DeliveryStatuses = deliveryStatuses
-	order.Distributor = actor
-	order.UpdateDate = txTimeAsPtr
-	order.Status = "SHIPPING"
 
 	updateOrderAsBytes, _ := json.Marshal(order)
-	ctx.GetStub().PutState(order.OrderId, updateOrderAsBytes)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), updateOrderAsBytes)
 
 	return order, nil
 }
 
-func (s *SmartContract) FinishOrder(ctx contractapi.TransactionContextInterface, user User, orderObj OrderForUpdateFinish) (*Order, error) {
+func (s *SmartContract) FinishOrder(ctx contractapi.TransactionContextInterface, orderObj OrderForUpdateFinish) (*Order, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	if user.Role != "distributor" {
 		return nil, fmt.Errorf("user must be a distributor")
 	}
@@ -1282,7 +2144,7 @@ func (s *SmartContract) FinishOrder(ctx contractapi.TransactionContextInterface,
 		return nil, fmt.Errorf("transaction timeStamp error")
 	}
 
-	orderBytes, _ := ctx.GetStub().GetState(orderObj.OrderId)
+	orderBytes, _ := ctx.GetStub().GetState(orderKey(ctx, orderObj.OrderId))
 	if orderBytes == nil {
 		return nil, fmt.Errorf("cannot find this order")
 	}
@@ -1290,36 +2152,46 @@ func (s *SmartContract) FinishOrder(ctx contractapi.TransactionContextInterface,
 	order := new(Order)
 	_ = json.Unmarshal(orderBytes, order)
 
-	// if order.Distributor.UserId != user.UserId {
-	// 	return nil, fmt.Errorf("Permission denied!")
-	// }
-
-	// retailing products in order
-	var productItemList []ProductCommercialItem
-	for _, item := range order.ProductItemList {
-		actor := parseUserToActor(user)
-		date := ProductDate{
-			Status: "RETAILING",
-			Time: txTimeAsPtr,
-			Actor: actor,
-		}
-		dates := append(item.Product.Dates, date)
+	if order.Status != "SHIPPING" && order.Status != "PARTIALLY_SHIPPED" {
+		return nil, fmt.Errorf("order %s is %s, only SHIPPING or PARTIALLY_SHIPPED orders can be finished", order.OrderId, order.Status)
+	}
+	err = checkAssignedDistributor(order, user)
+	if err != nil {
+		return nil, err
+	}
 
-		// update product in chaincode
-		item.Product.Dates = dates
-		item.Product.Status = "RETAILING"
+	shipments, err := s.GetShipmentsOfOrder(ctx, order.OrderId)
+	if err != nil {
+		return nil, err
+	}
 
-		updatedProductAsBytes, _ := json.Marshal(item.Product)
-		ctx.GetStub().PutState(item.Product.ProductCommercialId, updatedProductAsBytes)
+	// whatever has not left yet goes in a last shipment, orders shipped before shipments existed included.
+	// The scan above cannot see it, writes only reach the ledger once the transaction commits.
+	remaining := remainingOrderItems(order)
+	if len(remaining) > 0 {
+		shipment, err := dispatchShipment(ctx, user, order, remaining, orderObj.DeliveryStatus.Address, orderObj.Signature, 0, txTimeAsPtr)
+		if err != nil {
+			return nil, err
+		}
+		shipments = append(shipments, shipment)
+	}
 
-		// update updated products into order
-		productItem := ProductCommercialItem{
-			Product: item.Product,
-			Quantity: item.Quantity,
+	book := newInventoryBook(ctx)
+	for _, shipment := range shipments {
+		// shipments still on the way with a distributor the order was taken from are theirs to deliver
+		if shipment.Status != "SHIPPING" || !isActor(shipment.Distributor, user) {
+			continue
+		}
+		err = deliverShipment(ctx, book, user, order, shipment, orderObj.DeliveryStatus.Address, orderObj.Signature, txTimeAsPtr)
+		if err != nil {
+			return nil, err
 		}
-		productItemList = append(productItemList, productItem)
 	}
-	
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
+
 	actor := parseUserToActor(user)
 	delivery := DeliveryStatus{
 		Status:        	"SHIPPED",
@@ -1329,157 +2201,3535 @@ func (s *SmartContract) FinishOrder(ctx contractapi.TransactionContextInterface,
 	}
 	deliveryStatuses := append(order.DeliveryStatuses, delivery)
 
-	order.Status = "SHIPPED"
-	order.FinishDate = txTimeAsPtr
-	order.ProductItemList = productItemList
 	order.DeliveryStatuses = deliveryStatuses
 	order.Signatures = append(order.Signatures, orderObj.Signature)
 
 	finishOrderAsBytes, _ := json.Marshal(order)
-	ctx.GetStub().PutState(order.OrderId, finishOrderAsBytes)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), finishOrderAsBytes)
 
 	return order, nil
 }
 
-func (s *SmartContract) GetProductTransactionHistory(ctx contractapi.TransactionContextInterface, productId string) ([]ProductHistory, error) {
-	resultsIterator, err := ctx.GetStub().GetHistoryForKey(productId)
-
-	if err != nil {
-		return nil, fmt.Errorf(err.Error())
-	}
-
-	defer resultsIterator.Close()
-	var histories []ProductHistory
-
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
+func shipmentKey(ctx contractapi.TransactionContextInterface, shipmentId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(shipmentObjectType, []string{shipmentId})
+	return key
+}
 
-		if err != nil {
-			return nil, err
+// remainingOrderItems returns the quantity of each item of the order that has not been dispatched yet
+func remainingOrderItems(order *Order) []OrderItemAmendment {
+	var remaining []OrderItemAmendment
+	for _, item := range order.ProductItemList {
+		ordered, _ := parseQuantity(item.Quantity)
+		shipped, _ := parseQuantity(item.ShippedQuantity)
+		if ordered > shipped {
+			remaining = append(remaining, OrderItemAmendment{
+				ProductCommercialId: item.Product.ProductCommercialId,
+				Quantity: formatQuantity(ordered - shipped),
+			})
 		}
+	}
+	return remaining
+}
 
-		var product Product
-		if len(response.Value) > 0 {
-			err = json.Unmarshal(response.Value, &product)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			product = Product{
-				ProductId: productId,
-			}
-		}
+// deriveOrderStatus sets the status of a shipping order from the quantities its shipments dispatched and delivered
+func deriveOrderStatus(order *Order) {
+	var ordered, shipped, delivered float64
+	for _, item := range order.ProductItemList {
+		itemOrdered, _ := parseQuantity(item.Quantity)
+		itemShipped, _ := parseQuantity(item.ShippedQuantity)
+		itemDelivered, _ := parseQuantity(item.DeliveredQuantity)
+		ordered += itemOrdered
+		shipped += itemShipped
+		delivered += itemDelivered
+	}
 
-		timestamp, err := ptypes.Timestamp(response.Timestamp)
-		if err != nil {
-			return nil, err
-		}
+	switch {
+	case delivered >= ordered:
+		order.Status = "SHIPPED"
+	case delivered > 0:
+		order.Status = "PARTIALLY_SHIPPED"
+	case shipped > 0:
+		order.Status = "SHIPPING"
+	}
+}
 
-		productHistory := ProductHistory{
-			Record: &product,
-			TransactionId: response.TxId,
-			Timestamp: timestamp,
-			IsDelete: response.IsDelete,
-		}
-		histories = append(histories, productHistory)
+// updateOrderItemProduct moves the ProductCommercial record of an order item to status and keeps the order's copy in step
+func updateOrderItemProduct(ctx contractapi.TransactionContextInterface, user User, order *Order, i int, status string, txTimeAsPtr string) error {
+	product := order.ProductItemList[i].Product
+	err := checkProductTransition(user, product.ProductCommercialId, product.Status, product.Dates, status)
+	if err != nil {
+		return err
 	}
 
-	if len(histories) == 0 {
-		return []ProductHistory{}, nil
+	actor := parseUserToActor(user)
+	date := ProductDate{
+		Status: status,
+		Time: txTimeAsPtr,
+		Actor: actor,
 	}
+	product.Dates = append(product.Dates, date)
+	product.Status = status
 
-	return histories, nil
+	productAsBytes, _ := json.Marshal(product)
+	ctx.GetStub().PutState(productCommercialKey(ctx, product.ProductCommercialId), productAsBytes)
+
+	order.ProductItemList[i].Product = product
+	return nil
 }
 
-func (s *SmartContract) GetProductCommercialTransactionHistory(ctx contractapi.TransactionContextInterface, productCommercialId string) ([]ProductCommercialHistory, error) {
-	resultsIterator, err := ctx.GetStub().GetHistoryForKey(productCommercialId)
+// dispatchShipment records a shipment of the given quantities of an order. Items leaving for the first time become DISTRIBUTING.
+// A retried submission with the same idempotency key returns the shipment the first one created and leaves the order
+// alone. The caller saves the order.
+func dispatchShipment(ctx contractapi.TransactionContextInterface, user User, order *Order, items []OrderItemAmendment, address string, signature string, index int, txTimeAsPtr string) (*Shipment, error) {
+	shipmentId, err := newAssetId(ctx, shipmentObjectType, index)
 	if err != nil {
-		return nil, fmt.Errorf(err.Error())
+		return nil, err
+	}
+	existingAsBytes, err := ctx.GetStub().GetState(shipmentKey(ctx, shipmentId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if existingAsBytes != nil {
+		existing := new(Shipment)
+		_ = json.Unmarshal(existingAsBytes, existing)
+		if existing.OrderId != order.OrderId {
+			return nil, fmt.Errorf("idempotency key already used for shipment %s of order %s", existing.ShipmentId, existing.OrderId)
+		}
+		return existing, nil
 	}
 
-	defer resultsIterator.Close()
-	var histories []ProductCommercialHistory
-
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
+	if len(items) == 0 {
+		return nil, fmt.Errorf("a shipment needs at least one item")
+	}
 
+	for _, shipped := range items {
+		quantity, err := parseQuantity(shipped.Quantity)
 		if err != nil {
 			return nil, err
 		}
+		if quantity <= 0 {
+			return nil, fmt.Errorf("shipped quantity of %s must be positive", shipped.ProductCommercialId)
+		}
 
-		var productCommercial ProductCommercial
-		if len(response.Value) > 0 {
-			err = json.Unmarshal(response.Value, &productCommercial)
+		found := false
+		for i, item := range order.ProductItemList {
+			if item.Product.ProductCommercialId != shipped.ProductCommercialId {
+				continue
+			}
+			found = true
+
+			ordered, err := parseQuantity(item.Quantity)
 			if err != nil {
 				return nil, err
 			}
-		} else {
-			productCommercial = ProductCommercial{
-				ProductCommercialId: productCommercialId,
+			alreadyShipped, err := parseQuantity(item.ShippedQuantity)
+			if err != nil {
+				return nil, err
 			}
-		}
+			if alreadyShipped+quantity > ordered {
+				return nil, fmt.Errorf("only %s of %s is left to ship", formatQuantity(ordered-alreadyShipped), shipped.ProductCommercialId)
+			}
+			order.ProductItemList[i].ShippedQuantity = formatQuantity(alreadyShipped + quantity)
 
-		timestamp, err := ptypes.Timestamp(response.Timestamp)
-		if err != nil {
-			return nil, err
+			if item.Product.Status == "EXPORTED" {
+				err = updateOrderItemProduct(ctx, user, order, i, "DISTRIBUTING", txTimeAsPtr)
+				if err != nil {
+					return nil, err
+				}
+			}
 		}
-
-		ProductCommercialHistory := ProductCommercialHistory{
-			Record: &productCommercial,
-			TransactionId: response.TxId,
-			Timestamp: timestamp,
-			IsDelete: response.IsDelete,
+		if !found {
+			return nil, fmt.Errorf("order %s has no item %s", order.OrderId, shipped.ProductCommercialId)
 		}
-		histories = append(histories, ProductCommercialHistory)
 	}
 
-	if len(histories) == 0 {
-		return []ProductCommercialHistory{}, nil
+	actor := parseUserToActor(user)
+	delivery := DeliveryStatus{
+		Status:        	"SHIPPING",
+		DeliveryDate:  	txTimeAsPtr,
+		Address: 		address,
+		Actor: 			actor,
 	}
 
-	return histories, nil
-}
+	shipment := Shipment{
+		ShipmentId: 		shipmentId,
+		OrderId: 			order.OrderId,
+		Items: 				items,
+		DeliveryStatuses: 	[]DeliveryStatus{delivery},
+		Signatures: 		[]string{signature},
+		Status: 			"SHIPPING",
+		Distributor: 		actor,
+		CreateDate: 		txTimeAsPtr,
+	}
 
-func (s *SmartContract) GetOrderTransactionHistory(ctx contractapi.TransactionContextInterface, orderId string) ([]OrderHistory, error) {
-	resultsIterator, err := ctx.GetStub().GetHistoryForKey(orderId)
+	shipmentAsBytes, _ := json.Marshal(shipment)
+	ctx.GetStub().PutState(shipmentKey(ctx, shipment.ShipmentId), shipmentAsBytes)
+	err = indexShipment(ctx, &shipment)
 	if err != nil {
-		return nil, fmt.Errorf(err.Error())
+		return nil, err
 	}
 
-	defer resultsIterator.Close()
-	var histories []OrderHistory
+	order.UpdateDate = txTimeAsPtr
+	deriveOrderStatus(order)
 
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
+	return &shipment, nil
+}
 
+// deliverShipment marks a shipment delivered and takes its quantities out of stock. Items whose whole quantity
+// has arrived become RETAILING. The price of the delivered items is recorded as the shipment's PaymentDue,
+// paid once the retailer confirms receipt. The caller saves the order and the book.
+func deliverShipment(ctx contractapi.TransactionContextInterface, book *inventoryBook, user User, order *Order, shipment *Shipment, address string, signature string, txTimeAsPtr string) error {
+	var payment int64
+	for _, delivered := range shipment.Items {
+		quantity, err := parseQuantity(delivered.Quantity)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		var order Order
-		if len(response.Value) > 0 {
-			err = json.Unmarshal(response.Value, &order)
+		for i, item := range order.ProductItemList {
+			if item.Product.ProductCommercialId != delivered.ProductCommercialId {
+				continue
+			}
+
+			ordered, err := parseQuantity(item.Quantity)
 			if err != nil {
-				return nil, err
+				return err
 			}
-		} else {
-			order = Order{
-				OrderId: orderId,
+			alreadyDelivered, err := parseQuantity(item.DeliveredQuantity)
+			if err != nil {
+				return err
+			}
+			order.ProductItemList[i].DeliveredQuantity = formatQuantity(alreadyDelivered + quantity)
+
+			amount, err := orderItemAmount(item.Product, quantity)
+			if err != nil {
+				return err
+			}
+			if payment > math.MaxInt64-amount {
+				return fmt.Errorf("payment of shipment %s would overflow", shipment.ShipmentId)
+			}
+			payment += amount
+
+			err = book.consume(item.Product.ProductId, quantity)
+			if err != nil {
+				return err
+			}
+
+			if alreadyDelivered+quantity >= ordered && item.Product.Status == "DISTRIBUTING" {
+				err = updateOrderItemProduct(ctx, user, order, i, "RETAILING", txTimeAsPtr)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	actor := parseUserToActor(user)
+	delivery := DeliveryStatus{
+		Status:        	"DELIVERED",
+		DeliveryDate:  	txTimeAsPtr,
+		Address: 		address,
+		Actor: 			actor,
+	}
+
+	shipment.DeliveryStatuses = append(shipment.DeliveryStatuses, delivery)
+	shipment.Signatures = append(shipment.Signatures, signature)
+	shipment.Status = "DELIVERED"
+	shipment.FinishDate = txTimeAsPtr
+	shipment.PaymentDue = payment
+
+	shipmentAsBytes, _ := json.Marshal(shipment)
+	ctx.GetStub().PutState(shipmentKey(ctx, shipment.ShipmentId), shipmentAsBytes)
+
+	order.UpdateDate = txTimeAsPtr
+	order.FinishDate = txTimeAsPtr
+	deriveOrderStatus(order)
+
+	return nil
+}
+
+func (s *SmartContract) GetShipment(ctx contractapi.TransactionContextInterface, shipmentId string) (*Shipment, error) {
+	shipmentAsBytes, err := ctx.GetStub().GetState(shipmentKey(ctx, shipmentId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if shipmentAsBytes == nil {
+		return nil, fmt.Errorf("%s does not exist", shipmentId)
+	}
+
+	shipment := new(Shipment)
+	_ = json.Unmarshal(shipmentAsBytes, shipment)
+
+	return shipment, nil
+}
+
+const shipmentByOrderIndex = "ShipmentByOrder"
+
+// indexShipment lists a shipment under its order
+func indexShipment(ctx contractapi.TransactionContextInterface, shipment *Shipment) error {
+	key, _ := ctx.GetStub().CreateCompositeKey(shipmentByOrderIndex, []string{shipment.OrderId, shipment.ShipmentId})
+	err := ctx.GetStub().PutState(key, []byte(shipment.ShipmentId))
+	if err != nil {
+		return fmt.Errorf("failed to index shipment %s: %s", shipment.ShipmentId, err.Error())
+	}
+	return nil
+}
+
+// buildShipmentByOrderIndex indexes the shipments dispatched before the ShipmentByOrder index existed
+func buildShipmentByOrderIndex(ctx contractapi.TransactionContextInterface) (int, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(shipmentObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	indexed := 0
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		shipment := new(Shipment)
+		_ = json.Unmarshal(response.Value, shipment)
+		err = indexShipment(ctx, shipment)
+		if err != nil {
+			return 0, err
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+// GetShipmentsOfOrder lists the shipments of an order. Shipments dispatched before they were indexed by order are
+// only listed once RebuildIndex has run for ShipmentByOrder.
+func (s *SmartContract) GetShipmentsOfOrder(ctx contractapi.TransactionContextInterface, orderId string) ([]*Shipment, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(shipmentByOrderIndex, []string{orderId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	shipments := []*Shipment{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		shipment, err := s.GetShipment(ctx, string(response.Value))
+		if err != nil {
+			return nil, err
+		}
+		shipments = append(shipments, shipment)
+	}
+
+	return shipments, nil
+}
+
+// CreateShipment dispatches part of an approved order. The order becomes SHIPPING, PARTIALLY_SHIPPED or SHIPPED
+// depending on what its shipments carried and delivered so far.
+func (s *SmartContract) CreateShipment(ctx contractapi.TransactionContextInterface, shipmentObj ShipmentForCreate) (*Shipment, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "distributor" {
+		return nil, fmt.Errorf("user must be a distributor")
+	}
+
+	order, err := s.GetOrder(ctx, shipmentObj.OrderId)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Status != "APPROVED" && order.Status != "SHIPPING" && order.Status != "PARTIALLY_SHIPPED" {
+		return nil, fmt.Errorf("order %s is %s, only APPROVED, SHIPPING or PARTIALLY_SHIPPED orders can be shipped", order.OrderId, order.Status)
+	}
+	err = checkAssignedDistributor(order, user)
+	if err != nil {
+		return nil, err
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	shipment, err := dispatchShipment(ctx, user, order, shipmentObj.Items, shipmentObj.DeliveryStatus.Address, shipmentObj.Signature, 0, txTimeAsPtr)
+	if err != nil {
+		return nil, err
+	}
+
+	orderAsBytes, _ := json.Marshal(order)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+
+	return shipment, nil
+}
+
+// TrackShipment lets the distributor carrying a shipment add a step, such as a hand-over between trucks, to its trail
+func (s *SmartContract) TrackShipment(ctx contractapi.TransactionContextInterface, shipmentObj ShipmentForUpdate, status string) (*Shipment, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "distributor" {
+		return nil, fmt.Errorf("user must be a distributor")
+	}
+
+	shipment, err := s.GetShipment(ctx, shipmentObj.ShipmentId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isActor(shipment.Distributor, user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+	if shipment.Status != "SHIPPING" {
+		return nil, fmt.Errorf("shipment %s is %s and can no longer be tracked", shipment.ShipmentId, shipment.Status)
+	}
+	if status == "" || status == "SHIPPING" || status == "DELIVERED" || status == "RECEIVED" {
+		return nil, fmt.Errorf("invalid tracking status %s", status)
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	actor := parseUserToActor(user)
+	delivery := DeliveryStatus{
+		Status:        	status,
+		DeliveryDate:  	txTimeAsPtr,
+		Address: 		shipmentObj.DeliveryStatus.Address,
+		Actor: 			actor,
+	}
+
+	shipment.DeliveryStatuses = append(shipment.DeliveryStatuses, delivery)
+	if shipmentObj.Signature != "" {
+		shipment.Signatures = append(shipment.Signatures, shipmentObj.Signature)
+	}
+
+	shipmentAsBytes, _ := json.Marshal(shipment)
+	ctx.GetStub().PutState(shipmentKey(ctx, shipment.ShipmentId), shipmentAsBytes)
+
+	return shipment, nil
+}
+
+// payShipment pays what a received shipment is due, out of the order's escrow or, for orders placed before escrow,
+// out of the allowance the retailer gave the manufacturer. The caller saves the order.
+func payShipment(ctx contractapi.TransactionContextInterface, order *Order, shipment *Shipment, txTimeAsPtr string) error {
+	distributor := shipment.Distributor
+	if distributor.UserId == "" {
+		distributor = order.Distributor
+	}
+	escrowed, err := releaseOrderPayment(ctx, order, distributor, shipment.PaymentDue, txTimeAsPtr)
+	if err != nil {
+		return err
+	}
+	tokenConfig, err := getTokenConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if !escrowed && tokenConfig != nil && shipment.PaymentDue > 0 {
+		manufacturer := actorAccount(order.Manufacturer)
+		err = spendAllowance(ctx, actorAccount(order.Retailer), manufacturer, manufacturer, shipment.PaymentDue)
+		if err != nil {
+			return err
+		}
+	}
+	if escrowed || tokenConfig != nil {
+		order.PaidAmount += shipment.PaymentDue
+	}
+	return nil
+}
+
+// checkAssignedDistributor refuses anyone but the distributor the manufacturer assigned to the order
+func checkAssignedDistributor(order *Order, user User) error {
+	if order.Distributor.UserId == "" {
+		return fmt.Errorf("order %s has no distributor assigned", order.OrderId)
+	}
+	if !isActor(order.Distributor, user) {
+		return fmt.Errorf("Permission denied!")
+	}
+	return nil
+}
+
+// AssignDistributor names the distributor who ships an approved order, only the manufacturer who approved it may.
+// Shipments already on their way stay with the distributor who dispatched them.
+func (s *SmartContract) AssignDistributor(ctx contractapi.TransactionContextInterface, orderId string, distributorMspId string, distributorId string) (*Order, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "manufacturer" {
+		return nil, fmt.Errorf("user must be a manufacturer")
+	}
+
+	order, err := s.GetOrder(ctx, orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isActor(order.Manufacturer, user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+	if order.Status != "APPROVED" && order.Status != "SHIPPING" && order.Status != "PARTIALLY_SHIPPED" {
+		return nil, fmt.Errorf("order %s is %s, only APPROVED, SHIPPING or PARTIALLY_SHIPPED orders can be assigned a distributor", order.OrderId, order.Status)
+	}
+
+	key, err := userIdentityKey(ctx, distributorMspId, distributorId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user key: %s", err.Error())
+	}
+	distributorAsBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if distributorAsBytes == nil {
+		return nil, fmt.Errorf("identity %s of %s is not registered", distributorId, distributorMspId)
+	}
+	var distributor User
+	_ = json.Unmarshal(distributorAsBytes, &distributor)
+	if distributor.Role != "distributor" {
+		return nil, fmt.Errorf("%s is not a distributor", distributorId)
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	order.Distributor = parseUserToActor(distributor)
+	order.UpdateDate = txTimeAsPtr
+
+	orderAsBytes, _ := json.Marshal(order)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+
+	return order, nil
+}
+
+// DeliverShipment records the arrival of a shipment at the retailer
+func (s *SmartContract) DeliverShipment(ctx contractapi.TransactionContextInterface, shipmentObj ShipmentForUpdate) (*Shipment, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "distributor" {
+		return nil, fmt.Errorf("user must be a distributor")
+	}
+
+	shipment, err := s.GetShipment(ctx, shipmentObj.ShipmentId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isActor(shipment.Distributor, user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+	if shipment.Status != "SHIPPING" {
+		return nil, fmt.Errorf("shipment %s is %s, only SHIPPING shipments can be delivered", shipment.ShipmentId, shipment.Status)
+	}
+
+	order, err := s.GetOrder(ctx, shipment.OrderId)
+	if err != nil {
+		return nil, err
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	book := newInventoryBook(ctx)
+	err = deliverShipment(ctx, book, user, order, shipment, shipmentObj.DeliveryStatus.Address, shipmentObj.Signature, txTimeAsPtr)
+	if err != nil {
+		return nil, err
+	}
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
+
+	orderAsBytes, _ := json.Marshal(order)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+
+	return shipment, nil
+}
+
+// ConfirmShipmentReceipt lets the retailer of the order confirm a delivered shipment arrived.
+// This releases what the shipment is due to the manufacturer and the distributor.
+func (s *SmartContract) ConfirmShipmentReceipt(ctx contractapi.TransactionContextInterface, shipmentObj ShipmentForUpdate) (*Shipment, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "retailer" {
+		return nil, fmt.Errorf("user must be a retailer")
+	}
+
+	shipment, err := s.GetShipment(ctx, shipmentObj.ShipmentId)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := s.GetOrder(ctx, shipment.OrderId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isActor(order.Retailer, user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+	if shipment.Status != "DELIVERED" || shipment.ReceiveDate != "" {
+		return nil, fmt.Errorf("shipment %s is %s, only DELIVERED shipments can be confirmed", shipment.ShipmentId, shipment.Status)
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	err = payShipment(ctx, order, shipment, txTimeAsPtr)
+	if err != nil {
+		return nil, err
+	}
+
+	actor := parseUserToActor(user)
+	delivery := DeliveryStatus{
+		Status:        	"RECEIVED",
+		DeliveryDate:  	txTimeAsPtr,
+		Address: 		shipmentObj.DeliveryStatus.Address,
+		Actor: 			actor,
+	}
+
+	shipment.DeliveryStatuses = append(shipment.DeliveryStatuses, delivery)
+	if shipmentObj.Signature != "" {
+		shipment.Signatures = append(shipment.Signatures, shipmentObj.Signature)
+	}
+	shipment.Status = "RECEIVED"
+	shipment.ReceiveDate = txTimeAsPtr
+
+	shipmentAsBytes, _ := json.Marshal(shipment)
+	ctx.GetStub().PutState(shipmentKey(ctx, shipment.ShipmentId), shipmentAsBytes)
+
+	order.UpdateDate = txTimeAsPtr
+	orderAsBytes, _ := json.Marshal(order)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+
+	return shipment, nil
+}
+
+const orderConfigKey = "OrderConfig"
+
+const defaultPendingOrderTTLHours = 72
+
+// txTimeLayout parses the timestamps written by GetTxTimestampChannel
+const txTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+func getTxTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	txTime, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("transaction timeStamp error")
+	}
+	return time.Unix(txTime.Seconds, int64(txTime.Nanos)), nil
+}
+
+func getOrderConfig(ctx contractapi.TransactionContextInterface) OrderConfig {
+	config := OrderConfig{PendingOrderTTLHours: defaultPendingOrderTTLHours}
+	configAsBytes, _ := ctx.GetStub().GetState(orderConfigKey)
+	if configAsBytes != nil {
+		_ = json.Unmarshal(configAsBytes, &config)
+	}
+	return config
+}
+
+func lastDeliveryAddress(order *Order) string {
+	if len(order.DeliveryStatuses) == 0 {
+		return ""
+	}
+	return order.DeliveryStatuses[len(order.DeliveryStatuses)-1].Address
+}
+
+// rollbackOrderItems undoes what an order did to the ProductCommercial records CreateOrder minted for it.
+// Closed orders lose their records, amended ones only the EXPORTED step their approval added.
+func rollbackOrderItems(ctx contractapi.TransactionContextInterface, order *Order, remove bool) error {
+	for i, item := range order.ProductItemList {
+		key := productCommercialKey(ctx, item.Product.ProductCommercialId)
+		if remove {
+			err := removeProductCommercial(ctx, order, &item.Product)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		dates := item.Product.Dates
+		if item.Product.Status != "EXPORTED" || len(dates) < 2 || dates[len(dates)-1].Status != "EXPORTED" {
+			continue
+		}
+		item.Product.Dates = dates[:len(dates)-1]
+		item.Product.Status = dates[len(dates)-2].Status
+
+		productAsBytes, _ := json.Marshal(item.Product)
+		err := ctx.GetStub().PutState(key, productAsBytes)
+		if err != nil {
+			return fmt.Errorf("failed to roll back %s: %s", item.Product.ProductCommercialId, err.Error())
+		}
+		order.ProductItemList[i] = item
+	}
+	return nil
+}
+
+// removeProductCommercial deletes a ProductCommercial made for an order along with its ProductCommercialByProduct
+// entry and its place in the sequence number queue, which CreateOrder filled in the transaction that created the order
+func removeProductCommercial(ctx contractapi.TransactionContextInterface, order *Order, productCommercial *ProductCommercial) error {
+	err := ctx.GetStub().DelState(productCommercialKey(ctx, productCommercial.ProductCommercialId))
+	if err != nil {
+		return fmt.Errorf("failed to remove %s: %s", productCommercial.ProductCommercialId, err.Error())
+	}
+
+	indexKey, err := ctx.GetStub().CreateCompositeKey(productCommercialByProductIndex, []string{productCommercial.ProductId, productCommercial.ProductCommercialId})
+	if err != nil {
+		return fmt.Errorf("failed to create index key: %s", err.Error())
+	}
+	err = ctx.GetStub().DelState(indexKey)
+	if err != nil {
+		return fmt.Errorf("failed to unindex %s: %s", productCommercial.ProductCommercialId, err.Error())
+	}
+
+	// the queue entry of an order whose CreateDate cannot be read is left to AssignSequenceNumbers
+	createdAt, err := time.Parse(txTimeLayout, order.CreateDate)
+	if err != nil {
+		return nil
+	}
+	return dequeueSequenceNumber(ctx, productCommercialObjectType, createdAt, productCommercial.ProductCommercialId)
+}
+
+// CancelOrder lets the retailer who placed an order withdraw it before it is approved
+func (s *SmartContract) CancelOrder(ctx contractapi.TransactionContextInterface, orderId string) (*Order, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "retailer" {
+		return nil, fmt.Errorf("user must be a retailer")
+	}
+
+	order, err := s.GetOrder(ctx, orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isActor(order.Retailer, user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+	if order.Status != "PENDING" {
+		return nil, fmt.Errorf("order %s is %s, only PENDING orders can be cancelled", order.OrderId, order.Status)
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	err = rollbackOrderItems(ctx, order, true)
+	if err != nil {
+		return nil, err
+	}
+
+	book := newInventoryBook(ctx)
+	err = releaseOrderReservations(book, order)
+	if err != nil {
+		return nil, err
+	}
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
+
+	err = refundOrderPayment(ctx, order, txTimeAsPtr)
+	if err != nil {
+		return nil, err
+	}
+
+	actor := parseUserToActor(user)
+	delivery := DeliveryStatus{
+		Status:        	"CANCELLED",
+		DeliveryDate:  	txTimeAsPtr,
+		Address: 		actor.Address,
+		Actor: 			actor,
+	}
+
+	order.DeliveryStatuses = append(order.DeliveryStatuses, delivery)
+	order.UpdateDate = txTimeAsPtr
+	order.FinishDate = txTimeAsPtr
+	order.Status = "CANCELLED"
+
+	orderAsBytes, _ := json.Marshal(order)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+
+	return order, nil
+}
+
+// AmendOrder changes item quantities and the delivery address of an order that has not shipped yet.
+// The order goes back to PENDING and has to be approved again.
+func (s *SmartContract) AmendOrder(ctx contractapi.TransactionContextInterface, orderObj OrderForAmend) (*Order, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "retailer" {
+		return nil, fmt.Errorf("user must be a retailer")
+	}
+
+	order, err := s.GetOrder(ctx, orderObj.OrderId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isActor(order.Retailer, user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+	if order.Status != "PENDING" && order.Status != "APPROVED" {
+		return nil, fmt.Errorf("order %s is %s, only PENDING or APPROVED orders can be amended", order.OrderId, order.Status)
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	// reservations follow the new quantities
+	book := newInventoryBook(ctx)
+	for _, amendment := range orderObj.Items {
+		quantity, err := parseQuantity(amendment.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		if quantity <= 0 {
+			return nil, fmt.Errorf("ordered quantity of %s must be positive", amendment.ProductCommercialId)
+		}
+
+		found := false
+		for i, item := range order.ProductItemList {
+			if item.Product.ProductCommercialId != amendment.ProductCommercialId {
+				continue
+			}
+			found = true
+
+			previous, err := parseQuantity(item.Quantity)
+			if err != nil {
+				return nil, err
+			}
+			if quantity > previous {
+				err = book.reserve(item.Product.ProductId, quantity-previous)
+			} else {
+				err = book.release(item.Product.ProductId, previous-quantity)
+			}
+			if err != nil {
+				return nil, err
+			}
+			order.ProductItemList[i].Quantity = amendment.Quantity
+		}
+		if !found {
+			return nil, fmt.Errorf("order %s has no item %s", order.OrderId, amendment.ProductCommercialId)
+		}
+	}
+
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
+
+	err = rollbackOrderItems(ctx, order, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// the escrow follows the new total
+	err = lockOrderPayment(ctx, order, txTimeAsPtr)
+	if err != nil {
+		return nil, err
+	}
+
+	address := orderObj.DeliveryStatus.Address
+	if address == "" {
+		address = lastDeliveryAddress(order)
+	}
+
+	actor := parseUserToActor(user)
+	delivery := DeliveryStatus{
+		Status:        	"AMENDED",
+		DeliveryDate:  	txTimeAsPtr,
+		Address: 		address,
+		Actor: 			actor,
+	}
+
+	order.DeliveryStatuses = append(order.DeliveryStatuses, delivery)
+	order.Manufacturer = Actor{}
+	order.Distributor = Actor{}
+	order.UpdateDate = txTimeAsPtr
+	order.Status = "PENDING"
+
+	orderAsBytes, _ := json.Marshal(order)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+
+	return order, nil
+}
+
+// SetOrderConfig changes the settings of the order flow
+func (s *SmartContract) SetOrderConfig(ctx contractapi.TransactionContextInterface, config OrderConfig) (*OrderConfig, error) {
+	_, _, role, err := getClientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role != "admin" {
+		return nil, fmt.Errorf("user must be an admin")
+	}
+
+	if config.PendingOrderTTLHours <= 0 {
+		return nil, fmt.Errorf("pendingOrderTtlHours must be positive")
+	}
+	if config.DistributorFeeBps < 0 || config.DistributorFeeBps > 10000 {
+		return nil, fmt.Errorf("distributorFeeBps must be between 0 and 10000")
+	}
+
+	configAsBytes, _ := json.Marshal(config)
+	err = ctx.GetStub().PutState(orderConfigKey, configAsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save order config: %s", err.Error())
+	}
+
+	return &config, nil
+}
+
+func (s *SmartContract) GetOrderConfig(ctx contractapi.TransactionContextInterface) (*OrderConfig, error) {
+	config := getOrderConfig(ctx)
+	return &config, nil
+}
+
+// ExpireStaleOrders closes up to limit orders left PENDING for longer than the configured deadline,
+// counted from their creation or last amendment. Any registered user may run it. It returns the number of orders expired.
+func (s *SmartContract) ExpireStaleOrders(ctx contractapi.TransactionContextInterface, limit int) (int, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return 0, fmt.Errorf("transaction timeStamp error")
+	}
+	deadline := now.Add(-time.Duration(getOrderConfig(ctx).PendingOrderTTLHours) * time.Hour)
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	book := newInventoryBook(ctx)
+	expired := 0
+	for resultsIterator.HasNext() && expired < limit {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		order := new(Order)
+		_ = json.Unmarshal(response.Value, order)
+		if order.Status != "PENDING" {
+			continue
+		}
+
+		lastChange := order.CreateDate
+		if order.UpdateDate != "" {
+			lastChange = order.UpdateDate
+		}
+		changedAt, err := time.Parse(txTimeLayout, lastChange)
+		if err != nil || !changedAt.Before(deadline) {
+			continue
+		}
+
+		err = rollbackOrderItems(ctx, order, true)
+		if err != nil {
+			return 0, err
+		}
+		err = releaseOrderReservations(book, order)
+		if err != nil {
+			return 0, err
+		}
+		err = refundOrderPayment(ctx, order, txTimeAsPtr)
+		if err != nil {
+			return 0, err
+		}
+
+		actor := parseUserToActor(user)
+		delivery := DeliveryStatus{
+			Status:        	"EXPIRED",
+			DeliveryDate:  	txTimeAsPtr,
+			Address: 		lastDeliveryAddress(order),
+			Actor: 			actor,
+		}
+
+		order.DeliveryStatuses = append(order.DeliveryStatuses, delivery)
+		order.UpdateDate = txTimeAsPtr
+		order.FinishDate = txTimeAsPtr
+		order.Status = "EXPIRED"
+
+		orderAsBytes, _ := json.Marshal(order)
+		err = ctx.GetStub().PutState(response.Key, orderAsBytes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to expire order %s: %s", order.OrderId, err.Error())
+		}
+		expired++
+	}
+
+	err = book.save()
+	if err != nil {
+		return 0, err
+	}
+
+	return expired, nil
+}
+
+func parseQuantity(quantity string) (float64, error) {
+	if quantity == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(quantity, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %s", quantity)
+	}
+	return value, nil
+}
+
+func formatQuantity(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Inventory is the stock of a product held by its owner. Available stock is OnHand - Reserved.
+type Inventory struct {
+	ProductId 	string 	`json:"productId"`
+	OwnerId 	string 	`json:"ownerId"`
+	OwnerMSPID 	string 	`json:"ownerMspId" metadata:",optional"`
+	Unit 		string 	`json:"unit"`
+	OnHand 		float64 `json:"onHand"`
+	Reserved 	float64 `json:"reserved"` // held by orders not delivered yet
+	Shipped 	float64 `json:"shipped"` // delivered to retailers, less what came back
+	Available 	float64 `json:"available"`
+}
+
+// inventoryKey files stock under the MSP and ID of its owner, a user ID alone is only unique within its MSP
+func inventoryKey(ctx contractapi.TransactionContextInterface, owner TokenAccount, productId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(inventoryObjectType, []string{owner.MSPID, owner.UserId, productId})
+	return key
+}
+
+// legacyInventoryKey is where stock was kept before its key carried the owner's MSP
+func legacyInventoryKey(ctx contractapi.TransactionContextInterface, ownerId string, productId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(inventoryObjectType, []string{ownerId, productId})
+	return key
+}
+
+func inventoryOwner(inventory *Inventory) TokenAccount {
+	return TokenAccount{MSPID: inventory.OwnerMSPID, UserId: inventory.OwnerId}
+}
+
+// inventoryBook collects the inventory changes of a transaction. A transaction does not read its own writes,
+// so every record is loaded once and written back by save. Inventory is kept under the user holding the product.
+type inventoryBook struct {
+	ctx 		contractapi.TransactionContextInterface
+	records 	map[string]*Inventory
+	products 	map[string]*Product
+	untracked 	map[string]bool // product keys overwritten with ProductCommercial data by the legacy transactions
+	loaded 		map[string]string // key each record was read from, replaced on save when the record moved
+}
+
+func newInventoryBook(ctx contractapi.TransactionContextInterface) *inventoryBook {
+	return &inventoryBook{
+		ctx: ctx,
+		records: map[string]*Inventory{},
+		products: map[string]*Product{},
+		untracked: map[string]bool{},
+		loaded: map[string]string{},
+	}
+}
+
+// add registers the inventory of a product created by this transaction, its Amount is the stock on hand
+func (b *inventoryBook) add(product *Product) error {
+	onHand, err := parseQuantity(product.Amount)
+	if err != nil {
+		return err
+	}
+	holder := productHolder(product)
+	b.products[product.ProductId] = product
+	b.records[product.ProductId] = &Inventory{
+		ProductId: product.ProductId,
+		OwnerId: holder.UserId,
+		OwnerMSPID: holder.MSPID,
+		Unit: product.Unit,
+		OnHand: onHand,
+	}
+	return nil
+}
+
+// get loads the inventory of a product. Products created before inventory was tracked start with their Amount on hand.
+func (b *inventoryBook) get(productId string) (*Inventory, error) {
+	inventory, err := b.lookup(productId)
+	if err != nil {
+		return nil, err
+	}
+	if inventory == nil {
+		return nil, fmt.Errorf("product %s was overwritten by a commercial product and has no inventory", productId)
+	}
+	return inventory, nil
+}
+
+// lookup is get for stock movements of existing orders, it returns nil for a product key that holds
+// ProductCommercial data, whose stock can no longer be tracked
+func (b *inventoryBook) lookup(productId string) (*Inventory, error) {
+	if inventory, ok := b.records[productId]; ok {
+		return inventory, nil
+	}
+	if b.untracked[productId] {
+		return nil, nil
+	}
+
+	productAsBytes, err := b.ctx.GetStub().GetState(productKey(b.ctx, productId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if productAsBytes == nil {
+		return nil, fmt.Errorf("product %s does not exist", productId)
+	}
+	var commercial struct {
+		ProductCommercialId string `json:"productCommercialId"`
+	}
+	_ = json.Unmarshal(productAsBytes, &commercial)
+	if commercial.ProductCommercialId != "" {
+		b.untracked[productId] = true
+		return nil, nil
+	}
+	product := new(Product)
+	_ = json.Unmarshal(productAsBytes, product)
+
+	// stock recorded before its key carried the owner's MSP stays under the holder's ID, or the supplier's from before
+	// inventory followed the holder, until it is next touched
+	holder := productHolder(product)
+	var inventoryAsBytes []byte
+	var key string
+	for _, candidate := range []string{
+		inventoryKey(b.ctx, actorAccount(holder), productId),
+		legacyInventoryKey(b.ctx, holder.UserId, productId),
+		legacyInventoryKey(b.ctx, product.Supplier.UserId, productId),
+	} {
+		inventoryAsBytes, err = b.ctx.GetStub().GetState(candidate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+		}
+		if inventoryAsBytes != nil {
+			key = candidate
+			break
+		}
+	}
+	if inventoryAsBytes == nil {
+		err = b.add(product)
+		if err != nil {
+			return nil, err
+		}
+		return b.records[productId], nil
+	}
+
+	inventory := new(Inventory)
+	_ = json.Unmarshal(inventoryAsBytes, inventory)
+	b.products[productId] = product
+	b.records[productId] = inventory
+	b.loaded[productId] = key
+	b.handOver(product)
+	return inventory, nil
+}
+
+// handOver files the inventory of a product under the user now holding it. product is the record as this
+// transaction leaves it, loaded already.
+func (b *inventoryBook) handOver(product *Product) {
+	inventory := b.records[product.ProductId]
+	b.products[product.ProductId] = product
+	holder := productHolder(product)
+	inventory.OwnerId = holder.UserId
+	inventory.OwnerMSPID = holder.MSPID
+}
+
+// reserve holds quantity of a product for an order, failing if not enough is available
+func (b *inventoryBook) reserve(productId string, quantity float64) error {
+	inventory, err := b.get(productId)
+	if err != nil {
+		return err
+	}
+	if quantity > inventory.OnHand-inventory.Reserved {
+		return fmt.Errorf("insufficient stock of %s: %s %s available, %s requested", productId, formatQuantity(inventory.OnHand-inventory.Reserved), inventory.Unit, formatQuantity(quantity))
+	}
+	inventory.Reserved += quantity
+	return nil
+}
+
+func (b *inventoryBook) release(productId string, quantity float64) error {
+	inventory, err := b.lookup(productId)
+	if err != nil || inventory == nil {
+		return err
+	}
+	inventory.Reserved = math.Max(inventory.Reserved-quantity, 0)
+	return nil
+}
+
+// consume takes delivered quantity out of stock along with its reservation
+func (b *inventoryBook) consume(productId string, quantity float64) error {
+	inventory, err := b.lookup(productId)
+	if err != nil || inventory == nil {
+		return err
+	}
+	inventory.Reserved = math.Max(inventory.Reserved-quantity, 0)
+	inventory.OnHand -= quantity
+	inventory.Shipped += quantity
+	return nil
+}
+
+// restock puts returned quantity back on hand
+func (b *inventoryBook) restock(productId string, quantity float64) error {
+	inventory, err := b.lookup(productId)
+	if err != nil || inventory == nil {
+		return err
+	}
+	inventory.OnHand += quantity
+	inventory.Shipped = math.Max(inventory.Shipped-quantity, 0)
+	return nil
+}
+
+func (b *inventoryBook) setOnHand(productId string, onHand float64) error {
+	inventory, err := b.get(productId)
+	if err != nil {
+		return err
+	}
+	if onHand < inventory.Reserved {
+		return fmt.Errorf("%s of %s is reserved by orders, stock cannot drop to %s", formatQuantity(inventory.Reserved), productId, formatQuantity(onHand))
+	}
+	inventory.OnHand = onHand
+	return nil
+}
+
+// save writes every inventory record touched and keeps the Amount of their products equal to the stock on hand
+func (b *inventoryBook) save() error {
+	for productId, inventory := range b.records {
+		inventory.Available = inventory.OnHand - inventory.Reserved
+		inventoryAsBytes, _ := json.Marshal(inventory)
+		key := inventoryKey(b.ctx, inventoryOwner(inventory), productId)
+		err := b.ctx.GetStub().PutState(key, inventoryAsBytes)
+		if err != nil {
+			return fmt.Errorf("failed to save inventory of %s: %s", productId, err.Error())
+		}
+		if previousKey, ok := b.loaded[productId]; ok && previousKey != key {
+			err = b.ctx.GetStub().DelState(previousKey)
+			if err != nil {
+				return fmt.Errorf("failed to move inventory of %s: %s", productId, err.Error())
+			}
+		}
+
+		product := b.products[productId]
+		if product.Amount == formatQuantity(inventory.OnHand) {
+			continue
+		}
+		product.Amount = formatQuantity(inventory.OnHand)
+		productAsBytes, _ := json.Marshal(product)
+		err = b.ctx.GetStub().PutState(productKey(b.ctx, productId), productAsBytes)
+		if err != nil {
+			return fmt.Errorf("failed to update product %s: %s", productId, err.Error())
+		}
+	}
+	return nil
+}
+
+// releaseOrderReservations gives back the stock an order still holds
+func releaseOrderReservations(book *inventoryBook, order *Order) error {
+	for _, item := range order.ProductItemList {
+		ordered, err := parseQuantity(item.Quantity)
+		if err != nil {
+			return err
+		}
+		delivered, err := parseQuantity(item.DeliveredQuantity)
+		if err != nil {
+			return err
+		}
+		err = book.release(item.Product.ProductId, ordered-delivered)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetInventory returns the stock of a product
+func (s *SmartContract) GetInventory(ctx contractapi.TransactionContextInterface, productId string) (*Inventory, error) {
+	inventory, err := newInventoryBook(ctx).get(productId)
+	if err != nil {
+		return nil, err
+	}
+	inventory.Available = inventory.OnHand - inventory.Reserved
+	return inventory, nil
+}
+
+// GetInventoryOfOwner returns the stock of every product a user of an MSP holds. Products that never had stock
+// movements since inventory was tracked, or last moved before inventory was kept under the holder's MSP and ID,
+// are only reported by GetInventory.
+func (s *SmartContract) GetInventoryOfOwner(ctx contractapi.TransactionContextInterface, ownerMspId string, ownerId string) ([]*Inventory, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(inventoryObjectType, []string{ownerMspId, ownerId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	inventories := []*Inventory{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var inventory Inventory
+		_ = json.Unmarshal(response.Value, &inventory)
+		inventories = append(inventories, &inventory)
+	}
+
+	return inventories, nil
+}
+
+// expiryLayouts are the forms an expireTime may take. A bare date expires at the end of that day, UTC.
+var expiryLayouts = []string{time.RFC3339, txTimeLayout, "2006-01-02"}
+
+// parseExpiry reads an expireTime, ok is false for a product that does not expire
+func parseExpiry(expired string) (time.Time, bool, error) {
+	if expired == "" {
+		return time.Time{}, false, nil
+	}
+	for _, layout := range expiryLayouts {
+		expiresAt, err := time.Parse(layout, expired)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" {
+			expiresAt = expiresAt.AddDate(0, 0, 1)
+		}
+		return expiresAt, true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid expireTime %s, expected YYYY-MM-DD or RFC 3339", expired)
+}
+
+// checkNotExpired refuses stock that has expired by now. Free-text values written before expiry was
+// validated cannot be read and are not enforced.
+func checkNotExpired(productId string, expired string, now time.Time) error {
+	expiresAt, ok, err := parseExpiry(expired)
+	if err != nil || !ok {
+		return nil
+	}
+	if !now.Before(expiresAt) {
+		return fmt.Errorf("product %s expired at %s", productId, expired)
+	}
+	return nil
+}
+
+const productByCodeIndex = "ProductByCode"
+
+// productByCodeKey indexes a MANUFACTURED product under its code and expiry, so the products of a code are listed
+// soonest expiry first. Products without a readable expiry sort last.
+func productByCodeKey(ctx contractapi.TransactionContextInterface, product *Product) string {
+	expiry := "never"
+	if expiresAt, ok, err := parseExpiry(product.Expired); err == nil && ok {
+		expiry = expiresAt.UTC().Format(time.RFC3339)
+	}
+	key, _ := ctx.GetStub().CreateCompositeKey(productByCodeIndex, []string{product.ProductCode, expiry, product.ProductId})
+	return key
+}
+
+// indexProductByCode keeps the ProductByCode entry of a product in step with its code and expiry.
+// previous is the product as stored before this transaction, nil if it was not MANUFACTURED yet.
+func indexProductByCode(ctx contractapi.TransactionContextInterface, previous *Product, product *Product) error {
+	key := productByCodeKey(ctx, product)
+	if previous != nil && previous.Status == "MANUFACTURED" {
+		if previousKey := productByCodeKey(ctx, previous); previousKey != key {
+			err := ctx.GetStub().DelState(previousKey)
+			if err != nil {
+				return fmt.Errorf("failed to update product index: %s", err.Error())
+			}
+		}
+	}
+	if product.Status != "MANUFACTURED" {
+		return nil
+	}
+	err := ctx.GetStub().PutState(key, []byte(product.ProductId))
+	if err != nil {
+		return fmt.Errorf("failed to update product index: %s", err.Error())
+	}
+	return nil
+}
+
+// productManufacturer returns the user who manufactured a product from its dates, the latest entry counts.
+// A ProductCommercial carries the dates of the product it was made from.
+func productManufacturer(dates []ProductDate) Actor {
+	for i := len(dates) - 1; i >= 0; i-- {
+		if dates[i].Status == "MANUFACTURED" {
+			return dates[i].Actor
+		}
+	}
+	return Actor{}
+}
+
+// allocateByExpiry reserves quantity of a product code from the MANUFACTURED products carrying it, taking the stock
+// that expires first and products without an expiry last. It returns one order item per product drawn from.
+// A manufacturer approves a whole order, so all of the stock comes from manufacturer; when it is the zero account
+// the manufacturer whose stock covers the quantity and expires first is chosen and returned.
+func allocateByExpiry(ctx contractapi.TransactionContextInterface, book *inventoryBook, item ProductIdQRCodeItem, quantity float64, now time.Time, manufacturer TokenAccount) ([]ProductIdQRCodeItem, TokenAccount, error) {
+	type candidate struct {
+		productId 	string
+		available 	float64
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productByCodeIndex, []string{item.ProductCode})
+	if err != nil {
+		return nil, TokenAccount{}, err
+	}
+	defer resultsIterator.Close()
+
+	// candidates of each manufacturer in expiry order, manufacturers in the order of their first candidate
+	candidates := map[TokenAccount][]candidate{}
+	var manufacturers []TokenAccount
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, TokenAccount{}, err
+		}
+
+		productId := string(response.Value)
+		inventory, err := book.lookup(productId)
+		if err != nil {
+			return nil, TokenAccount{}, err
+		}
+		if inventory == nil {
+			continue
+		}
+		product := book.products[productId]
+		if product.ProductCode != item.ProductCode || product.Status != "MANUFACTURED" {
+			continue
+		}
+		// the index entry of an expiry that has changed since is left to the current one
+		if productByCodeKey(ctx, product) != response.Key {
+			continue
+		}
+		madeBy := actorAccount(productManufacturer(product.Dates))
+		if manufacturer.UserId != "" && madeBy != manufacturer {
+			continue
+		}
+		if checkNotExpired(product.ProductId, product.Expired, now) != nil {
+			continue
+		}
+		if checkProductNotRecalled(ctx, product.ProductId) != nil {
+			continue
+		}
+		available := inventory.OnHand - inventory.Reserved
+		if available <= 0 {
+			continue
+		}
+
+		if _, ok := candidates[madeBy]; !ok {
+			manufacturers = append(manufacturers, madeBy)
+		}
+		candidates[madeBy] = append(candidates[madeBy], candidate{productId: productId, available: available})
+	}
+
+	if manufacturer.UserId == "" {
+		for _, candidateManufacturer := range manufacturers {
+			total := 0.0
+			for _, c := range candidates[candidateManufacturer] {
+				total += c.available
+			}
+			if total >= quantity {
+				manufacturer = candidateManufacturer
+				break
+			}
+		}
+		if manufacturer.UserId == "" {
+			return nil, TokenAccount{}, fmt.Errorf("no manufacturer has %s of unexpired stock of product code %s", formatQuantity(quantity), item.ProductCode)
+		}
+	}
+
+	var allocated []ProductIdQRCodeItem
+	remaining := quantity
+	for _, c := range candidates[manufacturer] {
+		if remaining <= 0 {
+			break
+		}
+
+		take := math.Min(c.available, remaining)
+		err = book.reserve(c.productId, take)
+		if err != nil {
+			return nil, TokenAccount{}, err
+		}
+		allocated = append(allocated, ProductIdQRCodeItem{
+			ProductId: 	c.productId,
+			Quantity: 	formatQuantity(take),
+			QRCode: 	item.QRCode,
+		})
+		remaining -= take
+	}
+
+	if remaining > 0 {
+		return nil, TokenAccount{}, fmt.Errorf("insufficient unexpired stock of product code %s from manufacturer %s: %s short of %s requested", item.ProductCode, manufacturer, formatQuantity(remaining), formatQuantity(quantity))
+	}
+	return allocated, manufacturer, nil
+}
+
+// buildProductByCodeIndex indexes the MANUFACTURED products written before the ProductByCode index existed
+func buildProductByCodeIndex(ctx contractapi.TransactionContextInterface) (int, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	indexed := 0
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		product := new(Product)
+		_ = json.Unmarshal(response.Value, product)
+		if product.Status != "MANUFACTURED" {
+			continue
+		}
+		err = indexProductByCode(ctx, nil, product)
+		if err != nil {
+			return 0, err
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+// buildOrderDocType sets the docType the status selector of GetOrdersWithPagination matches on, for orders written without one
+func buildOrderDocType(ctx contractapi.TransactionContextInterface) (int, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	updated := 0
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		order := new(Order)
+		_ = json.Unmarshal(response.Value, order)
+		if order.DocType == orderObjectType {
+			continue
+		}
+		order.DocType = orderObjectType
+		orderAsBytes, _ := json.Marshal(order)
+		err = ctx.GetStub().PutState(response.Key, orderAsBytes)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update order %s: %s", order.OrderId, err.Error())
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// indexBuilders fill a secondary index from the records it covers, or the docType the order selectors match on
+var indexBuilders = map[string]func(ctx contractapi.TransactionContextInterface) (int, error){
+	productByCodeIndex: buildProductByCodeIndex,
+	productCommercialByProductIndex: buildProductCommercialByProductIndex,
+	orderByProductIndex: buildOrderByProductIndex,
+	returnByOrderIndex: buildReturnByOrderIndex,
+	shipmentByOrderIndex: buildShipmentByOrderIndex,
+	orderObjectType: buildOrderDocType,
+}
+
+// RebuildIndex fills a secondary index for the records written before it existed. It returns the number of entries written.
+func (s *SmartContract) RebuildIndex(ctx contractapi.TransactionContextInterface, index string) (int, error) {
+	_, _, role, err := getClientIdentity(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if role != "admin" {
+		return 0, fmt.Errorf("user must be an admin")
+	}
+
+	build, ok := indexBuilders[index]
+	if !ok {
+		return 0, fmt.Errorf("unknown index %s", index)
+	}
+	return build(ctx)
+}
+
+// ExpiringStock is a product or commercial product held by a user that expires soon
+type ExpiringStock struct {
+	Product 			*Product 			`json:"product,omitempty" metadata:",optional"`
+	ProductCommercial 	*ProductCommercial 	`json:"productCommercial,omitempty" metadata:",optional"`
+	OrderId 			string 				`json:"orderId,omitempty" metadata:",optional"` // order a commercial product belongs to
+	Quantity 			string 				`json:"quantity"` // amount on hand of a product, quantity ordered of a commercial product
+	ExpireTime 			string 				`json:"expireTime"`
+	expiresAt 			time.Time
+}
+
+// productCustodySteps are the statuses of a product taken by the user who holds it from then on
+var productCustodySteps = map[string]bool{"CULTIVATED": true, "HARVESTED": true, "IMPORTED": true, "MANUFACTURED": true}
+
+// productHolder returns the user holding a product, the custodian of its latest custody step. Other steps, such as
+// a recall, do not change hands.
+func productHolder(product *Product) Actor {
+	for i := len(product.Dates) - 1; i >= 0; i-- {
+		if productCustodySteps[product.Dates[i].Status] {
+			return product.Dates[i].Actor
+		}
+	}
+	return product.Supplier
+}
+
+// productCommercialHolder returns who of the order holds a commercial product in the given status, ok is false
+// once it has left the supply chain
+func productCommercialHolder(order *Order, status string) (Actor, bool) {
+	switch status {
+	case "EXPORTED":
+		return order.Manufacturer, true
+	case "DISTRIBUTING", "RETURNED":
+		return order.Distributor, true
+	case "RETAILING":
+		return order.Retailer, true
+	}
+	return Actor{}, false
+}
+
+// expiringCommercialStock lists the commercial products made from a product that user holds and that expire in time,
+// found through the orders they were made for
+func expiringCommercialStock(ctx contractapi.TransactionContextInterface, productId string, user User, expiring func(expired string) (time.Time, bool)) ([]*ExpiringStock, error) {
+	ordersIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderByProductIndex, []string{productId})
+	if err != nil {
+		return nil, err
+	}
+	defer ordersIterator.Close()
+
+	stock := []*ExpiringStock{}
+	for ordersIterator.HasNext() {
+		response, err := ordersIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		orderAsBytes, err := ctx.GetStub().GetState(orderKey(ctx, string(response.Value)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+		}
+		if orderAsBytes == nil {
+			continue
+		}
+		order := new(Order)
+		_ = json.Unmarshal(orderAsBytes, order)
+		for _, item := range order.ProductItemList {
+			if item.Product.ProductId != productId {
+				continue
+			}
+			productAsBytes, err := ctx.GetStub().GetState(productCommercialKey(ctx, item.Product.ProductCommercialId))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+			}
+			if productAsBytes == nil {
+				continue
+			}
+			product := new(ProductCommercial)
+			_ = json.Unmarshal(productAsBytes, product)
+
+			holder, ok := productCommercialHolder(order, product.Status)
+			if !ok || !isActor(holder, user) {
+				continue
+			}
+			expiresAt, ok := expiring(product.Expired)
+			if !ok {
+				continue
+			}
+
+			stock = append(stock, &ExpiringStock{ProductCommercial: product, OrderId: order.OrderId, Quantity: item.Quantity, ExpireTime: product.Expired, expiresAt: expiresAt})
+		}
+	}
+	return stock, nil
+}
+
+// GetExpiringProducts lists the products and commercial products the submitting user holds that expire within the
+// given number of days, or have already expired, soonest first
+func (s *SmartContract) GetExpiringProducts(ctx contractapi.TransactionContextInterface, withinDays int) ([]*ExpiringStock, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if withinDays < 0 {
+		return nil, fmt.Errorf("withinDays cannot be negative")
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	horizon := now.AddDate(0, 0, withinDays)
+
+	expiring := func(expired string) (time.Time, bool) {
+		expiresAt, ok, err := parseExpiry(expired)
+		if err != nil || !ok || !expiresAt.Before(horizon) {
+			return time.Time{}, false
+		}
+		return expiresAt, true
+	}
+
+	// stock with an expiry is MANUFACTURED, so the ProductByCode index tells which products expire in time
+	// without reading them
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productByCodeIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	stock := []*ExpiringStock{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(response.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(attributes) != 3 {
+			continue
+		}
+		if _, ok := expiring(attributes[1]); !ok {
+			continue
+		}
+
+		productAsBytes, err := ctx.GetStub().GetState(productKey(ctx, attributes[2]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+		}
+		if productAsBytes == nil {
+			continue
+		}
+		product := new(Product)
+		_ = json.Unmarshal(productAsBytes, product)
+		// the index entry of an expiry that has changed since is left to the current one
+		if productByCodeKey(ctx, product) != response.Key {
+			continue
+		}
+
+		onHand, err := parseQuantity(product.Amount)
+		if err == nil && onHand > 0 && isActor(productHolder(product), user) {
+			expiresAt, ok := expiring(product.Expired)
+			if ok {
+				stock = append(stock, &ExpiringStock{Product: product, Quantity: product.Amount, ExpireTime: product.Expired, expiresAt: expiresAt})
+			}
+		}
+
+		// commercial products are created for an order, which tells who holds them at each step
+		commercialStock, err := expiringCommercialStock(ctx, product.ProductId, user, expiring)
+		if err != nil {
+			return nil, err
+		}
+		stock = append(stock, commercialStock...)
+	}
+
+	stockId := func(item *ExpiringStock) string {
+		if item.Product != nil {
+			return item.Product.ProductId
+		}
+		return item.ProductCommercial.ProductCommercialId
+	}
+	sort.Slice(stock, func(i, j int) bool {
+		a, b := stock[i].expiresAt, stock[j].expiresAt
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return stockId(stock[i]) < stockId(stock[j])
+	})
+
+	return stock, nil
+}
+
+// reserveReturnQuantities adds sign * the returned quantity of each item to the order's ReturnedQuantity,
+// failing if more would be returned than was delivered
+func reserveReturnQuantities(order *Order, items []OrderItemAmendment, sign float64) error {
+	for _, returned := range items {
+		quantity, err := parseQuantity(returned.Quantity)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for i, item := range order.ProductItemList {
+			if item.Product.ProductCommercialId != returned.ProductCommercialId {
+				continue
+			}
+			found = true
+
+			ordered, err := parseQuantity(item.Quantity)
+			if err != nil {
+				return err
+			}
+			// orders delivered before shipments existed have no delivered quantity, they arrived in full
+			if item.DeliveredQuantity != "" {
+				ordered, err = parseQuantity(item.DeliveredQuantity)
+				if err != nil {
+					return err
+				}
+			}
+			alreadyReturned, err := parseQuantity(item.ReturnedQuantity)
+			if err != nil {
+				return err
+			}
+			if alreadyReturned+sign*quantity > ordered {
+				return fmt.Errorf("only %s of %s can still be returned", formatQuantity(ordered-alreadyReturned), returned.ProductCommercialId)
+			}
+			order.ProductItemList[i].ReturnedQuantity = formatQuantity(alreadyReturned + sign*quantity)
+		}
+		if !found {
+			return fmt.Errorf("order %s has no item %s", order.OrderId, returned.ProductCommercialId)
+		}
+	}
+	return nil
+}
+
+func (s *SmartContract) GetReturn(ctx contractapi.TransactionContextInterface, returnId string) (*ReturnRequest, error) {
+	returnAsBytes, err := ctx.GetStub().GetState(returnKey(ctx, returnId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if returnAsBytes == nil {
+		return nil, fmt.Errorf("%s does not exist", returnId)
+	}
+
+	returnRequest := new(ReturnRequest)
+	_ = json.Unmarshal(returnAsBytes, returnRequest)
+
+	return returnRequest, nil
+}
+
+const returnByOrderIndex = "ReturnByOrder"
+
+// indexReturn lists a return under its order
+func indexReturn(ctx contractapi.TransactionContextInterface, returnRequest *ReturnRequest) error {
+	key, _ := ctx.GetStub().CreateCompositeKey(returnByOrderIndex, []string{returnRequest.OrderId, returnRequest.ReturnId})
+	err := ctx.GetStub().PutState(key, []byte(returnRequest.ReturnId))
+	if err != nil {
+		return fmt.Errorf("failed to index return %s: %s", returnRequest.ReturnId, err.Error())
+	}
+	return nil
+}
+
+// buildReturnByOrderIndex indexes the returns opened before the ReturnByOrder index existed
+func buildReturnByOrderIndex(ctx contractapi.TransactionContextInterface) (int, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(returnObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	indexed := 0
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		returnRequest := new(ReturnRequest)
+		_ = json.Unmarshal(response.Value, returnRequest)
+		err = indexReturn(ctx, returnRequest)
+		if err != nil {
+			return 0, err
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+// GetReturnsOfOrder lists the returns of an order. Returns opened before they were indexed by order are only
+// listed once RebuildIndex has run for ReturnByOrder.
+func (s *SmartContract) GetReturnsOfOrder(ctx contractapi.TransactionContextInterface, orderId string) ([]*ReturnRequest, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(returnByOrderIndex, []string{orderId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	returns := []*ReturnRequest{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		returnRequest, err := s.GetReturn(ctx, string(response.Value))
+		if err != nil {
+			return nil, err
+		}
+		returns = append(returns, returnRequest)
+	}
+
+	return returns, nil
+}
+
+// OpenReturn lets the retailer of a delivered order send some of its items back
+func (s *SmartContract) OpenReturn(ctx contractapi.TransactionContextInterface, returnObj ReturnForCreate) (*ReturnRequest, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "retailer" {
+		return nil, fmt.Errorf("user must be a retailer")
+	}
+
+	order, err := s.GetOrder(ctx, returnObj.OrderId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isActor(order.Retailer, user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+	if order.Status != "SHIPPED" && order.Status != "PARTIALLY_SHIPPED" {
+		return nil, fmt.Errorf("order %s is %s, only SHIPPED or PARTIALLY_SHIPPED orders can be returned", order.OrderId, order.Status)
+	}
+	if len(returnObj.Items) == 0 {
+		return nil, fmt.Errorf("a return needs at least one item")
+	}
+	if returnObj.Reason == "" {
+		return nil, fmt.Errorf("a return needs a reason")
+	}
+	for _, item := range returnObj.Items {
+		quantity, err := parseQuantity(item.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		if quantity <= 0 {
+			return nil, fmt.Errorf("returned quantity of %s must be positive", item.ProductCommercialId)
+		}
+	}
+
+	returnId, err := newAssetId(ctx, returnObjectType, 0)
+	if err != nil {
+		return nil, err
+	}
+	// a retried submission with the same idempotency key returns what the first one created
+	if existing, _ := s.GetReturn(ctx, returnId); existing != nil {
+		return existing, nil
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	// the quantities stay reserved until the return is disputed
+	err = reserveReturnQuantities(order, returnObj.Items, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	actor := parseUserToActor(user)
+	status := DeliveryStatus{
+		Status:        	"REQUESTED",
+		DeliveryDate:  	txTimeAsPtr,
+		Address: 		actor.Address,
+		Actor: 			actor,
+	}
+
+	returnRequest := ReturnRequest{
+		ReturnId: 		returnId,
+		OrderId: 		order.OrderId,
+		Items: 			returnObj.Items,
+		Reason: 		returnObj.Reason,
+		Statuses: 		[]DeliveryStatus{status},
+		Status: 		"REQUESTED",
+		CreateDate: 	txTimeAsPtr,
+		Retailer: 		actor,
+		Manufacturer: 	order.Manufacturer,
+	}
+
+	returnAsBytes, _ := json.Marshal(returnRequest)
+	ctx.GetStub().PutState(returnKey(ctx, returnRequest.ReturnId), returnAsBytes)
+	err = indexReturn(ctx, &returnRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	orderAsBytes, _ := json.Marshal(order)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+
+	return &returnRequest, nil
+}
+
+// resolveReturn moves a REQUESTED return to APPROVED or DISPUTED on behalf of the manufacturer who approved the order
+func (s *SmartContract) resolveReturn(ctx contractapi.TransactionContextInterface, returnId string, status string, reason string) (*ReturnRequest, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "manufacturer" {
+		return nil, fmt.Errorf("user must be a manufacturer")
+	}
+
+	returnRequest, err := s.GetReturn(ctx, returnId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isActor(returnRequest.Manufacturer, user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+	if returnRequest.Status != "REQUESTED" {
+		return nil, fmt.Errorf("return %s is %s, only REQUESTED returns can be resolved", returnRequest.ReturnId, returnRequest.Status)
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	// a disputed return gives its quantities back to the order
+	if status == "DISPUTED" {
+		order, err := s.GetOrder(ctx, returnRequest.OrderId)
+		if err != nil {
+			return nil, err
+		}
+		err = reserveReturnQuantities(order, returnRequest.Items, -1)
+		if err != nil {
+			return nil, err
+		}
+		orderAsBytes, _ := json.Marshal(order)
+		ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+
+		returnRequest.DisputeReason = reason
+	}
+
+	actor := parseUserToActor(user)
+	returnStatus := DeliveryStatus{
+		Status:        	status,
+		DeliveryDate:  	txTimeAsPtr,
+		Address: 		actor.Address,
+		Actor: 			actor,
+	}
+
+	returnRequest.Statuses = append(returnRequest.Statuses, returnStatus)
+	returnRequest.UpdateDate = txTimeAsPtr
+	returnRequest.Status = status
+
+	returnAsBytes, _ := json.Marshal(returnRequest)
+	ctx.GetStub().PutState(returnKey(ctx, returnRequest.ReturnId), returnAsBytes)
+
+	return returnRequest, nil
+}
+
+func (s *SmartContract) ApproveReturn(ctx contractapi.TransactionContextInterface, returnId string) (*ReturnRequest, error) {
+	return s.resolveReturn(ctx, returnId, "APPROVED", "")
+}
+
+func (s *SmartContract) DisputeReturn(ctx contractapi.TransactionContextInterface, returnId string, reason string) (*ReturnRequest, error) {
+	if reason == "" {
+		return nil, fmt.Errorf("a dispute needs a reason")
+	}
+	return s.resolveReturn(ctx, returnId, "DISPUTED", reason)
+}
+
+// PickupReturn records the distributor collecting an approved return. The returned products become RETURNED
+// and their quantities go back to the inventory of the products they were ordered from.
+func (s *SmartContract) PickupReturn(ctx contractapi.TransactionContextInterface, returnId string) (*ReturnRequest, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "distributor" {
+		return nil, fmt.Errorf("user must be a distributor")
+	}
+
+	returnRequest, err := s.GetReturn(ctx, returnId)
+	if err != nil {
+		return nil, err
+	}
+
+	if returnRequest.Status != "APPROVED" {
+		return nil, fmt.Errorf("return %s is %s, only APPROVED returns can be picked up", returnRequest.ReturnId, returnRequest.Status)
+	}
+
+	order, err := s.GetOrder(ctx, returnRequest.OrderId)
+	if err != nil {
+		return nil, err
+	}
+
+	// the goods go back the way they came, with the order's distributor
+	if !isActor(order.Distributor, user) {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	actor := parseUserToActor(user)
+	book := newInventoryBook(ctx)
+	for _, returned := range returnRequest.Items {
+		productCommercial, err := s.GetProductCommercial(ctx, returned.ProductCommercialId)
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkProductTransition(user, productCommercial.ProductCommercialId, productCommercial.Status, productCommercial.Dates, "RETURNED")
+		if err != nil {
+			return nil, err
+		}
+
+		date := ProductDate{
+			Status: "RETURNED",
+			Time: txTimeAsPtr,
+			Actor: actor,
+		}
+		productCommercial.Dates = append(productCommercial.Dates, date)
+		productCommercial.Status = "RETURNED"
+
+		productCommercialAsBytes, _ := json.Marshal(productCommercial)
+		ctx.GetStub().PutState(productCommercialKey(ctx, productCommercial.ProductCommercialId), productCommercialAsBytes)
+
+		for i, item := range order.ProductItemList {
+			if item.Product.ProductCommercialId == productCommercial.ProductCommercialId {
+				order.ProductItemList[i].Product = *productCommercial
+			}
+		}
+
+		// restore the quantity to the product the item was minted from
+		quantity, err := parseQuantity(returned.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		err = book.restock(productCommercial.ProductId, quantity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = book.save()
+	if err != nil {
+		return nil, err
+	}
+
+	returnStatus := DeliveryStatus{
+		Status:        	"RETURNED",
+		DeliveryDate:  	txTimeAsPtr,
+		Address: 		actor.Address,
+		Actor: 			actor,
+	}
+
+	returnRequest.Statuses = append(returnRequest.Statuses, returnStatus)
+	returnRequest.Distributor = actor
+	returnRequest.UpdateDate = txTimeAsPtr
+	returnRequest.Status = "RETURNED"
+
+	returnAsBytes, _ := json.Marshal(returnRequest)
+	ctx.GetStub().PutState(returnKey(ctx, returnRequest.ReturnId), returnAsBytes)
+
+	orderAsBytes, _ := json.Marshal(order)
+	ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+
+	return returnRequest, nil
+}
+
+// Payment token for order escrow. It lives in this chaincode's namespace only: the coffee batch chaincode
+// (go/chaincode/token.go) runs a token of its own for buys, with its own config, supply and balances.
+// The two are separate currencies and tokens cannot move between them.
+// Accounts are user IDs qualified by their MSP, the pair RegisterUser binds to one client identity.
+const (
+	tokenConfigKey = "TokenConfig"
+	tokenSupplyKey = "TokenSupply"
+	tokenBalanceObjectType = "TokenBalance"
+	tokenAllowanceObjectType = "TokenAllowance"
+)
+
+// TokenConfig describes the payment token and the org allowed to mint it
+type TokenConfig struct {
+	Name 		string `json:"name"`
+	Symbol 		string `json:"symbol"`
+	IssuerMSPID string `json:"issuerMspId"`
+}
+
+func getTokenConfig(ctx contractapi.TransactionContextInterface) (*TokenConfig, error) {
+	configAsBytes, err := ctx.GetStub().GetState(tokenConfigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if configAsBytes == nil {
+		return nil, nil
+	}
+
+	var config TokenConfig
+	_ = json.Unmarshal(configAsBytes, &config)
+	return &config, nil
+}
+
+// TokenAccount names the holder of a token balance, a user ID alone is only unique within its MSP
+type TokenAccount struct {
+	MSPID 	string `json:"mspId"`
+	UserId 	string `json:"userId"`
+}
+
+func (a TokenAccount) String() string {
+	return a.UserId + "@" + a.MSPID
+}
+
+func userAccount(user User) TokenAccount {
+	return TokenAccount{MSPID: user.MSPID, UserId: user.UserId}
+}
+
+func actorAccount(actor Actor) TokenAccount {
+	return TokenAccount{MSPID: actor.MSPID, UserId: actor.UserId}
+}
+
+func tokenBalanceKey(ctx contractapi.TransactionContextInterface, account TokenAccount) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(tokenBalanceObjectType, []string{account.MSPID, account.UserId})
+	return key
+}
+
+func tokenAllowanceKey(ctx contractapi.TransactionContextInterface, owner TokenAccount, spender TokenAccount) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(tokenAllowanceObjectType, []string{owner.MSPID, owner.UserId, spender.MSPID, spender.UserId})
+	return key
+}
+
+// readTokenAmount reads an amount stored under key, a missing key holds 0
+func readTokenAmount(ctx contractapi.TransactionContextInterface, key string) (int64, error) {
+	amountAsBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if amountAsBytes == nil {
+		return 0, nil
+	}
+	amount, err := strconv.ParseInt(string(amountAsBytes), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse token amount: %s", err.Error())
+	}
+	return amount, nil
+}
+
+func writeTokenAmount(ctx contractapi.TransactionContextInterface, key string, amount int64) error {
+	var err error
+	if amount == 0 {
+		err = ctx.GetStub().DelState(key)
+	} else {
+		err = ctx.GetStub().PutState(key, []byte(strconv.FormatInt(amount, 10)))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save token amount: %s", err.Error())
+	}
+	return nil
+}
+
+// addTokens changes the balance of an account by delta, refusing overdrafts and overflow
+func addTokens(ctx contractapi.TransactionContextInterface, account TokenAccount, delta int64) error {
+	if account.MSPID == "" || account.UserId == "" {
+		return fmt.Errorf("token account needs an MSP ID and a user ID")
+	}
+	key := tokenBalanceKey(ctx, account)
+	balance, err := readTokenAmount(ctx, key)
+	if err != nil {
+		return err
+	}
+	if delta < 0 && balance < -delta {
+		return fmt.Errorf("account %s has %d tokens, %d are needed", account, balance, -delta)
+	}
+	if delta > 0 && balance > math.MaxInt64-delta {
+		return fmt.Errorf("balance of account %s would overflow", account)
+	}
+	return writeTokenAmount(ctx, key, balance+delta)
+}
+
+// transferTokens moves amount from one account to another
+func transferTokens(ctx contractapi.TransactionContextInterface, from TokenAccount, to TokenAccount, amount int64) error {
+	if amount <= 0 {
+		return fmt.Errorf("transfer amount must be positive")
+	}
+	if from == to {
+		return fmt.Errorf("cannot transfer tokens to the same account")
+	}
+	err := addTokens(ctx, from, -amount)
+	if err != nil {
+		return err
+	}
+	return addTokens(ctx, to, amount)
+}
+
+// spendAllowance moves amount from owner to recipient out of what owner allowed spender to use
+func spendAllowance(ctx contractapi.TransactionContextInterface, owner TokenAccount, spender TokenAccount, recipient TokenAccount, amount int64) error {
+	key := tokenAllowanceKey(ctx, owner, spender)
+	allowance, err := readTokenAmount(ctx, key)
+	if err != nil {
+		return err
+	}
+	if allowance < amount {
+		return fmt.Errorf("%s allowed %s to spend %d tokens, %d are needed", owner, spender, allowance, amount)
+	}
+	err = transferTokens(ctx, owner, recipient, amount)
+	if err != nil {
+		return err
+	}
+	return writeTokenAmount(ctx, key, allowance-amount)
+}
+
+// orderItemAmount is the price of quantity units of a product in tokens, an unpriced product costs nothing
+func orderItemAmount(product ProductCommercial, quantity float64) (int64, error) {
+	if product.Price == "" {
+		return 0, nil
+	}
+	price, err := strconv.ParseFloat(product.Price, 64)
+	if err != nil || price < 0 {
+		return 0, fmt.Errorf("invalid price %s of %s", product.Price, product.ProductCommercialId)
+	}
+	amount := price * quantity
+	if math.Abs(amount-math.Round(amount)) > 1e-9 || amount > math.MaxInt64 {
+		return 0, fmt.Errorf("%s units of %s do not cost a whole number of tokens", formatQuantity(quantity), product.ProductCommercialId)
+	}
+	return int64(math.Round(amount)), nil
+}
+
+// InitializeToken names the payment token and designates the org whose clients may mint it, once
+func (s *SmartContract) InitializeToken(ctx contractapi.TransactionContextInterface, config TokenConfig) (*TokenConfig, error) {
+	_, _, role, err := getClientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role != "admin" {
+		return nil, fmt.Errorf("user must be an admin")
+	}
+
+	if config.Name == "" || config.Symbol == "" || config.IssuerMSPID == "" {
+		return nil, fmt.Errorf("name, symbol and issuerMspId are required")
+	}
+
+	// the issuer decides who may mint, it is set once and no admin can change it afterwards
+	existing, err := getTokenConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("token %s has already been initialized", existing.Symbol)
+	}
+
+	configAsBytes, _ := json.Marshal(config)
+	err = ctx.GetStub().PutState(tokenConfigKey, configAsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save token config: %s", err.Error())
+	}
+
+	return &config, nil
+}
+
+func (s *SmartContract) GetTokenConfig(ctx contractapi.TransactionContextInterface) (*TokenConfig, error) {
+	config, err := getTokenConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, fmt.Errorf("token has not been initialized")
+	}
+	return config, nil
+}
+
+// checkRegisteredAccount refuses accounts no registered user holds, their tokens could be claimed by whoever registers first
+func checkRegisteredAccount(ctx contractapi.TransactionContextInterface, account TokenAccount) error {
+	key, err := userIdentityKey(ctx, account.MSPID, account.UserId)
+	if err != nil {
+		return fmt.Errorf("failed to create user key: %s", err.Error())
+	}
+	userBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if userBytes == nil {
+		return fmt.Errorf("identity %s of %s is not registered", account.UserId, account.MSPID)
+	}
+	return nil
+}
+
+// Mint creates new tokens in a registered user's account, only clients of the issuer org may mint
+func (s *SmartContract) Mint(ctx contractapi.TransactionContextInterface, recipient TokenAccount, amount int64) (int64, error) {
+	config, err := s.GetTokenConfig(ctx)
+	if err != nil {
+		return 0, err
+	}
+	mspID, _, _, err := getClientIdentity(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if mspID != config.IssuerMSPID {
+		return 0, fmt.Errorf("only clients of %s may mint %s", config.IssuerMSPID, config.Symbol)
+	}
+	if amount <= 0 {
+		return 0, fmt.Errorf("mint amount must be positive")
+	}
+	err = checkRegisteredAccount(ctx, recipient)
+	if err != nil {
+		return 0, err
+	}
+
+	supply, err := readTokenAmount(ctx, tokenSupplyKey)
+	if err != nil {
+		return 0, err
+	}
+	if supply > math.MaxInt64-amount {
+		return 0, fmt.Errorf("total supply would overflow")
+	}
+	err = addTokens(ctx, recipient, amount)
+	if err != nil {
+		return 0, err
+	}
+	err = writeTokenAmount(ctx, tokenSupplyKey, supply+amount)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.BalanceOf(ctx, recipient)
+}
+
+// Transfer moves tokens from the submitting user's account to the account of a registered recipient
+func (s *SmartContract) Transfer(ctx contractapi.TransactionContextInterface, recipient TokenAccount, amount int64) error {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkRegisteredAccount(ctx, recipient)
+	if err != nil {
+		return err
+	}
+	return transferTokens(ctx, userAccount(user), recipient, amount)
+}
+
+// Approve allows spender to move up to amount of the submitting user's tokens, replacing any earlier allowance
+func (s *SmartContract) Approve(ctx contractapi.TransactionContextInterface, spender TokenAccount, amount int64) error {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return err
+	}
+	if amount < 0 {
+		return fmt.Errorf("allowance cannot be negative")
+	}
+	if spender.MSPID == "" || spender.UserId == "" || spender == userAccount(user) {
+		return fmt.Errorf("spender must be another account")
+	}
+	return writeTokenAmount(ctx, tokenAllowanceKey(ctx, userAccount(user), spender), amount)
+}
+
+// TransferFrom moves tokens from owner to a registered recipient out of the allowance owner gave the submitting user
+func (s *SmartContract) TransferFrom(ctx contractapi.TransactionContextInterface, owner TokenAccount, recipient TokenAccount, amount int64) error {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkRegisteredAccount(ctx, recipient)
+	if err != nil {
+		return err
+	}
+	return spendAllowance(ctx, owner, userAccount(user), recipient, amount)
+}
+
+func (s *SmartContract) BalanceOf(ctx contractapi.TransactionContextInterface, account TokenAccount) (int64, error) {
+	return readTokenAmount(ctx, tokenBalanceKey(ctx, account))
+}
+
+func (s *SmartContract) ClientAccountBalance(ctx contractapi.TransactionContextInterface) (int64, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return s.BalanceOf(ctx, userAccount(user))
+}
+
+func (s *SmartContract) ClientAccountID(ctx contractapi.TransactionContextInterface) (*TokenAccount, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	account := userAccount(user)
+	return &account, nil
+}
+
+func (s *SmartContract) Allowance(ctx contractapi.TransactionContextInterface, owner TokenAccount, spender TokenAccount) (int64, error) {
+	return readTokenAmount(ctx, tokenAllowanceKey(ctx, owner, spender))
+}
+
+func (s *SmartContract) TotalSupply(ctx contractapi.TransactionContextInterface) (int64, error) {
+	return readTokenAmount(ctx, tokenSupplyKey)
+}
+
+const escrowObjectType = "Escrow"
+
+// Escrow holds a retailer's payment for an order from CreateOrder until the retailer confirms the items were received
+type Escrow struct {
+	OrderId 			string `json:"orderId"`
+	Payer 				string `json:"payer"`
+	PayerMSPID 			string `json:"payerMspId"`
+	Locked 				int64  `json:"locked"` // tokens still held
+	Released 			int64  `json:"released"` // tokens paid out to the manufacturer and distributor
+	Refunded 			int64  `json:"refunded"` // tokens returned to the payer
+	DistributorFeeBps 	int    `json:"distributorFeeBps"` // share of each release going to the distributor, fixed when the payment is locked
+	Status 				string `json:"status"` // LOCKED, PARTIALLY_RELEASED, RELEASED or REFUNDED
+	UpdateDate 			string `json:"updateDate"`
+}
+
+func escrowKey(ctx contractapi.TransactionContextInterface, orderId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(escrowObjectType, []string{orderId})
+	return key
+}
+
+func getEscrow(ctx contractapi.TransactionContextInterface, orderId string) (*Escrow, error) {
+	escrowAsBytes, err := ctx.GetStub().GetState(escrowKey(ctx, orderId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if escrowAsBytes == nil {
+		return nil, nil
+	}
+
+	escrow := new(Escrow)
+	_ = json.Unmarshal(escrowAsBytes, escrow)
+	return escrow, nil
+}
+
+func putEscrow(ctx contractapi.TransactionContextInterface, escrow *Escrow) error {
+	escrowAsBytes, _ := json.Marshal(escrow)
+	err := ctx.GetStub().PutState(escrowKey(ctx, escrow.OrderId), escrowAsBytes)
+	if err != nil {
+		return fmt.Errorf("failed to save escrow of order %s: %s", escrow.OrderId, err.Error())
+	}
+	return nil
+}
+
+func escrowPayer(escrow *Escrow) TokenAccount {
+	return TokenAccount{MSPID: escrow.PayerMSPID, UserId: escrow.Payer}
+}
+
+// orderTotal is the price of every item of an order in tokens
+func orderTotal(order *Order) (int64, error) {
+	var total int64
+	for _, item := range order.ProductItemList {
+		quantity, err := parseQuantity(item.Quantity)
+		if err != nil {
+			return 0, err
+		}
+		amount, err := orderItemAmount(item.Product, quantity)
+		if err != nil {
+			return 0, err
+		}
+		if total > math.MaxInt64-amount {
+			return 0, fmt.Errorf("total of order %s would overflow", order.OrderId)
+		}
+		total += amount
+	}
+	return total, nil
+}
+
+// lockOrderPayment moves the order total from the retailer's account into the order's escrow. An amended order
+// locks or refunds the difference with what is already held. Nothing is locked before the token is initialized.
+func lockOrderPayment(ctx contractapi.TransactionContextInterface, order *Order, txTimeAsPtr string) error {
+	tokenConfig, err := getTokenConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if tokenConfig == nil {
+		return nil
+	}
+
+	total, err := orderTotal(order)
+	if err != nil {
+		return err
+	}
+	escrow, err := getEscrow(ctx, order.OrderId)
+	if err != nil {
+		return err
+	}
+	if escrow == nil {
+		if total == 0 {
+			return nil
+		}
+		escrow = &Escrow{
+			OrderId: 			order.OrderId,
+			Payer: 				order.Retailer.UserId,
+			PayerMSPID: 		order.Retailer.MSPID,
+			DistributorFeeBps: 	getOrderConfig(ctx).DistributorFeeBps,
+		}
+	}
+
+	delta := total - escrow.Locked
+	if delta != 0 {
+		err = addTokens(ctx, escrowPayer(escrow), -delta)
+		if err != nil {
+			return err
+		}
+	}
+	if delta < 0 {
+		escrow.Refunded -= delta
+	}
+
+	escrow.Locked = total
+	escrow.Status = "LOCKED"
+	escrow.UpdateDate = txTimeAsPtr
+	return putEscrow(ctx, escrow)
+}
+
+// refundOrderPayment returns what the escrow of a closed order still holds to the retailer
+func refundOrderPayment(ctx contractapi.TransactionContextInterface, order *Order, txTimeAsPtr string) error {
+	escrow, err := getEscrow(ctx, order.OrderId)
+	if err != nil {
+		return err
+	}
+	if escrow == nil || escrow.Locked == 0 {
+		return nil
+	}
+
+	err = addTokens(ctx, escrowPayer(escrow), escrow.Locked)
+	if err != nil {
+		return err
+	}
+
+	escrow.Refunded += escrow.Locked
+	escrow.Locked = 0
+	escrow.Status = "REFUNDED"
+	escrow.UpdateDate = txTimeAsPtr
+	return putEscrow(ctx, escrow)
+}
+
+// releaseOrderPayment pays amount out of the order's escrow, the distributor's fee to the distributor and the rest
+// to the manufacturer. It returns false when the order has no escrow.
+func releaseOrderPayment(ctx contractapi.TransactionContextInterface, order *Order, distributor Actor, amount int64, txTimeAsPtr string) (bool, error) {
+	escrow, err := getEscrow(ctx, order.OrderId)
+	if err != nil {
+		return false, err
+	}
+	if escrow == nil {
+		return false, nil
+	}
+	if amount == 0 {
+		return true, nil
+	}
+	if amount > escrow.Locked {
+		return true, fmt.Errorf("escrow of order %s holds %d tokens, %d are due", order.OrderId, escrow.Locked, amount)
+	}
+
+	fee := amount * int64(escrow.DistributorFeeBps) / 10000
+	if fee > 0 {
+		err = addTokens(ctx, actorAccount(distributor), fee)
+		if err != nil {
+			return true, err
+		}
+	}
+	err = addTokens(ctx, actorAccount(order.Manufacturer), amount-fee)
+	if err != nil {
+		return true, err
+	}
+
+	escrow.Locked -= amount
+	escrow.Released += amount
+	escrow.Status = "PARTIALLY_RELEASED"
+	if escrow.Locked == 0 {
+		escrow.Status = "RELEASED"
+	}
+	escrow.UpdateDate = txTimeAsPtr
+	return true, putEscrow(ctx, escrow)
+}
+
+func (s *SmartContract) GetEscrow(ctx contractapi.TransactionContextInterface, orderId string) (*Escrow, error) {
+	escrow, err := getEscrow(ctx, orderId)
+	if err != nil {
+		return nil, err
+	}
+	if escrow == nil {
+		return nil, fmt.Errorf("order %s has no escrow", orderId)
+	}
+	return escrow, nil
+}
+
+const (
+	recallObjectType = "Recall"
+	recalledProductIndex = "RecalledProduct"
+	productCommercialByProductIndex = "ProductCommercialByProduct"
+	orderByProductIndex = "OrderByProduct"
+	recallAckObjectType = "RecallAck"
+)
+
+type RecallAcknowledgement struct {
+	Actor 	Actor 	`json:"actor"`
+	Note 	string 	`json:"note"`
+	Time 	string 	`json:"time"`
+}
+
+// Recall withdraws products and every ProductCommercial made from them.
+// Scope is "product" for one ProductId, or "productCode" for every product with ProductCode made between From and To.
+// Acknowledgements are kept under RecallAck~recallId~holderMspId~holderId so holders do not conflict on the recall,
+// GetRecall fills them in.
+type Recall struct {
+	RecallId 				string 					`json:"recallId"`
+	Scope 					string 					`json:"scope"`
+	ProductId 				string 					`json:"productId"`
+	ProductCode 			string 					`json:"productCode"`
+	From 					string 					`json:"from"` // 2006-01-02, inclusive
+	To 						string 					`json:"to"` // 2006-01-02, inclusive
+	Severity 				string 					`json:"severity"`
+	Reason 					string 					`json:"reason"`
+	IssueDate 				string 					`json:"issueDate"`
+	IssuedBy 				Actor 					`json:"issuedBy"`
+	ProductIds 				[]string 				`json:"productIds" metadata:",optional"`
+	ProductCommercialIds 	[]string 				`json:"productCommercialIds" metadata:",optional"`
+	OrderIds 				[]string 				`json:"orderIds" metadata:",optional"`
+	Holders 				[]Actor 				`json:"holders" metadata:",optional"` // users expected to acknowledge
+	Acknowledgements 		[]RecallAcknowledgement `json:"acknowledgements" metadata:",optional"`
+}
+
+type RecallForCreate struct {
+	Scope 		string `json:"scope"`
+	ProductId 	string `json:"productId"`
+	ProductCode string `json:"productCode"`
+	From 		string `json:"from"`
+	To 			string `json:"to"`
+	Severity 	string `json:"severity"`
+	Reason 		string `json:"reason"`
+}
+
+type RecallImpact struct {
+	RecallId 		string 		`json:"recallId"`
+	Orders 			[]*Order 	`json:"orders"`
+	Retailers 		[]Actor 	`json:"retailers"`
+	Holders 		[]Actor 	`json:"holders"`
+	Unacknowledged 	[]Actor 	`json:"unacknowledged"`
+}
+
+func recallKey(ctx contractapi.TransactionContextInterface, recallId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(recallObjectType, []string{recallId})
+	return key
+}
+
+func recalledProductKey(ctx contractapi.TransactionContextInterface, productId string) string {
+	key, _ := ctx.GetStub().CreateCompositeKey(recalledProductIndex, []string{productId})
+	return key
+}
+
+// checkProductNotRecalled refuses to order or sell a recalled product
+func checkProductNotRecalled(ctx contractapi.TransactionContextInterface, productId string) error {
+	recallId, err := ctx.GetStub().GetState(recalledProductKey(ctx, productId))
+	if err != nil {
+		return fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if recallId != nil {
+		return fmt.Errorf("product %s is recalled by %s", productId, string(recallId))
+	}
+	return nil
+}
+
+// recallMatches tells whether a product falls under a recall. A product is made when its first date was recorded.
+func recallMatches(recall RecallForCreate, product *Product) bool {
+	if recall.Scope == "product" {
+		return product.ProductId == recall.ProductId
+	}
+	if product.ProductCode != recall.ProductCode {
+		return false
+	}
+	if recall.From == "" && recall.To == "" {
+		return true
+	}
+	if len(product.Dates) == 0 {
+		return false
+	}
+	madeAt, err := time.Parse(txTimeLayout, product.Dates[0].Time)
+	if err != nil {
+		return false
+	}
+	if recall.From != "" {
+		from, _ := time.Parse("2006-01-02", recall.From)
+		if madeAt.Before(from) {
+			return false
+		}
+	}
+	if recall.To != "" {
+		to, _ := time.Parse("2006-01-02", recall.To)
+		if !madeAt.Before(to.AddDate(0, 0, 1)) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexProductCommercial lists a commercial product under the product it was made from
+func indexProductCommercial(ctx contractapi.TransactionContextInterface, productCommercial *ProductCommercial) error {
+	key, _ := ctx.GetStub().CreateCompositeKey(productCommercialByProductIndex, []string{productCommercial.ProductId, productCommercial.ProductCommercialId})
+	err := ctx.GetStub().PutState(key, []byte(productCommercial.ProductCommercialId))
+	if err != nil {
+		return fmt.Errorf("failed to index %s: %s", productCommercial.ProductCommercialId, err.Error())
+	}
+	return nil
+}
+
+// indexOrderProducts lists an order under every product its items were made from
+func indexOrderProducts(ctx contractapi.TransactionContextInterface, order *Order) error {
+	for _, item := range order.ProductItemList {
+		key, _ := ctx.GetStub().CreateCompositeKey(orderByProductIndex, []string{item.Product.ProductId, order.OrderId})
+		err := ctx.GetStub().PutState(key, []byte(order.OrderId))
+		if err != nil {
+			return fmt.Errorf("failed to index order %s: %s", order.OrderId, err.Error())
+		}
+	}
+	return nil
+}
+
+// indexedIds returns the IDs an index lists under a product
+func indexedIds(ctx contractapi.TransactionContextInterface, index string, productId string) ([]string, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(index, []string{productId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var ids []string
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, string(response.Value))
+	}
+	return ids, nil
+}
+
+// buildProductCommercialByProductIndex indexes the commercial products written before the index existed
+func buildProductCommercialByProductIndex(ctx contractapi.TransactionContextInterface) (int, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productCommercialObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	indexed := 0
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		productCommercial := new(ProductCommercial)
+		_ = json.Unmarshal(response.Value, productCommercial)
+		err = indexProductCommercial(ctx, productCommercial)
+		if err != nil {
+			return 0, err
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+// buildOrderByProductIndex indexes the orders written before the index existed
+func buildOrderByProductIndex(ctx contractapi.TransactionContextInterface) (int, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(orderObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	indexed := 0
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		order := new(Order)
+		_ = json.Unmarshal(response.Value, order)
+		err = indexOrderProducts(ctx, order)
+		if err != nil {
+			return 0, err
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+// checkRecallIssuer refuses a recall of a product by anyone but an admin, its supplier or its manufacturer
+func checkRecallIssuer(user User, product *Product) error {
+	if user.Role == "admin" || isActor(product.Supplier, user) || isActor(productManufacturer(product.Dates), user) {
+		return nil
+	}
+	return fmt.Errorf("permission denied: product %s was neither supplied nor manufactured by %s", product.ProductId, user.UserId)
+}
+
+func appendDistinct(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// appendActor adds actor to actors unless a user of the same MSP and ID is in there already
+func appendActor(actors []Actor, actor Actor) []Actor {
+	if actor.UserId == "" {
+		return actors
+	}
+	for _, existing := range actors {
+		if actorAccount(existing) == actorAccount(actor) {
+			return actors
+		}
+	}
+	return append(actors, actor)
+}
+
+// IssueRecall marks the products in scope and every ProductCommercial made from them RECALLED, so they can no
+// longer be ordered, moved or sold. Orders holding them are listed on the recall and their parties have to acknowledge it.
+// Suppliers and manufacturers recall their own products, a productCode recall by them covers only those.
+func (s *SmartContract) IssueRecall(ctx contractapi.TransactionContextInterface, recallObj RecallForCreate) (*Recall, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Role != "admin" && user.Role != "supplier" && user.Role != "manufacturer" {
+		return nil, fmt.Errorf("user must be an admin, supplier or manufacturer")
+	}
+
+	switch recallObj.Scope {
+	case "product":
+		if recallObj.ProductId == "" {
+			return nil, fmt.Errorf("productId is required")
+		}
+	case "productCode":
+		if recallObj.ProductCode == "" {
+			return nil, fmt.Errorf("productCode is required")
+		}
+		for _, day := range []string{recallObj.From, recallObj.To} {
+			if _, err := time.Parse("2006-01-02", day); day != "" && err != nil {
+				return nil, fmt.Errorf("invalid date %s, expected YYYY-MM-DD", day)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("scope must be product or productCode")
+	}
+	if recallObj.Severity != "LOW" && recallObj.Severity != "MEDIUM" && recallObj.Severity != "HIGH" {
+		return nil, fmt.Errorf("severity must be LOW, MEDIUM or HIGH")
+	}
+	if recallObj.Reason == "" {
+		return nil, fmt.Errorf("a reason is required")
+	}
+
+	recallId, err := newAssetId(ctx, recallObjectType, 0)
+	if err != nil {
+		return nil, err
+	}
+	// a retried submission with the same idempotency key returns what the first one created
+	if existing, _ := s.GetRecall(ctx, recallId); existing != nil {
+		return existing, nil
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	actor := parseUserToActor(user)
+	recalledDate := ProductDate{
+		Status: "RECALLED",
+		Time: txTimeAsPtr,
+		Actor: actor,
+	}
+
+	recall := Recall{
+		RecallId: 		recallId,
+		Scope: 			recallObj.Scope,
+		ProductId: 		recallObj.ProductId,
+		ProductCode: 	recallObj.ProductCode,
+		From: 			recallObj.From,
+		To: 			recallObj.To,
+		Severity: 		recallObj.Severity,
+		Reason: 		recallObj.Reason,
+		IssueDate: 		txTimeAsPtr,
+		IssuedBy: 		actor,
+	}
+
+	// the products themselves
+	var products []*Product
+	if recallObj.Scope == "product" {
+		productAsBytes, err := ctx.GetStub().GetState(productKey(ctx, recallObj.ProductId))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+		}
+		if productAsBytes == nil {
+			return nil, fmt.Errorf("product %s does not exist", recallObj.ProductId)
+		}
+		product := new(Product)
+		_ = json.Unmarshal(productAsBytes, product)
+		err = checkRecallIssuer(user, product)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	} else {
+		productIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(productObjectType, []string{})
+		if err != nil {
+			return nil, err
+		}
+		defer productIterator.Close()
+
+		for productIterator.HasNext() {
+			response, err := productIterator.Next()
+			if err != nil {
+				return nil, err
+			}
+
+			product := new(Product)
+			_ = json.Unmarshal(response.Value, product)
+			if !recallMatches(recallObj, product) || checkRecallIssuer(user, product) != nil {
+				continue
+			}
+			products = append(products, product)
+		}
+	}
+	if len(products) == 0 {
+		return nil, fmt.Errorf("no product matches the recall")
+	}
+
+	recalled := map[string]bool{}
+	for _, product := range products {
+		recalled[product.ProductId] = true
+		recall.ProductIds = append(recall.ProductIds, product.ProductId)
+		recall.Holders = appendActor(recall.Holders, product.Supplier)
+
+		if product.Status != "RECALLED" {
+			product.Status = "RECALLED"
+			product.Dates = append(product.Dates, recalledDate)
+			productAsBytes, _ := json.Marshal(product)
+			err = ctx.GetStub().PutState(productKey(ctx, product.ProductId), productAsBytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to recall %s: %s", product.ProductId, err.Error())
+			}
+		}
+		err = ctx.GetStub().PutState(recalledProductKey(ctx, product.ProductId), []byte(recallId))
+		if err != nil {
+			return nil, fmt.Errorf("failed to index recalled product %s: %s", product.ProductId, err.Error())
+		}
+	}
+
+	// every ProductCommercial minted from them, and the orders carrying a copy of them, which the order flow checks
+	orderIds := []string{}
+	for _, product := range products {
+		productCommercialIds, err := indexedIds(ctx, productCommercialByProductIndex, product.ProductId)
+		if err != nil {
+			return nil, err
+		}
+		for _, productCommercialId := range productCommercialIds {
+			productCommercialAsBytes, err := ctx.GetStub().GetState(productCommercialKey(ctx, productCommercialId))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+			}
+			if productCommercialAsBytes == nil {
+				continue
 			}
+			productCommercial := new(ProductCommercial)
+			_ = json.Unmarshal(productCommercialAsBytes, productCommercial)
+
+			recall.ProductCommercialIds = append(recall.ProductCommercialIds, productCommercialId)
+			if productCommercial.Status == "RECALLED" {
+				continue
+			}
+			productCommercial.Status = "RECALLED"
+			productCommercial.Dates = append(productCommercial.Dates, recalledDate)
+			productCommercialAsBytes, _ = json.Marshal(productCommercial)
+			err = ctx.GetStub().PutState(productCommercialKey(ctx, productCommercialId), productCommercialAsBytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to recall %s: %s", productCommercialId, err.Error())
+			}
+		}
+
+		productOrderIds, err := indexedIds(ctx, orderByProductIndex, product.ProductId)
+		if err != nil {
+			return nil, err
+		}
+		for _, orderId := range productOrderIds {
+			orderIds = appendDistinct(orderIds, orderId)
+		}
+	}
+
+	for _, orderId := range orderIds {
+		orderAsBytes, err := ctx.GetStub().GetState(orderKey(ctx, orderId))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+		}
+		if orderAsBytes == nil {
+			continue
+		}
+		order := new(Order)
+		_ = json.Unmarshal(orderAsBytes, order)
+
+		for i, item := range order.ProductItemList {
+			if recalled[item.Product.ProductId] && item.Product.Status != "RECALLED" {
+				order.ProductItemList[i].Product.Status = "RECALLED"
+				order.ProductItemList[i].Product.Dates = append(item.Product.Dates, recalledDate)
+			}
+		}
+
+		recall.OrderIds = append(recall.OrderIds, order.OrderId)
+		recall.Holders = appendActor(recall.Holders, order.Retailer)
+		recall.Holders = appendActor(recall.Holders, order.Manufacturer)
+		recall.Holders = appendActor(recall.Holders, order.Distributor)
+
+		orderAsBytes, _ = json.Marshal(order)
+		err = ctx.GetStub().PutState(orderKey(ctx, order.OrderId), orderAsBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to flag order %s: %s", order.OrderId, err.Error())
+		}
+	}
+
+	recallAsBytes, _ := json.Marshal(recall)
+	err = ctx.GetStub().PutState(recallKey(ctx, recall.RecallId), recallAsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save recall: %s", err.Error())
+	}
+
+	return &recall, nil
+}
+
+func (s *SmartContract) GetRecall(ctx contractapi.TransactionContextInterface, recallId string) (*Recall, error) {
+	recallAsBytes, err := ctx.GetStub().GetState(recallKey(ctx, recallId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if recallAsBytes == nil {
+		return nil, fmt.Errorf("%s does not exist", recallId)
+	}
+
+	recall := new(Recall)
+	_ = json.Unmarshal(recallAsBytes, recall)
+
+	// acknowledgements made before they had keys of their own stay inline
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(recallAckObjectType, []string{recallId})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
 		}
 
-		timestamp, err := ptypes.Timestamp(response.Timestamp)
+		var acknowledgement RecallAcknowledgement
+		_ = json.Unmarshal(response.Value, &acknowledgement)
+		recall.Acknowledgements = append(recall.Acknowledgements, acknowledgement)
+	}
+
+	return recall, nil
+}
+
+// GetRecallImpact lists the orders holding recalled items, their retailers, and the holders yet to acknowledge the recall
+func (s *SmartContract) GetRecallImpact(ctx contractapi.TransactionContextInterface, recallId string) (*RecallImpact, error) {
+	recall, err := s.GetRecall(ctx, recallId)
+	if err != nil {
+		return nil, err
+	}
+
+	impact := RecallImpact{
+		RecallId: 		recallId,
+		Orders: 		[]*Order{},
+		Retailers: 		[]Actor{},
+		Holders: 		recall.Holders,
+		Unacknowledged: []Actor{},
+	}
+	if impact.Holders == nil {
+		impact.Holders = []Actor{}
+	}
+
+	seen := map[TokenAccount]bool{}
+	for _, orderId := range recall.OrderIds {
+		order, err := s.GetOrder(ctx, orderId)
 		if err != nil {
 			return nil, err
 		}
+		impact.Orders = append(impact.Orders, order)
+		if !seen[actorAccount(order.Retailer)] {
+			seen[actorAccount(order.Retailer)] = true
+			impact.Retailers = append(impact.Retailers, order.Retailer)
+		}
+	}
+
+	for _, holder := range impact.Holders {
+		acknowledged := false
+		for _, acknowledgement := range recall.Acknowledgements {
+			if actorAccount(acknowledgement.Actor) == actorAccount(holder) {
+				acknowledged = true
+			}
+		}
+		if !acknowledged {
+			impact.Unacknowledged = append(impact.Unacknowledged, holder)
+		}
+	}
+
+	return &impact, nil
+}
+
+// AcknowledgeRecall records on the recall that the submitting holder took notice of it
+func (s *SmartContract) AcknowledgeRecall(ctx contractapi.TransactionContextInterface, recallId string, note string) (*Recall, error) {
+	user, err := getSubmittingUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	recall, err := s.GetRecall(ctx, recallId)
+	if err != nil {
+		return nil, err
+	}
+
+	holder := false
+	for _, actor := range recall.Holders {
+		if isActor(actor, user) {
+			holder = true
+		}
+	}
+	if !holder {
+		return nil, fmt.Errorf("Permission denied!")
+	}
+	for _, acknowledgement := range recall.Acknowledgements {
+		if isActor(acknowledgement.Actor, user) {
+			return nil, fmt.Errorf("recall %s is already acknowledged by %s", recallId, user.UserId)
+		}
+	}
+
+	txTimeAsPtr, errTx := s.GetTxTimestampChannel(ctx)
+	if errTx != nil {
+		return nil, fmt.Errorf("transaction timeStamp error")
+	}
+
+	acknowledgement := RecallAcknowledgement{
+		Actor: 	parseUserToActor(user),
+		Note: 	note,
+		Time: 	txTimeAsPtr,
+	}
+	acknowledgementAsBytes, _ := json.Marshal(acknowledgement)
+	ackKey, err := ctx.GetStub().CreateCompositeKey(recallAckObjectType, []string{recall.RecallId, user.MSPID, user.UserId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create acknowledgement key: %s", err.Error())
+	}
+	err = ctx.GetStub().PutState(ackKey, acknowledgementAsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save acknowledgement: %s", err.Error())
+	}
+
+	recall.Acknowledgements = append(recall.Acknowledgements, acknowledgement)
+	return recall, nil
+}
+
+// Certificates are kept in the registry of the coffee batch chaincode (go/chaincode/certificate.go), where
+// certification bodies issue, suspend and revoke them. This chaincode only reads them from there.
+const (
+	certificateRegistryKey = "CertificateRegistry"
+	certificateDateLayout = "2006-01-02"
+)
+
+// CertificateRegistry names the chaincode holding the certificate registry
+type CertificateRegistry struct {
+	ChaincodeName 	string `json:"chaincodeName"`
+	Channel 		string `json:"channel" metadata:",optional"` // "" for the channel of this chaincode
+}
+
+// Certificate is a certification as the registry records it. Status is ACTIVE, SUSPENDED or REVOKED.
+type Certificate struct {
+	CertificateNo 	string 		`json:"certificateNo"`
+	IssuerId 		string 		`json:"issuerId"`
+	Holder 			string 		`json:"holder" metadata:",optional"` // supplier user ID, "" if not bound to a holder
+	Scope 			string 		`json:"scope"`
+	ProductTypes 	[]string 	`json:"productTypes" metadata:",optional"` // product codes or names, empty covers every product
+	ValidFrom 		string 		`json:"validFrom"` // 2006-01-02, inclusive
+	ValidTo 		string 		`json:"validTo"` // 2006-01-02, inclusive
+	DocumentHash 	string 		`json:"documentHash"`
+	Status 			string 		`json:"status" metadata:",optional"`
+	StatusReason 	string 		`json:"statusReason" metadata:",optional"`
+	IssuedAt 		string 		`json:"issuedAt" metadata:",optional"`
+	UpdatedAt 		string 		`json:"updatedAt" metadata:",optional"`
+}
+
+// SetCertificateRegistry points certificate checks at the chaincode holding the registry
+func (s *SmartContract) SetCertificateRegistry(ctx contractapi.TransactionContextInterface, registry CertificateRegistry) (*CertificateRegistry, error) {
+	_, _, role, err := getClientIdentity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if role != "admin" {
+		return nil, fmt.Errorf("user must be an admin")
+	}
+
+	if registry.ChaincodeName == "" {
+		return nil, fmt.Errorf("chaincodeName is required")
+	}
+
+	registryAsBytes, _ := json.Marshal(registry)
+	err = ctx.GetStub().PutState(certificateRegistryKey, registryAsBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save certificate registry: %s", err.Error())
+	}
+
+	return &registry, nil
+}
+
+func (s *SmartContract) GetCertificateRegistry(ctx contractapi.TransactionContextInterface) (*CertificateRegistry, error) {
+	registryAsBytes, err := ctx.GetStub().GetState(certificateRegistryKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state. %s", err.Error())
+	}
+	if registryAsBytes == nil {
+		return nil, fmt.Errorf("certificate registry is not configured")
+	}
+
+	registry := new(CertificateRegistry)
+	_ = json.Unmarshal(registryAsBytes, registry)
+
+	return registry, nil
+}
+
+// GetCertificate reads a certificate from the registry chaincode
+func (s *SmartContract) GetCertificate(ctx contractapi.TransactionContextInterface, certificateNo string) (*Certificate, error) {
+	registry, err := s.GetCertificateRegistry(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	args := [][]byte{[]byte("ViewCertificate"), []byte(certificateNo)}
+	response := ctx.GetStub().InvokeChaincode(registry.ChaincodeName, args, registry.Channel)
+	if response.Status != shim.OK {
+		return nil, fmt.Errorf("certificate %s could not be read from %s: %s", certificateNo, registry.ChaincodeName, response.Message)
+	}
+
+	certificate := new(Certificate)
+	err = json.Unmarshal(response.Payload, certificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate %s: %s", certificateNo, err.Error())
+	}
+
+	return certificate, nil
+}
+
+// checkCertificate returns the certificate if it is registered, active, valid now, held by holder when it names
+// a holder, and covers the product
+func (s *SmartContract) checkCertificate(ctx contractapi.TransactionContextInterface, certificateNo string, holder string, productCode string, productName string) (*Certificate, error) {
+	if certificateNo == "" {
+		return nil, fmt.Errorf("certificateNo is required")
+	}
+	certificate, err := s.GetCertificate(ctx, certificateNo)
+	if err != nil {
+		return nil, err
+	}
+	if certificate.Status != "ACTIVE" {
+		return nil, fmt.Errorf("certificate %s is %s", certificateNo, certificate.Status)
+	}
+
+	now, err := getTxTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	today := now.UTC().Format(certificateDateLayout)
+	if today < certificate.ValidFrom || today > certificate.ValidTo {
+		return nil, fmt.Errorf("certificate %s is valid from %s to %s", certificateNo, certificate.ValidFrom, certificate.ValidTo)
+	}
+
+	if certificate.Holder != "" && certificate.Holder != holder {
+		return nil, fmt.Errorf("certificate %s is held by %s", certificateNo, certificate.Holder)
+	}
+
+	if len(certificate.ProductTypes) > 0 {
+		covered := false
+		for _, productType := range certificate.ProductTypes {
+			if strings.EqualFold(productType, productCode) || strings.EqualFold(productType, productName) {
+				covered = true
+			}
+		}
+		if !covered {
+			return nil, fmt.Errorf("certificate %s does not cover %s", certificateNo, productName)
+		}
+	}
+
+	return certificate, nil
+}
+
+func (s *SmartContract) GetProductTransactionHistory(ctx contractapi.TransactionContextInterface, productId string) ([]ProductHistory, error) {
+	// records moved off their raw ID keep their earlier history under it
+	var histories []ProductHistory
+	for _, key := range []string{productId, productKey(ctx, productId)} {
+		resultsIterator, err := ctx.GetStub().GetHistoryForKey(key)
+
+		if err != nil {
+			return nil, fmt.Errorf(err.Error())
+		}
+		defer resultsIterator.Close()
+
+		for resultsIterator.HasNext() {
+			response, err := resultsIterator.Next()
+
+			if err != nil {
+				return nil, err
+			}
+
+			var product Product
+			if len(response.Value) > 0 {
+				err = json.Unmarshal(response.Value, &product)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				product = Product{
+					ProductId: productId,
+				}
+			}
+
+			timestamp, err := ptypes.Timestamp(response.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+
+			productHistory := ProductHistory{
+				Record: &product,
+				TransactionId: response.TxId,
+				Timestamp: timestamp,
+				IsDelete: response.IsDelete,
+			}
+			histories = append(histories, productHistory)
+		}
+	}
+
+	if len(histories) == 0 {
+		return []ProductHistory{}, nil
+	}
+
+	return histories, nil
+}
+
+func (s *SmartContract) GetProductCommercialTransactionHistory(ctx contractapi.TransactionContextInterface, productCommercialId string) ([]ProductCommercialHistory, error) {
+	// records moved off their raw ID keep their earlier history under it
+	var histories []ProductCommercialHistory
+	for _, key := range []string{productCommercialId, productCommercialKey(ctx, productCommercialId)} {
+		resultsIterator, err := ctx.GetStub().GetHistoryForKey(key)
+		if err != nil {
+			return nil, fmt.Errorf(err.Error())
+		}
+		defer resultsIterator.Close()
+
+		for resultsIterator.HasNext() {
+			response, err := resultsIterator.Next()
+
+			if err != nil {
+				return nil, err
+			}
+
+			var productCommercial ProductCommercial
+			if len(response.Value) > 0 {
+				err = json.Unmarshal(response.Value, &productCommercial)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				productCommercial = ProductCommercial{
+					ProductCommercialId: productCommercialId,
+				}
+			}
+
+			timestamp, err := ptypes.Timestamp(response.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+
+			ProductCommercialHistory := ProductCommercialHistory{
+				Record: &productCommercial,
+				TransactionId: response.TxId,
+				Timestamp: timestamp,
+				IsDelete: response.IsDelete,
+			}
+			histories = append(histories, ProductCommercialHistory)
+		}
+	}
+
+	if len(histories) == 0 {
+		return []ProductCommercialHistory{}, nil
+	}
+
+	return histories, nil
+}
+
+func (s *SmartContract) GetOrderTransactionHistory(ctx contractapi.TransactionContextInterface, orderId string) ([]OrderHistory, error) {
+	// records moved off their raw ID keep their earlier history under it
+	var histories []OrderHistory
+	for _, key := range []string{orderId, orderKey(ctx, orderId)} {
+		resultsIterator, err := ctx.GetStub().GetHistoryForKey(key)
+		if err != nil {
+			return nil, fmt.Errorf(err.Error())
+		}
+		defer resultsIterator.Close()
+
+		for resultsIterator.HasNext() {
+			response, err := resultsIterator.Next()
+
+			if err != nil {
+				return nil, err
+			}
 
-		orderHistory := OrderHistory{
-			Record: &order,
-			TransactionId: response.TxId,
-			Timestamp: timestamp,
-			IsDelete: response.IsDelete,
+			var order Order
+			if len(response.Value) > 0 {
+				err = json.Unmarshal(response.Value, &order)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				order = Order{
+					OrderId: orderId,
+				}
+			}
+
+			timestamp, err := ptypes.Timestamp(response.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+
+			orderHistory := OrderHistory{
+				Record: &order,
+				TransactionId: response.TxId,
+				Timestamp: timestamp,
+				IsDelete: response.IsDelete,
+			}
+			histories = append(histories, orderHistory)
 		}
-		histories = append(histories, orderHistory)
 	}
 
 	if len(histories) == 0 {